@@ -0,0 +1,32 @@
+package main
+
+import (
+	"uk.ac.bris.cs/gameoflife/batch"
+	"uk.ac.bris.cs/gameoflife/gol"
+)
+
+// Runs the jobs of a batch with up to parallel of them at once, each with the settings of defaults not in the job file.
+// run simulates a job and returns the alive cells, which are written in the format of defaults.
+// Returns the results in the order of the jobs.
+func runBatch(jobs []batch.Job, parallel int, defaults golParams, run func(golParams) ([]cell, error)) ([]batch.Result, error) {
+	f, err := formatByName(defaults.format)
+	if err != nil {
+		return nil, err
+	}
+	return batch.Run(jobs, parallel, f.extensions[0], func(job batch.Job) (int, func(string) error, error) {
+		p := defaults
+		p.input, p.rule = job.Input, &job.Rule
+		p.imageWidth, p.imageHeight, p.turns, p.threads = job.Width, job.Height, job.Turns, job.Threads
+		alive, err := run(p)
+		if err != nil {
+			return 0, nil, err
+		}
+		return len(alive), func(image string) error {
+			width, height := p.imageWidth, p.imageHeight
+			if p.topology == gol.Plane {
+				width, height, alive = cropCells(alive)
+			}
+			return writeImageFile(image, f, width, height, cellPixels(width, height, alive), imageHeader{rule: job.Rule})
+		}, nil
+	}), nil
+}
@@ -0,0 +1,171 @@
+// Package batch runs simulations listed in a job file, a few at once, and writes their results as CSV.
+// It knows nothing of how a job is simulated, so every program running batches shares it.
+package batch
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+	"uk.ac.bris.cs/gameoflife/protocol"
+)
+
+// Job is a simulation of a batch, read from one line of a job file
+type Job struct {
+	Line    int // Line of the job file
+	Input   string
+	Rule    protocol.Rule
+	Width   int
+	Height  int
+	Turns   int
+	Threads int
+	Output  string // Directory the final world is written to
+}
+
+// Result is the outcome of a job, written to the manifest
+type Result struct {
+	Job        Job
+	Population int
+	Runtime    time.Duration
+	Image      string // Image of the final world
+	Err        error
+}
+
+// Simulate runs a job, returning the number of alive cells left and a function writing the final world to an image.
+// The image is written once the runtime of the job is measured.
+type Simulate func(job Job) (population int, save func(image string) error, err error)
+
+// ReadJobFile reads a job file, where each line is a job with the columns
+//
+//	input rule size turns threads output
+//
+// such as
+//
+//	images/64x64.pgm B36/S23 64x64 1000 8 out/highlife
+//
+// Blank lines and lines starting with # are skipped.
+func ReadJobFile(path string) ([]Job, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var jobs []Job
+	for i, line := range strings.Split(string(data), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		if len(fields) != 6 {
+			return nil, fmt.Errorf("%s:%d: expected input, rule, size, turns, threads and output, got %d columns", path, i+1, len(fields))
+		}
+
+		job := Job{Line: i + 1, Input: fields[0], Output: fields[5]}
+		job.Rule, err = protocol.ParseRule(fields[1])
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %v", path, i+1, err)
+		}
+		_, err = fmt.Sscanf(fields[2], "%dx%d", &job.Width, &job.Height)
+		if err != nil || job.Width < 1 || job.Height < 1 {
+			return nil, fmt.Errorf("%s:%d: size %q is not [width]x[height]", path, i+1, fields[2])
+		}
+		job.Turns, err = strconv.Atoi(fields[3])
+		if err != nil || job.Turns < 0 {
+			return nil, fmt.Errorf("%s:%d: turns %q is not a number of turns", path, i+1, fields[3])
+		}
+		job.Threads, err = strconv.Atoi(fields[4])
+		if err != nil || job.Threads < 1 {
+			return nil, fmt.Errorf("%s:%d: threads %q is not a number of threads", path, i+1, fields[4])
+		}
+		jobs = append(jobs, job)
+	}
+	return jobs, nil
+}
+
+// Run runs the jobs in order, with up to parallel of them at once, and writes their final worlds to images with the
+// given extension in their output directories. Returns the results in the order of the jobs.
+func Run(jobs []Job, parallel int, extension string, simulate Simulate) []Result {
+	if parallel < 1 {
+		parallel = 1
+	}
+	results := make([]Result, len(jobs))
+	running := make(chan byte, parallel)
+	for i := range jobs {
+		running <- 1
+		go func(i int) {
+			results[i] = runJob(jobs[i], extension, simulate)
+			<-running
+		}(i)
+	}
+	// Wait for the last jobs
+	for i := 0; i < parallel; i++ {
+		running <- 1
+	}
+	return results
+}
+
+// Runs a job, and writes the final world to its output directory
+func runJob(job Job, extension string, simulate Simulate) Result {
+	result := Result{Job: job}
+
+	err := os.MkdirAll(job.Output, os.ModePerm)
+	if err != nil {
+		fmt.Println("Job on line", job.Line, "failed:", err)
+		result.Err = err
+		return result
+	}
+
+	fmt.Println("Running job on line", job.Line)
+	start := time.Now()
+	population, save, err := simulate(job)
+	result.Runtime = time.Since(start)
+	if err != nil {
+		fmt.Println("Job on line", job.Line, "failed:", err)
+		result.Err = err
+		return result
+	}
+	result.Population = population
+
+	input := filepath.Base(job.Input)
+	name := fmt.Sprintf("line%d-%s-%s-%d%s", job.Line, strings.TrimSuffix(input, filepath.Ext(input)),
+		strings.Replace(job.Rule.String(), "/", "", 1), job.Turns, extension)
+	result.Image = filepath.Join(job.Output, name)
+	result.Err = save(result.Image)
+	return result
+}
+
+// WriteManifest writes the results of a batch as CSV, one row per job
+func WriteManifest(path string, results []Result) error {
+	file, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	w := csv.NewWriter(file)
+	_ = w.Write([]string{"line", "input", "rule", "size", "turns", "threads", "population", "seconds", "output", "error"})
+	for _, r := range results {
+		errorText := ""
+		if r.Err != nil {
+			errorText = r.Err.Error()
+		}
+		_ = w.Write([]string{
+			strconv.Itoa(r.Job.Line),
+			r.Job.Input,
+			r.Job.Rule.String(),
+			strconv.Itoa(r.Job.Width) + "x" + strconv.Itoa(r.Job.Height),
+			strconv.Itoa(r.Job.Turns),
+			strconv.Itoa(r.Job.Threads),
+			strconv.Itoa(r.Population),
+			strconv.FormatFloat(r.Runtime.Seconds(), 'f', 3, 64),
+			r.Image,
+			errorText,
+		})
+	}
+	w.Flush()
+	return w.Error()
+}
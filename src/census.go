@@ -0,0 +1,43 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"uk.ac.bris.cs/gameoflife/gol"
+)
+
+// Prints a census of the world at the current turn, and writes it as JSON
+func reportCensus(p golParams, sim *gol.Simulation) error {
+	turn := sim.Turn()
+	census := sim.Census()
+	fmt.Println("Census on turn", turn, "is", census)
+	path, err := writeCensus(p, turn, census)
+	if err != nil {
+		return err
+	}
+	fmt.Println("Census written to", path)
+	return nil
+}
+
+// Writes a census of the world at a turn as JSON, next to the images, and returns the path of the file
+func writeCensus(p golParams, turn int, census gol.Census) (string, error) {
+	dir := "out"
+	if p.outputDir != "" {
+		dir = p.outputDir
+	}
+	err := os.MkdirAll(dir, os.ModePerm)
+	if err != nil {
+		return "", err
+	}
+
+	data, err := json.MarshalIndent(census, "", "  ")
+	if err != nil {
+		return "", err
+	}
+	path := filepath.Join(dir, strconv.Itoa(p.imageWidth)+"x"+strconv.Itoa(p.imageHeight)+"_census_"+strconv.Itoa(turn)+".json")
+	return path, ioutil.WriteFile(path, append(data, '\n'), 0644)
+}
@@ -69,7 +69,8 @@ func analyseCpuTimes() {
 
 func readBenchmarks(file []byte) []bench {
 	numberRegex, _ := regexp.Compile(`\d+`)
-	rowRegex, _ := regexp.Compile(`\d+x\d+x\d+-?\d*\s+\d+\s+\d+ ns/op`)
+	// Benchmarks of your solution are named by their engine after their size
+	rowRegex, _ := regexp.Compile(`\d+x\d+x\d+(/[a-z]+)?-?\d*\s+\d+\s+\d+ ns/op`)
 	rows := rowRegex.FindAllString(string(file), -1)
 	benchmarks := make([]bench, len(rows))
 	for i, row := range rows {
@@ -1,8 +1,15 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"github.com/nsf/termbox-go"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+	"uk.ac.bris.cs/gameoflife/gol"
 )
 
 // getKeyboardCommand sends all keys pressed on the keyboard as runes (characters) on the key chan.
@@ -21,13 +28,16 @@ func getKeyboardCommand(key chan<- rune) {
 }
 
 // startControlServer initialises termbox and prints basic information about the game configuration.
-func startControlServer(p golParams) {
+func startControlServer(p golParams) error {
 	e := termbox.Init()
-	check(e)
+	if e != nil {
+		return e
+	}
 
 	fmt.Println("Threads:", p.threads)
 	fmt.Println("Width:", p.imageWidth)
 	fmt.Println("Height:", p.imageHeight)
+	return nil
 }
 
 // stopControlServer closes termbox.
@@ -35,3 +45,162 @@ func startControlServer(p golParams) {
 func StopControlServer() {
 	termbox.Close()
 }
+
+// Sends a command to the io goroutine, unless ctx is cancelled first
+func sendCommand(ctx context.Context, d distributorChans, command ioCommand) error {
+	select {
+	case d.io.command <- command:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Reads the image from the io goroutine, and returns its alive cells
+func readWorld(ctx context.Context, p golParams, d distributorChans) ([]gol.Cell, error) {
+	// Request the io goroutine to read in the image with the given filename.
+	err := sendCommand(ctx, d, ioInput)
+	if err != nil {
+		return nil, err
+	}
+	d.io.filename <- strings.Join([]string{strconv.Itoa(p.imageWidth), strconv.Itoa(p.imageHeight)}, "x")
+	err = <-d.io.inputErr
+	if err != nil {
+		return nil, err
+	}
+
+	// The io goroutine sends the requested image a row at a time.
+	var cells []gol.Cell
+	for y := 0; y < p.imageHeight; y++ {
+		row := <-d.io.input
+		for x, val := range row {
+			if val != 0 {
+				fmt.Println("Alive cell at", x, y)
+				cells = append(cells, gol.Cell{X: x, Y: y})
+			}
+		}
+	}
+	return cells, nil
+}
+
+// Sends world to output, which it must not be changed after. Returns as soon as the io goroutine has it, so the
+// simulation carries on while the image is written.
+func outputWorld(ctx context.Context, p golParams, state int, d distributorChans, world [][]byte) error {
+	err := sendCommand(ctx, d, ioOutput)
+	if err != nil {
+		return err
+	}
+	filename := strings.Join([]string{strconv.Itoa(len(world[0])), strconv.Itoa(len(world))}, "x") + "_state_" + strconv.Itoa(state)
+	d.io.output <- ioImage{filename: filename, world: world}
+	return nil
+}
+
+// Saves the world of the current turn. A plane saved as a macrocell file is written straight from its alive cells,
+// named after the size of the smallest world holding them, as a pattern which has spread far cannot be drawn whole.
+func saveWorld(ctx context.Context, p golParams, sim *gol.Simulation, d distributorChans, message string) error {
+	if p.topology != gol.Plane || p.format != "mc" {
+		snapshot := sim.Snapshot()
+		fmt.Println(message, snapshot.Turn)
+		return outputWorld(ctx, p, snapshot.Turn, d, snapshot.World)
+	}
+	pattern := sim.Pattern()
+	fmt.Println(message, pattern.Turn)
+	cells := pattern.Cells
+	var min, max gol.Cell
+	for i, c := range cells {
+		if i == 0 || c.X < min.X {
+			min.X = c.X
+		}
+		if i == 0 || c.X > max.X {
+			max.X = c.X
+		}
+		if i == 0 || c.Y < min.Y {
+			min.Y = c.Y
+		}
+		if i == 0 || c.Y > max.Y {
+			max.Y = c.Y
+		}
+	}
+	dir := "out"
+	if p.outputDir != "" {
+		dir = p.outputDir
+	}
+	err := os.MkdirAll(dir, os.ModePerm)
+	if err != nil {
+		return err
+	}
+	rule := gol.Conway
+	if p.rule != nil {
+		rule = *p.rule
+	}
+	filename := strconv.Itoa(max.X-min.X+1) + "x" + strconv.Itoa(max.Y-min.Y+1) + "_state_" + strconv.Itoa(pattern.Turn)
+	err = writeMacrocellFile(filepath.Join(dir, filename+".mc"), cells, rule)
+	if err == nil {
+		fmt.Println("File", filename, "output done!")
+	}
+	return err
+}
+
+// Waits for the io goroutine to finish any output, and returns the first error writing an image
+func checkIdle(ctx context.Context, d distributorChans) error {
+	err := sendCommand(ctx, d, ioCheckIdle)
+	if err != nil {
+		return err
+	}
+	return <-d.io.idle
+}
+
+// Runs the simulation to its last turn, controlled by the keys: p pauses and resumes, s saves the world and any
+// heatmap, and q saves the world and quits.
+// Prints the number of alive cells every 2 seconds.
+// Returns ctx.Err() if ctx is cancelled first.
+func controlSimulation(ctx context.Context, p golParams, sim *gol.Simulation, d distributorChans, keyChan <-chan rune) error {
+	runCtx, quit := context.WithCancel(ctx)
+	defer quit()
+	finished := make(chan error, 1)
+	go func() {
+		finished <- sim.Run(runCtx)
+	}()
+
+	paused := false
+	ticker := time.NewTicker(2 * time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if !paused {
+				fmt.Println("There are", sim.Population(), "alive cells in the world.")
+			}
+		case k := <-keyChan:
+			switch k {
+			case 'p':
+				if paused {
+					sim.Resume()
+					fmt.Println("Continuing.")
+				} else {
+					sim.Pause()
+					fmt.Println("Pausing on turn", sim.Turn())
+				}
+				paused = !paused
+			case 's':
+				err := saveWorld(ctx, p, sim, d, "Saving on turn")
+				if err == nil {
+					err = reportHeatmap(p, sim)
+				}
+				if err != nil {
+					quit()
+					<-finished
+					return err
+				}
+			case 'q':
+				sim.Pause()
+				err := saveWorld(ctx, p, sim, d, "Saving and quitting on turn")
+				quit()
+				<-finished
+				return err
+			}
+		case err := <-finished:
+			return err
+		}
+	}
+}
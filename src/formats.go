@@ -0,0 +1,555 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"uk.ac.bris.cs/gameoflife/gol"
+)
+
+// An image format worlds are read from and written to, as pixels row by row which are 0xFF when alive
+type imageFormat struct {
+	name       string
+	extensions []string // Extensions of the files of the format, the first of which is given to the files written
+	// pattern is set for formats which only hold the alive cells, so their files can be smaller than the world
+	pattern bool
+	// read reads an image for a world of worldWidth by worldHeight. Images which do not fit are refused before
+	// their pixels are made, and those which make no pixels are checked against the world once read.
+	read func(data []byte, worldWidth, worldHeight int) (width, height int, pixels []byte, err error)
+	// write writes a world, with as much of the header as the format has room for
+	write func(w *bufio.Writer, width, height int, pixels []byte, header imageHeader) error
+}
+
+// What is written about a world besides its cells
+type imageHeader struct {
+	comment string
+	rule    gol.Rule
+}
+
+// Formats by name, given to -format
+var imageFormats = map[string]*imageFormat{
+	"pgm":      {name: "pgm", extensions: []string{".pgm"}, read: raster(readPgmData), write: writePgmData},
+	"pbm":      {name: "pbm", extensions: []string{".pbm"}, read: readPbmData, write: writeRawPbm},
+	"plainpbm": {name: "plainpbm", extensions: []string{".pbm"}, read: readPbmData, write: writePlainPbm},
+	"png":      {name: "png", extensions: []string{".png"}, read: readPngData, write: writePngData},
+	"cells":    {name: "cells", extensions: []string{".cells"}, pattern: true, read: readCells, write: writeCells},
+	"life":     {name: "life", extensions: []string{".lif", ".life"}, pattern: true, read: readLife106, write: writeLife106},
+	"mc":       {name: "mc", extensions: []string{".mc"}, pattern: true, read: readMacrocellData, write: writeMacrocellData},
+}
+
+// Adapts the reader of a format which holds every cell of the world and makes no pixels of its own, so it can be read
+// for a world of any size. Its images are checked against the world once read.
+func raster(read func(data []byte) (int, int, []byte, error)) func([]byte, int, int) (int, int, []byte, error) {
+	return func(data []byte, worldWidth, worldHeight int) (int, int, []byte, error) {
+		return read(data)
+	}
+}
+
+// Returns the format with the given name, or pgm when it is empty
+func formatByName(name string) (*imageFormat, error) {
+	if name == "" {
+		name = "pgm"
+	}
+	f, ok := imageFormats[name]
+	if !ok {
+		var names []string
+		for n := range imageFormats {
+			names = append(names, n)
+		}
+		sort.Strings(names)
+		return nil, fmt.Errorf("unknown format %q, expected one of %s", name, strings.Join(names, ", "))
+	}
+	return f, nil
+}
+
+// Returns the format of a file from its extension, or the format with the name fallback if it has none of theirs.
+// Plain and raw pbm files share an extension, and are both read by either.
+func formatOf(path, fallback string) (*imageFormat, error) {
+	extension := strings.ToLower(filepath.Ext(path))
+	for _, name := range []string{"pgm", "pbm", "png", "cells", "life", "mc"} {
+		for _, e := range imageFormats[name].extensions {
+			if e == extension {
+				return imageFormats[name], nil
+			}
+		}
+	}
+	return formatByName(fallback)
+}
+
+// Reads an image for a world of worldWidth by worldHeight in the format of its extension, or the format named fallback,
+// returning its width, height and pixels
+func readImageFile(path, fallback string, worldWidth, worldHeight int) (int, int, []byte, *imageFormat, error) {
+	f, err := formatOf(path, fallback)
+	if err != nil {
+		return 0, 0, nil, nil, err
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return 0, 0, nil, nil, err
+	}
+	width, height, pixels, err := f.read(data, worldWidth, worldHeight)
+	if err != nil {
+		return 0, 0, nil, nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return width, height, pixels, f, nil
+}
+
+// Writes an image in a format through a buffer, so the file is written in large blocks
+func writeImageFile(path string, f *imageFormat, width, height int, pixels []byte, header imageHeader) error {
+	file, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriterSize(file, 64*1024)
+	err = f.write(w, width, height, pixels, header)
+	if err == nil {
+		err = w.Flush()
+	}
+	if err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// Reads the first count fields of the header of a pnm file, skipping comments, which run from a # to the end of the
+// line. Returns the fields and the data after the line of the last one.
+func pnmHeader(data []byte, count int) ([]string, []byte) {
+	var fields []string
+	rest := data
+	for len(fields) < count && len(rest) > 0 {
+		line := rest
+		end := bytes.IndexByte(rest, '\n')
+		if end >= 0 {
+			line, rest = rest[:end], rest[end+1:]
+		} else {
+			rest = nil
+		}
+		if comment := bytes.IndexByte(line, '#'); comment >= 0 {
+			line = line[:comment]
+		}
+		fields = append(fields, strings.Fields(string(line))...)
+	}
+	return fields, rest
+}
+
+// Returns the width and height of the header of a pnm file
+func pnmSize(fields []string) (int, int, error) {
+	width, err := strconv.Atoi(fields[1])
+	if err != nil || width < 1 {
+		return 0, 0, fmt.Errorf("invalid width")
+	}
+	height, err := strconv.Atoi(fields[2])
+	if err != nil || height < 1 {
+		return 0, 0, fmt.Errorf("invalid height")
+	}
+	return width, height, nil
+}
+
+// Returns why an image of width by height cannot be read for a world of worldWidth by worldHeight, or nil if it fits,
+// so the pixels of a huge image are never made
+func fitImage(width, height, worldWidth, worldHeight int) error {
+	if width > worldWidth || height > worldHeight {
+		return fmt.Errorf("a %dx%d image does not fit in a %dx%d world", width, height, worldWidth, worldHeight)
+	}
+	return nil
+}
+
+// Returns whether rows of rowBytes bytes each fit in the available bytes. They are divided rather than multiplied, so
+// sizes from a header cannot overflow into a small one.
+func rowsFit(rows, rowBytes, available int) bool {
+	return available >= 0 && rowBytes <= available/rows
+}
+
+// Writes the header of a pnm file, with the comment after the magic number
+func writePnmHeader(w *bufio.Writer, magic string, width, height int, comment string) {
+	_, _ = w.WriteString(magic + "\n")
+	if comment != "" {
+		_, _ = w.WriteString("# " + comment + "\n")
+	}
+	_, _ = w.WriteString(strconv.Itoa(width) + " " + strconv.Itoa(height) + "\n")
+}
+
+func readPgmData(data []byte) (int, int, []byte, error) {
+	fields, _ := pnmHeader(data, 4)
+	if len(fields) < 4 || fields[0] != "P5" {
+		return 0, 0, nil, fmt.Errorf("not a pgm file")
+	}
+	width, height, err := pnmSize(fields)
+	if err != nil {
+		return 0, 0, nil, err
+	}
+	if fields[3] != "255" {
+		return 0, 0, nil, fmt.Errorf("does not have a maxval of 255")
+	}
+	// The pixels follow the single whitespace after the maxval
+	if !rowsFit(height, width, len(data)-1) {
+		return 0, 0, nil, fmt.Errorf("missing pixels")
+	}
+	return width, height, data[len(data)-width*height:], nil
+}
+
+func writePgmData(w *bufio.Writer, width, height int, pixels []byte, header imageHeader) error {
+	writePnmHeader(w, "P5", width, height, header.comment)
+	_, _ = w.WriteString("255\n")
+	_, err := w.Write(pixels)
+	return err
+}
+
+// Reads a plain P1 or raw P4 pbm file, where 1 is an alive cell
+func readPbmData(data []byte, worldWidth, worldHeight int) (int, int, []byte, error) {
+	fields, rest := pnmHeader(data, 3)
+	if len(fields) < 3 || (fields[0] != "P1" && fields[0] != "P4") {
+		return 0, 0, nil, fmt.Errorf("not a pbm file")
+	}
+	width, height, err := pnmSize(fields)
+	if err == nil {
+		err = fitImage(width, height, worldWidth, worldHeight)
+	}
+	if err != nil {
+		return 0, 0, nil, err
+	}
+
+	if fields[0] == "P4" {
+		// Each row is packed into bytes, the first cell in the highest bit, and ends at the end of the data
+		rowBytes := (width + 7) / 8
+		if !rowsFit(height, rowBytes, len(data)-1) {
+			return 0, 0, nil, fmt.Errorf("missing pixels")
+		}
+		pixels := make([]byte, width*height)
+		raster := data[len(data)-rowBytes*height:]
+		for y := 0; y < height; y++ {
+			for x := 0; x < width; x++ {
+				if raster[y*rowBytes+x/8]&(0x80>>uint(x%8)) != 0 {
+					pixels[y*width+x] = 0xFF
+				}
+			}
+		}
+		return width, height, pixels, nil
+	}
+
+	// Plain pixels are the digits 0 and 1, which may be run together or split by whitespace and comments, so each
+	// takes at least a byte
+	if !rowsFit(height, width, len(rest)) {
+		return 0, 0, nil, fmt.Errorf("missing pixels")
+	}
+	pixels := make([]byte, width*height)
+	i := 0
+	comment := false
+	for _, b := range rest {
+		switch {
+		case comment:
+			comment = b != '\n'
+		case b == '#':
+			comment = true
+		case b == '0' || b == '1':
+			if i == len(pixels) {
+				return 0, 0, nil, fmt.Errorf("too many pixels")
+			}
+			if b == '1' {
+				pixels[i] = 0xFF
+			}
+			i++
+		case b != ' ' && b != '\t' && b != '\r' && b != '\n':
+			return 0, 0, nil, fmt.Errorf("pixel %q is not 0 or 1", b)
+		}
+	}
+	if i < len(pixels) {
+		return 0, 0, nil, fmt.Errorf("missing pixels")
+	}
+	return width, height, pixels, nil
+}
+
+func writeRawPbm(w *bufio.Writer, width, height int, pixels []byte, header imageHeader) error {
+	writePnmHeader(w, "P4", width, height, header.comment)
+	row := make([]byte, (width+7)/8)
+	for y := 0; y < height; y++ {
+		for i := range row {
+			row[i] = 0
+		}
+		for x := 0; x < width; x++ {
+			if pixels[y*width+x] != 0 {
+				row[x/8] |= 0x80 >> uint(x%8)
+			}
+		}
+		_, err := w.Write(row)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func writePlainPbm(w *bufio.Writer, width, height int, pixels []byte, header imageHeader) error {
+	writePnmHeader(w, "P1", width, height, header.comment)
+	// Lines of a plain pbm file should be at most 70 characters
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			digit := byte('0')
+			if pixels[y*width+x] != 0 {
+				digit = '1'
+			}
+			_ = w.WriteByte(digit)
+			if x%70 == 69 && x < width-1 {
+				_ = w.WriteByte('\n')
+			}
+		}
+		err := w.WriteByte('\n')
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Reads a png file, where the light pixels are alive cells. Its size is read first, as a small file can hold a huge
+// image.
+func readPngData(data []byte, worldWidth, worldHeight int) (int, int, []byte, error) {
+	config, err := png.DecodeConfig(bytes.NewReader(data))
+	if err == nil {
+		err = fitImage(config.Width, config.Height, worldWidth, worldHeight)
+	}
+	if err != nil {
+		return 0, 0, nil, err
+	}
+	img, err := png.Decode(bytes.NewReader(data))
+	if err != nil {
+		return 0, 0, nil, err
+	}
+	bounds := img.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+	pixels := make([]byte, width*height)
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			if color.GrayModel.Convert(img.At(bounds.Min.X+x, bounds.Min.Y+y)).(color.Gray).Y >= 0x80 {
+				pixels[y*width+x] = 0xFF
+			}
+		}
+	}
+	return width, height, pixels, nil
+}
+
+// Writes a grey png with the alive cells white. Comments are left out, as the encoder has nowhere to put them.
+func writePngData(w *bufio.Writer, width, height int, pixels []byte, header imageHeader) error {
+	img := image.NewGray(image.Rect(0, 0, width, height))
+	copy(img.Pix, pixels)
+	return png.Encode(w, img)
+}
+
+// Reads a plaintext .cells file, with a row of . for dead and O for alive cells on each line after the comments,
+// which start with a !. It is as wide as its longest row.
+func readCells(data []byte, worldWidth, worldHeight int) (int, int, []byte, error) {
+	var rows []string
+	width := 0
+	for _, line := range strings.Split(strings.Replace(string(data), "\r", "", -1), "\n") {
+		if strings.HasPrefix(line, "!") {
+			continue
+		}
+		rows = append(rows, line)
+		if len(line) > width {
+			width = len(line)
+		}
+	}
+	// The last line ends with a newline, which does not start another row
+	for len(rows) > 0 && rows[len(rows)-1] == "" {
+		rows = rows[:len(rows)-1]
+	}
+	if width == 0 {
+		// A file without cells is an empty pattern
+		return 1, 1, []byte{0}, nil
+	}
+	if width > worldWidth || len(rows) > worldHeight {
+		return 0, 0, nil, fmt.Errorf("a %dx%d pattern does not fit in a %dx%d world", width, len(rows), worldWidth, worldHeight)
+	}
+
+	pixels := make([]byte, width*len(rows))
+	for y, row := range rows {
+		for x, c := range row {
+			switch c {
+			case 'O', '*':
+				pixels[y*width+x] = 0xFF
+			case '.':
+			default:
+				return 0, 0, nil, fmt.Errorf("line %q has a cell %q which is not . or O", row, c)
+			}
+		}
+	}
+	return width, len(rows), pixels, nil
+}
+
+// Writes a .cells file with every row of the world, so it is read back the same size
+func writeCells(w *bufio.Writer, width, height int, pixels []byte, header imageHeader) error {
+	if header.comment != "" {
+		_, _ = w.WriteString("!" + header.comment + "\n")
+	}
+	row := make([]byte, width+1)
+	row[width] = '\n'
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			row[x] = '.'
+			if pixels[y*width+x] != 0 {
+				row[x] = 'O'
+			}
+		}
+		_, err := w.Write(row)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Reads a Life 1.06 file, with the x and y of an alive cell on each line after the header and comments, which start
+// with a #
+func readLife106(data []byte, worldWidth, worldHeight int) (int, int, []byte, error) {
+	var cells []gol.Cell
+	for i, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		var c gol.Cell
+		_, err := fmt.Sscanf(line, "%d %d", &c.X, &c.Y)
+		if err != nil {
+			return 0, 0, nil, fmt.Errorf("line %d is not the x and y of a cell", i+1)
+		}
+		cells = append(cells, c)
+	}
+	return patternPixels(cells, worldWidth, worldHeight)
+}
+
+func writeLife106(w *bufio.Writer, width, height int, pixels []byte, header imageHeader) error {
+	_, _ = w.WriteString("#Life 1.06\n")
+	if header.comment != "" {
+		_, _ = w.WriteString("#D " + header.comment + "\n")
+	}
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			if pixels[y*width+x] != 0 {
+				_, err := w.WriteString(strconv.Itoa(x) + " " + strconv.Itoa(y) + "\n")
+				if err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// Reads a Golly macrocell file, which is centred at 0,0
+func readMacrocellData(data []byte, worldWidth, worldHeight int) (int, int, []byte, error) {
+	cells, _, err := gol.ReadMacrocell(bytes.NewReader(data))
+	if err != nil {
+		return 0, 0, nil, err
+	}
+	return patternPixels(cells, worldWidth, worldHeight)
+}
+
+// Writes a Golly macrocell file with the rule of the header. Comments are left out, as Golly keeps none.
+func writeMacrocellData(w *bufio.Writer, width, height int, pixels []byte, header imageHeader) error {
+	var cells []gol.Cell
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			if pixels[y*width+x] != 0 {
+				cells = append(cells, gol.Cell{X: x, Y: y})
+			}
+		}
+	}
+	return gol.WriteMacrocell(w, cells, header.rule)
+}
+
+// Reads a macrocell file without expanding it into cells, so it can be loaded where it is onto a plane
+func readMacrocellFile(path string) (*gol.Macrocell, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	m, err := gol.ParseMacrocell(bufio.NewReaderSize(file, 64*1024))
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return m, nil
+}
+
+// Writes alive cells where they are to a macrocell file, so the cells of a plane are saved without drawing a world
+func writeMacrocellFile(path string, cells []gol.Cell, rule gol.Rule) error {
+	file, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	err = gol.WriteMacrocell(file, cells, rule)
+	if err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// Returns the pixels of a pattern of alive cells, which are placed at their positions from 0,0, unless some are left
+// of or above it, in which case the pattern is moved so its leftmost and topmost cells are at 0.
+// A pattern which does not fit in a world of worldWidth by worldHeight is refused before its pixels are made.
+// Without cells it is a single dead cell, so empty worlds are read back.
+func patternPixels(cells []gol.Cell, worldWidth, worldHeight int) (int, int, []byte, error) {
+	if len(cells) == 0 {
+		return 1, 1, []byte{0}, nil
+	}
+	var min, max gol.Cell
+	for i, c := range cells {
+		if i == 0 || c.X < min.X {
+			min.X = c.X
+		}
+		if i == 0 || c.Y < min.Y {
+			min.Y = c.Y
+		}
+		if i == 0 || c.X > max.X {
+			max.X = c.X
+		}
+		if i == 0 || c.Y > max.Y {
+			max.Y = c.Y
+		}
+	}
+	if min.X > 0 {
+		min.X = 0
+	}
+	if min.Y > 0 {
+		min.Y = 0
+	}
+	// Unsigned, so cells at opposite ends of the range of int do not overflow into a small pattern
+	if uint64(max.X-min.X) >= uint64(worldWidth) || uint64(max.Y-min.Y) >= uint64(worldHeight) {
+		return 0, 0, nil, fmt.Errorf("a %dx%d pattern does not fit in a %dx%d world",
+			uint64(max.X-min.X)+1, uint64(max.Y-min.Y)+1, worldWidth, worldHeight)
+	}
+	width, height := max.X-min.X+1, max.Y-min.Y+1
+	pixels := make([]byte, width*height)
+	for _, c := range cells {
+		pixels[(c.Y-min.Y)*width+c.X-min.X] = 0xFF
+	}
+	return width, height, pixels, nil
+}
+
+// Returns the pixels of a world of the given size holding a pattern of a smaller size at its top left.
+// The pattern has to fit.
+func placePattern(width, height, patternWidth, patternHeight int, pattern []byte) ([]byte, error) {
+	if patternWidth > width || patternHeight > height {
+		return nil, fmt.Errorf("a %dx%d pattern does not fit in a %dx%d world", patternWidth, patternHeight, width, height)
+	}
+	pixels := make([]byte, width*height)
+	for y := 0; y < patternHeight; y++ {
+		copy(pixels[y*width:], pattern[y*patternWidth:(y+1)*patternWidth])
+	}
+	return pixels, nil
+}
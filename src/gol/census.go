@@ -0,0 +1,440 @@
+package gol
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"uk.ac.bris.cs/gameoflife/protocol"
+)
+
+// Kind says how an object of a census behaves when left on its own
+type Kind int
+
+const (
+	// StillLife never changes
+	StillLife Kind = iota
+	// Oscillator goes back to where it started after its period
+	Oscillator
+	// Spaceship goes back to how it started after its period, but moved
+	Spaceship
+	// Unstable has not repeated itself after censusTurns turns, or dies
+	Unstable
+)
+
+var kindNames = map[Kind]string{
+	StillLife:  "still life",
+	Oscillator: "oscillator",
+	Spaceship:  "spaceship",
+	Unstable:   "unstable",
+}
+
+// String returns the name of the kind
+func (k Kind) String() string {
+	if name, ok := kindNames[k]; ok {
+		return name
+	}
+	return fmt.Sprintf("kind %d", int(k))
+}
+
+// MarshalText lets a kind be written by name, such as in JSON
+func (k Kind) MarshalText() ([]byte, error) {
+	return []byte(k.String()), nil
+}
+
+// UnmarshalText reads a kind written by MarshalText
+func (k *Kind) UnmarshalText(text []byte) error {
+	for kind, name := range kindNames {
+		if name == string(text) {
+			*k = kind
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown kind %q", text)
+}
+
+// Object is a kind of pattern found by a census
+type Object struct {
+	// Name is the common name of the object, such as block or glider. Other objects are named by their kind
+	// and a hash of their cells like apgsearch: xs with the population of a still life, xp with the period
+	// of an oscillator, xq with the period of a spaceship and zz with the population of anything else.
+	Name         string `json:"name"`
+	Kind         Kind   `json:"kind"`
+	Period       int    `json:"period"`       // 0 when unstable
+	Displacement Cell   `json:"displacement"` // Cells a spaceship moves each period, the larger distance in X
+	Cells        []Cell `json:"cells"`        // Alive cells of the phase and orientation every copy is turned into
+}
+
+// Tally is the number of copies of an object in a world
+type Tally struct {
+	Object
+	Count int `json:"count"`
+}
+
+// Census lists the objects a world is made of, the most common first
+type Census []Tally
+
+// String lists the objects and their counts, such as "block x12, blinker x5, glider x2"
+func (c Census) String() string {
+	tallies := make([]string, len(c))
+	for i, t := range c {
+		tallies[i] = t.Name + " x" + strconv.Itoa(t.Count)
+	}
+	return strings.Join(tallies, ", ")
+}
+
+// Turns an object is run for on its own to find its period
+const censusTurns = 256
+
+// Common objects, with the period they have under Conway's Game of Life
+var knownObjects = []struct {
+	name   string
+	period int
+	rows   string
+}{
+	{"block", 1, "XX/XX"},
+	{"beehive", 1, ".XX./X..X/.XX."},
+	{"loaf", 1, ".XX./X..X/.X.X/..X."},
+	{"boat", 1, "XX./X.X/.X."},
+	{"ship", 1, "XX./X.X/.XX"},
+	{"tub", 1, ".X./X.X/.X."},
+	{"pond", 1, ".XX./X..X/X..X/.XX."},
+	{"long boat", 1, "XX../X.X./.X.X/..X."},
+	{"barge", 1, ".X../X.X./.X.X/..X."},
+	{"blinker", 2, "XXX"},
+	{"toad", 2, ".XXX/XXX."},
+	{"beacon", 2, "XX../XX../..XX/..XX"},
+	{"pentadecathlon", 15, "..X....X../XX.XXXX.XX/..X....X.."},
+	{"glider", 4, ".X./..X/XXX"},
+	{"lightweight spaceship", 4, ".X..X/X..../X...X/XXXX."},
+	{"middleweight spaceship", 4, "...X../.X...X/X...../X....X/XXXXX."},
+	{"heavyweight spaceship", 4, "...XX../.X....X/X....../X.....X/XXXXXX."},
+}
+
+// Names of the known objects, by the cells of their canonical form
+var knownNames map[string]string
+
+func init() {
+	knownNames = make(map[string]string, len(knownObjects))
+	for _, known := range knownObjects {
+		var cells []Cell
+		for y, row := range strings.Split(known.rows, "/") {
+			for x, c := range row {
+				if c == 'X' {
+					cells = append(cells, Cell{X: x, Y: y})
+				}
+			}
+		}
+		o := classify(cells, Conway)
+		if o.Period != known.period {
+			panic(fmt.Sprintf("%s has period %d, not %d", known.name, o.Period, known.period))
+		}
+		knownNames[cellsKey(o.Cells)] = known.name
+	}
+}
+
+// TakeCensus splits the world of a snapshot into objects, and counts the copies of each.
+// Cells which are within two cells of each other can affect each other, so belong to the same object, unless its
+// pieces run the same on their own, such as two blocks a cell apart.
+// Each object is then run on its own, under the rule, to find how it behaves.
+func TakeCensus(snapshot Snapshot, rule Rule, topology Topology) Census {
+	world := snapshot.World
+	height, width := len(world), len(world[0])
+	seen := make([][]bool, height)
+	for y := range seen {
+		seen[y] = make([]bool, width)
+	}
+
+	tallies := make(map[string]*Tally)
+	for y := range world {
+		for x := range world[y] {
+			if world[y][x] != 0xFF || seen[y][x] {
+				continue
+			}
+
+			// Cells reached across the edges of a torus carry on past them, so the object stays in one piece
+			seen[y][x] = true
+			queue := []Cell{{X: x, Y: y}}
+			var cells []Cell
+			for len(queue) > 0 {
+				c := queue[0]
+				queue = queue[1:]
+				cells = append(cells, Cell{X: snapshot.Origin.X + c.X, Y: snapshot.Origin.Y + c.Y})
+				for dy := -2; dy <= 2; dy++ {
+					for dx := -2; dx <= 2; dx++ {
+						i, j := c.Y+dy, c.X+dx
+						if topology == Torus {
+							i, j = positiveModulo(i, height), positiveModulo(j, width)
+						} else if i < 0 || i >= height || j < 0 || j >= width {
+							continue
+						}
+						if world[i][j] == 0xFF && !seen[i][j] {
+							seen[i][j] = true
+							queue = append(queue, Cell{X: c.X + dx, Y: c.Y + dy})
+						}
+					}
+				}
+			}
+
+			o := classify(cells, rule)
+			objects := []Object{o}
+			if pieces := separate(cells, o, rule); len(pieces) > 1 {
+				objects = objects[:0]
+				for _, piece := range pieces {
+					objects = append(objects, classify(piece, rule))
+				}
+			}
+			for _, o := range objects {
+				t, ok := tallies[o.Name]
+				if !ok {
+					t = &Tally{Object: o}
+					tallies[o.Name] = t
+				}
+				t.Count++
+			}
+		}
+	}
+
+	census := make(Census, 0, len(tallies))
+	for _, t := range tallies {
+		census = append(census, *t)
+	}
+	sort.Slice(census, func(i, j int) bool {
+		if census[i].Count != census[j].Count {
+			return census[i].Count > census[j].Count
+		}
+		return census[i].Name < census[j].Name
+	})
+	return census
+}
+
+// Census takes a census of the world at the end of the current turn
+func (s *Simulation) Census() Census {
+	rep := s.request(save, true)
+	return TakeCensus(Snapshot{Turn: rep.turn, World: rep.world, Origin: rep.origin}, s.p.rule, s.p.topology)
+}
+
+// Runs an object on its own to find its kind, period and canonical form
+func classify(cells []Cell, rule Rule) Object {
+	start, origin := normalise(cells)
+	phases := [][]Cell{start}
+	o := Object{Kind: Unstable}
+	current := cells
+	for turn := 1; turn <= censusTurns; turn++ {
+		current = evolve(current, rule)
+		if len(current) == 0 {
+			break
+		}
+		phase, moved := normalise(current)
+		if cellsKey(phase) == cellsKey(start) {
+			o.Period = turn
+			o.Displacement = Cell{X: abs(moved.X - origin.X), Y: abs(moved.Y - origin.Y)}
+			if o.Displacement.Y > o.Displacement.X {
+				o.Displacement.X, o.Displacement.Y = o.Displacement.Y, o.Displacement.X
+			}
+			switch {
+			case o.Displacement != Cell{}:
+				o.Kind = Spaceship
+			case turn == 1:
+				o.Kind = StillLife
+			default:
+				o.Kind = Oscillator
+			}
+			break
+		}
+		phases = append(phases, phase)
+	}
+
+	// Only the phases of the cycle are the same object, so an unstable object keeps the phase it was found in
+	if o.Kind == Unstable {
+		phases = phases[:1]
+	}
+	key := ""
+	for _, phase := range phases {
+		for t := 0; t < 8; t++ {
+			transformed, _ := normalise(transform(phase, t))
+			if k := cellsKey(transformed); key == "" || k < key {
+				key = k
+				o.Cells = transformed
+			}
+		}
+	}
+
+	if name, ok := knownNames[key]; ok && rule == Conway {
+		o.Name = name
+		return o
+	}
+	var hash uint64
+	for _, c := range o.Cells {
+		hash ^= protocol.CellHash(c.X, c.Y)
+	}
+	switch o.Kind {
+	case StillLife:
+		o.Name = fmt.Sprintf("xs%d_%08x", len(o.Cells), uint32(hash))
+	case Oscillator:
+		o.Name = fmt.Sprintf("xp%d_%08x", o.Period, uint32(hash))
+	case Spaceship:
+		o.Name = fmt.Sprintf("xq%d_%08x", o.Period, uint32(hash))
+	default:
+		o.Name = fmt.Sprintf("zz%d_%08x", len(o.Cells), uint32(hash))
+	}
+	return o
+}
+
+// Splits a still life or oscillator into its pieces of touching cells, if every piece runs on its own the same as
+// it does next to the others, and is back where it started, after the period of the object.
+// Otherwise returns the object in one piece.
+func separate(cells []Cell, o Object, rule Rule) [][]Cell {
+	alive := make(map[Cell]bool, len(cells))
+	for _, c := range cells {
+		alive[c] = true
+	}
+	var pieces [][]Cell
+	for _, c := range cells {
+		if !alive[c] {
+			continue
+		}
+		delete(alive, c)
+		piece := []Cell{c}
+		for i := 0; i < len(piece); i++ {
+			for _, offset := range offsets {
+				n := Cell{X: piece[i].X + offset[1], Y: piece[i].Y + offset[0]}
+				if alive[n] {
+					delete(alive, n)
+					piece = append(piece, n)
+				}
+			}
+		}
+		pieces = append(pieces, piece)
+	}
+	if (o.Kind != StillLife && o.Kind != Oscillator) || len(pieces) == 1 {
+		return [][]Cell{cells}
+	}
+
+	whole := cells
+	apart := pieces
+	for turn := 0; turn < o.Period; turn++ {
+		whole = evolve(whole, rule)
+		together := make(map[Cell]bool, len(whole))
+		for _, c := range whole {
+			together[c] = true
+		}
+		count := 0
+		next := make([][]Cell, len(apart))
+		for i, piece := range apart {
+			next[i] = evolve(piece, rule)
+			for _, c := range next[i] {
+				if !together[c] {
+					return [][]Cell{cells}
+				}
+				count++
+			}
+		}
+		if count != len(whole) {
+			return [][]Cell{cells}
+		}
+		apart = next
+	}
+	for i, piece := range pieces {
+		if len(apart[i]) != len(piece) {
+			return [][]Cell{cells}
+		}
+		start := make(map[Cell]bool, len(piece))
+		for _, c := range piece {
+			start[c] = true
+		}
+		for _, c := range apart[i] {
+			if !start[c] {
+				return [][]Cell{cells}
+			}
+		}
+	}
+	return pieces
+}
+
+// Returns the cells after one turn under the rule, on a plane.
+// Cells without alive neighbours are never born, as no rule allowed on a plane would.
+func evolve(cells []Cell, rule Rule) []Cell {
+	alive := make(map[Cell]bool, len(cells))
+	neighbours := make(map[Cell]int, 9*len(cells))
+	for _, c := range cells {
+		alive[c] = true
+		for _, offset := range offsets {
+			neighbours[Cell{X: c.X + offset[1], Y: c.Y + offset[0]}]++
+		}
+	}
+	var next []Cell
+	for c := range alive {
+		if rule.Survive[neighbours[c]] {
+			next = append(next, c)
+		}
+	}
+	for c, n := range neighbours {
+		if !alive[c] && rule.Born[n] {
+			next = append(next, c)
+		}
+	}
+	return next
+}
+
+// Returns one of the 8 rotations and reflections of the cells
+func transform(cells []Cell, t int) []Cell {
+	transformed := make([]Cell, len(cells))
+	for i, c := range cells {
+		if t&1 != 0 {
+			c.X = -c.X
+		}
+		if t&2 != 0 {
+			c.Y = -c.Y
+		}
+		if t&4 != 0 {
+			c.X, c.Y = c.Y, c.X
+		}
+		transformed[i] = c
+	}
+	return transformed
+}
+
+// Returns the cells moved so the top left of their bounding box is at 0,0, sorted row by row,
+// and where the top left was
+func normalise(cells []Cell) ([]Cell, Cell) {
+	min := cells[0]
+	for _, c := range cells {
+		if c.X < min.X {
+			min.X = c.X
+		}
+		if c.Y < min.Y {
+			min.Y = c.Y
+		}
+	}
+	moved := make([]Cell, len(cells))
+	for i, c := range cells {
+		moved[i] = Cell{X: c.X - min.X, Y: c.Y - min.Y}
+	}
+	sort.Slice(moved, func(i, j int) bool {
+		if moved[i].Y != moved[j].Y {
+			return moved[i].Y < moved[j].Y
+		}
+		return moved[i].X < moved[j].X
+	})
+	return moved, min
+}
+
+// Returns a string which is the same for the same sorted cells, and orders them by their cells
+func cellsKey(cells []Cell) string {
+	var b strings.Builder
+	for _, c := range cells {
+		b.WriteString(strconv.Itoa(c.Y))
+		b.WriteByte(',')
+		b.WriteString(strconv.Itoa(c.X))
+		b.WriteByte(' ')
+	}
+	return b.String()
+}
+
+func abs(x int) int {
+	if x < 0 {
+		return -x
+	}
+	return x
+}
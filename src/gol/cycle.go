@@ -0,0 +1,54 @@
+package gol
+
+import "uk.ac.bris.cs/gameoflife/protocol"
+
+// WithCycleDetection hashes the world after every turn to find when it repeats an earlier one, sending Stabilised.
+// With skip, Step and Run then leave out the turns which would only go round the cycle again, so they finish early
+// with the world of the turn they would have finished at.
+func WithCycleDetection(skip bool) Option {
+	return func(c *config) {
+		c.cycles = &cycles{skip: skip}
+	}
+}
+
+// The fingerprint of the world of every turn so far, to find the first turn a world repeats.
+// The worlds are told apart as the stage5 distributor does, so both find the same cycles.
+type cycles struct {
+	protocol.Cycles
+	skip bool
+}
+
+// Returns the hash of a world with its top left cell at origin
+func hashWorld(origin Cell, world [][]byte) uint64 {
+	var hash uint64
+	for y, row := range world {
+		for x, c := range row {
+			if c == 0xFF {
+				hash ^= protocol.CellHash(origin.X+x, origin.Y+y)
+			}
+		}
+	}
+	return hash
+}
+
+// Moves the turn on past every whole cycle before the turn last, once a cycle has been found and may be skipped,
+// as the world is then the same as after going round them. Returns true if it moved. The mutex must be held.
+func (s *Simulation) skipCycles(last int) bool {
+	if s.cycles == nil || !s.cycles.skip || s.cycles.Period == 0 {
+		return false
+	}
+	skipped := (last - s.turn) / s.cycles.Period * s.cycles.Period
+	s.turn += skipped
+	return skipped > 0
+}
+
+// Cycle returns the first turn of the cycle the world goes round and its period, once found with WithCycleDetection.
+// found is false until then.
+func (s *Simulation) Cycle() (start, period int, found bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.cycles == nil || s.cycles.Period == 0 {
+		return 0, 0, false
+	}
+	return s.cycles.Start, s.cycles.Period, true
+}
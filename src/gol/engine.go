@@ -0,0 +1,291 @@
+package gol
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+)
+
+// Engine is the way the turns of a simulation are computed
+type Engine int
+
+const (
+	// Halo splits the world between workers which each keep their own tile, and exchange halos over channels
+	Halo Engine = iota
+	// Shared splits the world between workers which read their neighbours directly from a world they share,
+	// waiting for each other at the end of every turn
+	Shared
+	// Reference computes the whole world cell by cell, without any workers
+	Reference
+	// Remote runs the workers on stage5 clients connected over TCP, set with WithCluster
+	Remote
+	// Sparse is like Shared, but only computes the blocks of the world which can change,
+	// so worlds which are mostly dead or still run much faster
+	Sparse
+)
+
+var engineNames = map[Engine]string{
+	Halo:      "halo",
+	Shared:    "shared",
+	Reference: "reference",
+	Remote:    "remote",
+	Sparse:    "sparse",
+}
+
+// Engines lists every engine, in the order they are declared
+var Engines = []Engine{Halo, Shared, Reference, Remote, Sparse}
+
+// ParseEngine returns the engine with the given name, such as halo or shared
+func ParseEngine(name string) (Engine, error) {
+	for e, n := range engineNames {
+		if strings.EqualFold(name, n) {
+			return e, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown engine %q", name)
+}
+
+// String returns the name of the engine
+func (e Engine) String() string {
+	if name, ok := engineNames[e]; ok {
+		return name
+	}
+	return fmt.Sprintf("engine %d", int(e))
+}
+
+// What the simulation needs from an engine. Its methods are only called by one goroutine at a time.
+type backend interface {
+	// load sets the world the engine starts from
+	load(world [][]byte)
+	// advance runs n turns and returns the number it ran. Once ctx is cancelled it stops at the end of a turn,
+	// after running at least one, and returns ctx.Err().
+	// observe is nil or called after every turn, with a report of the turns run so far in this call,
+	// the number of alive cells, the cells which flipped, the births, deaths and bounds and the hash of the world.
+	advance(ctx context.Context, n int, observe func(report)) (int, error)
+	// snapshot returns a copy of the world
+	snapshot() [][]byte
+	// population returns the number of alive cells
+	population() int
+}
+
+// Returns the backend of the engine set by the options
+func newBackend(c config) backend {
+	switch c.engine {
+	case Shared:
+		return &sharedEngine{p: c.params}
+	case Reference:
+		return &referenceEngine{p: c.params}
+	case Remote:
+		return &remoteEngine{p: c.params, cluster: c.cluster}
+	case Sparse:
+		return &sparseEngine{p: c.params}
+	}
+	return &haloEngine{p: c.params}
+}
+
+// Computes the cells of a tile for the next turn into next, reading their neighbours from world
+func computeTile(p params, world, next [][]byte, t tile) {
+	height, width := len(world), len(world[0])
+	var dead []byte
+	if p.topology == Bounded && (t.startX == 0 || t.endX == height) {
+		dead = make([]byte, width)
+	}
+	for i := t.startX; i < t.endX; i++ {
+		above, row, below := world[positiveModulo(i-1, height)], world[i], world[(i+1)%height]
+		if p.topology == Bounded && i == 0 {
+			above = dead
+		}
+		if p.topology == Bounded && i == height-1 {
+			below = dead
+		}
+
+		for j := t.startY; j < t.endY; j++ {
+			aliveNeighbours := int(above[j]) + int(below[j])
+			if j > 0 && j < width-1 {
+				aliveNeighbours += int(above[j-1]) + int(row[j-1]) + int(below[j-1]) +
+					int(above[j+1]) + int(row[j+1]) + int(below[j+1])
+			} else {
+				// The columns beyond the edge wrap around on a torus
+				if p.topology == Torus || j > 0 {
+					left := positiveModulo(j-1, width)
+					aliveNeighbours += int(above[left]) + int(row[left]) + int(below[left])
+				}
+				if p.topology == Torus || j < width-1 {
+					right := (j + 1) % width
+					aliveNeighbours += int(above[right]) + int(row[right]) + int(below[right])
+				}
+			}
+
+			switch getNewState(p.rule, aliveNeighbours/255, row[j] == 0xFF) {
+			case -1:
+				next[i][j] = 0x00
+			case 1:
+				next[i][j] = 0xFF
+			case 0:
+				next[i][j] = row[j]
+			}
+		}
+	}
+}
+
+// Reports the alive cells of a tile in next, the cells which differ from world and the hash of the tile
+func compareTile(world, next [][]byte, t tile) report {
+	var r report
+	for i := t.startX; i < t.endX; i++ {
+		for j := t.startY; j < t.endY; j++ {
+			r.add(Cell{X: j, Y: i}, world[i][j] == 0xFF, next[i][j] == 0xFF)
+		}
+	}
+	return r
+}
+
+// Computes the whole world in one goroutine, to check the other engines against
+type referenceEngine struct {
+	p           params
+	world, next [][]byte
+}
+
+func (e *referenceEngine) load(world [][]byte) {
+	e.world = copyWorld(world)
+	e.next = makeMatrix(e.p.imageWidth, e.p.imageHeight)
+}
+
+func (e *referenceEngine) advance(ctx context.Context, n int, observe func(report)) (int, error) {
+	whole := tile{0, e.p.imageHeight, 0, e.p.imageWidth}
+	for turn := 1; turn <= n; turn++ {
+		computeTile(e.p, e.world, e.next, whole)
+		if observe != nil {
+			r := compareTile(e.world, e.next, whole)
+			r.turn = turn
+			observe(r)
+		}
+		e.world, e.next = e.next, e.world
+
+		if ctx.Err() != nil && turn < n {
+			return turn, ctx.Err()
+		}
+	}
+	return n, nil
+}
+
+func (e *referenceEngine) snapshot() [][]byte {
+	return copyWorld(e.world)
+}
+
+func (e *referenceEngine) population() int {
+	return population(e.world)
+}
+
+// Splits the world into tiles, each computed by its own worker.
+// Every worker reads the world of the last turn and writes its own tile of the next one, so instead of exchanging
+// halos they only wait for each other at a barrier at the end of every turn, then swap the worlds.
+type sharedEngine struct {
+	p           params
+	tiles       []tile
+	world, next [][]byte
+}
+
+func (e *sharedEngine) load(world [][]byte) {
+	rows, cols := tileGrid(e.p)
+	e.tiles = makeTiles(e.p, rows, cols)
+	e.world = copyWorld(world)
+	e.next = makeMatrix(e.p.imageWidth, e.p.imageHeight)
+}
+
+// Barrier which can be used again once every goroutine has left it
+type barrier struct {
+	mutex      sync.Mutex
+	released   *sync.Cond
+	parties    int
+	waiting    int
+	generation int // Number of times the barrier has been passed
+}
+
+func newBarrier(parties int) *barrier {
+	b := &barrier{parties: parties}
+	b.released = sync.NewCond(&b.mutex)
+	return b
+}
+
+// Waits until every goroutine has arrived. The last one to arrive runs action, if not nil, before the others carry on.
+func (b *barrier) wait(action func()) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	generation := b.generation
+	b.waiting++
+	if b.waiting < b.parties {
+		for generation == b.generation {
+			b.released.Wait()
+		}
+		return
+	}
+	if action != nil {
+		action()
+	}
+	b.waiting = 0
+	b.generation++
+	b.released.Broadcast()
+}
+
+func (e *sharedEngine) advance(ctx context.Context, n int, observe func(report)) (int, error) {
+	// The workers only decide to stop at the end of a turn, so none are started for no turns
+	if n <= 0 {
+		return 0, nil
+	}
+	reports := make([]report, len(e.tiles))
+
+	// Run by the last worker to finish each turn, deciding whether the workers stop
+	turn := 0
+	stop := false
+	endOfTurn := func() {
+		turn++
+		if observe != nil {
+			combined := report{turn: turn}
+			for _, r := range reports {
+				combined.combine(r)
+			}
+			observe(combined)
+		}
+		stop = turn == n || ctx.Err() != nil
+	}
+
+	b := newBarrier(len(e.tiles))
+	var finished sync.WaitGroup
+	finished.Add(len(e.tiles))
+	for i, t := range e.tiles {
+		go func(i int, t tile) {
+			// Each worker swaps its own pointers, so they all agree on which world is the last turn
+			world, next := e.world, e.next
+			for {
+				computeTile(e.p, world, next, t)
+				if observe != nil {
+					reports[i] = compareTile(world, next, t)
+				}
+				b.wait(endOfTurn)
+				world, next = next, world
+				if stop {
+					break
+				}
+			}
+			finished.Done()
+		}(i, t)
+	}
+	finished.Wait()
+
+	if turn%2 == 1 {
+		e.world, e.next = e.next, e.world
+	}
+	if turn < n {
+		return turn, ctx.Err()
+	}
+	return n, nil
+}
+
+func (e *sharedEngine) snapshot() [][]byte {
+	return copyWorld(e.world)
+}
+
+func (e *sharedEngine) population() int {
+	return population(e.world)
+}
@@ -0,0 +1,609 @@
+package gol
+
+import (
+	"context"
+	"fmt"
+)
+
+// Settings of a simulation. turns is the number of turns of the current run.
+type params struct {
+	turns       int
+	threads     int
+	imageWidth  int
+	imageHeight int
+	tiled       bool
+	haloDepth   int
+	rule        Rule
+	topology    Topology
+}
+
+type workerChannel struct {
+	inputByte,
+	outputByte chan byte
+	inputHalo,
+	outputHalo [8]chan []byte
+	distributorInput,
+	distributorOutput chan int
+	report chan<- report // Reports each turn to the observers, nil when there are none
+}
+
+// Part of the world owned by one worker: rows startX to endX and columns startY to endY
+type tile struct {
+	startX, endX, startY, endY int
+}
+
+const (
+	pause  = iota
+	ping   = iota
+	resume = iota
+	quit   = iota
+	save   = iota
+	list   = iota
+	survey = iota
+)
+
+// Sent by a worker when it reaches the last turn of a run
+const done = -1
+
+// Halo directions, clockwise from the row above
+const (
+	north = iota
+	northEast
+	east
+	southEast
+	south
+	southWest
+	west
+	northWest
+)
+
+// Row and column offset of each direction
+var offsets = [8][2]int{{-1, 0}, {-1, 1}, {0, 1}, {1, 1}, {1, 0}, {1, -1}, {0, -1}, {-1, -1}}
+
+// Returns the direction pointing the other way
+func opposite(direction int) int {
+	return (direction + 4) % 8
+}
+
+func positiveModulo(x, m int) int {
+	for x < 0 {
+		x += m
+	}
+	return x % m
+}
+
+// Returns the new state of a cell from the number of alive neighbours and current state, under rule r
+func getNewState(r Rule, numberOfAlive int, cellState bool) int {
+	if cellState == true {
+		if !r.Survive[numberOfAlive] {
+			return -1
+		}
+	} else if r.Born[numberOfAlive] {
+		return 1
+	}
+	return 0
+}
+
+// Makes a matrix slice
+func makeMatrix(width, height int) [][]byte {
+	M := make([][]byte, height)
+	for i := range M {
+		M[i] = make([]byte, width)
+	}
+	return M
+}
+
+// Returns the range covered by a halo along one axis of a worker's world, for halos of the given depth.
+// Ghost halos lie outside the tile, edge halos are the cells of the tile a neighbour needs.
+func haloSpan(offset, length, depth int, ghost bool) (int, int) {
+	switch {
+	case offset == 0:
+		return depth, depth + length
+	case offset < 0 && ghost:
+		return 0, depth
+	case offset < 0:
+		return depth, 2 * depth
+	case ghost:
+		return depth + length, 2*depth + length
+	default:
+		return length, depth + length
+	}
+}
+
+// Returns the rows and columns of the halo in a direction, for a tile of the given size with halos of the given depth
+func haloRegion(direction, height, width, depth int, ghost bool) (startX, endX, startY, endY int) {
+	startX, endX = haloSpan(offsets[direction][0], height, depth, ghost)
+	startY, endY = haloSpan(offsets[direction][1], width, depth, ghost)
+	return
+}
+
+// Fills the halo in a direction from the opposite edge of the same worker, when it is its own neighbour
+func wrapHalo(world [][]byte, direction, depth int) {
+	height, width := len(world)-2*depth, len(world[0])-2*depth
+	startX, endX, startY, endY := haloRegion(direction, height, width, depth, true)
+	fromX, _, fromY, _ := haloRegion(opposite(direction), height, width, depth, false)
+	for i := startX; i < endX; i++ {
+		copy(world[i][startY:endY], world[fromX+i-startX][fromY:fromY+endY-startY])
+	}
+}
+
+// Copies the cells of a halo region into a single slice, so it can be sent as one message
+func packHalo(world [][]byte, startX, endX, startY, endY int) []byte {
+	halo := make([]byte, 0, (endX-startX)*(endY-startY))
+	for i := startX; i < endX; i++ {
+		halo = append(halo, world[i][startY:endY]...)
+	}
+	return halo
+}
+
+// Copies a halo received as one message into its region
+func unpackHalo(world [][]byte, halo []byte, startX, endX, startY, endY int) {
+	for i := startX; i < endX; i++ {
+		copy(world[i][startY:endY], halo[(i-startX)*(endY-startY):])
+	}
+}
+
+// Answers a pause from the distributor with the current turn, and receives the turn after which to stop
+func interrupt(channels workerChannel, turn int, stopAtTurn *int) {
+	channels.distributorOutput <- turn
+	*stopAtTurn = <-channels.distributorInput
+}
+
+// Receive halo, or receive command from distributor
+func receiveOrInterrupt(world [][]byte, channels workerChannel, turn int, halo *bool, stopAtTurn *int, direction, depth int) {
+	select {
+	case h := <-channels.inputHalo[direction]:
+		startX, endX, startY, endY := haloRegion(direction, len(world)-2*depth, len(world[0])-2*depth, depth, true)
+		unpackHalo(world, h, startX, endX, startY, endY)
+		*halo = true
+	case <-channels.distributorInput:
+		interrupt(channels, turn, stopAtTurn)
+	}
+}
+
+// Send halo, or receive command from distributor
+func sendOrInterrupt(world [][]byte, channels workerChannel, turn int, out *bool, stopAtTurn *int, direction, depth int) {
+	startX, endX, startY, endY := haloRegion(direction, len(world)-2*depth, len(world[0])-2*depth, depth, false)
+	select {
+	case channels.outputHalo[direction] <- packHalo(world, startX, endX, startY, endY):
+		*out = true
+	case <-channels.distributorInput:
+		interrupt(channels, turn, stopAtTurn)
+	}
+}
+
+// Returns the directions which lie beyond the edge of a bounded world, where every cell is dead
+func walls(p params, startX, endX, startY, endY int) [8]bool {
+	var w [8]bool
+	if p.topology != Bounded {
+		return w
+	}
+	for direction, offset := range offsets {
+		w[direction] = offset[0] < 0 && startX == 0 || offset[0] > 0 && endX == p.imageHeight ||
+			offset[1] < 0 && startY == 0 || offset[1] > 0 && endY == p.imageWidth
+	}
+	return w
+}
+
+// Returns true if every element is true
+func all(flags [8]bool) bool {
+	for _, f := range flags {
+		if !f {
+			return false
+		}
+	}
+	return true
+}
+
+// Worker function
+// Halos are exchanged every p.haloDepth turns. In between, the worker also computes the cells of its halos
+// which are still valid, which are one fewer in every direction each turn.
+// After the last turn, or when the distributor pauses it, the worker waits for commands until it is told to quit.
+func worker(p params, channels workerChannel, startX, endX, startY, endY int) {
+	height := endX - startX
+	width := endY - startY
+	depth := p.haloDepth
+	wall := walls(p, startX, endX, startY, endY)
+
+	world := makeMatrix(width+2*depth, height+2*depth)
+	newWorld := makeMatrix(width+2*depth, height+2*depth)
+
+	// Receive initial world, surrounded by its halos, from distributor
+	for i := range world {
+		for j := range world[i] {
+			newWorld[i][j] = <-channels.inputByte
+			world[i][j] = newWorld[i][j]
+		}
+	}
+
+	halos := [8]bool{true, true, true, true, true, true, true, true}
+	stopAtTurn := -2
+	life := p.rule
+
+	for turn := 0; ; {
+
+		// This is the turn in which all workers synchronise and stop, or the last turn
+		if turn == stopAtTurn+1 || turn == p.turns {
+			if turn == stopAtTurn+1 {
+				channels.distributorOutput <- pause
+			} else {
+				channels.distributorOutput <- done
+			}
+			// Process IO
+			for {
+				r := <-channels.distributorInput
+				if r == resume {
+					break
+				} else if r == save {
+					// Send the world to the distributor
+					for i := depth; i < height+depth; i++ {
+						for j := depth; j < width+depth; j++ {
+							channels.outputByte <- newWorld[i][j]
+						}
+					}
+				} else if r == quit {
+					return
+				} else if r == ping {
+					// Send the number of alive cells to the distributor
+					alive := 0
+					for i := depth; i < height+depth; i++ {
+						for j := depth; j < width+depth; j++ {
+							if newWorld[i][j] == 0xFF {
+								alive++
+							}
+						}
+					}
+					channels.distributorOutput <- alive
+				} else if r == pause {
+					// The distributor did not know this worker had already stopped
+					interrupt(channels, turn, &stopAtTurn)
+					channels.distributorOutput <- pause
+				}
+			}
+		}
+
+		// Workers without neighbours never wait for halos, so they check for a command between turns
+		select {
+		case <-channels.distributorInput:
+			interrupt(channels, turn, &stopAtTurn)
+		default:
+		}
+
+		// Get halos or command
+		for direction := range halos {
+			if halos[direction] {
+				continue
+			}
+			if wall[direction] {
+				// The cells beyond the edge stay dead
+				halos[direction] = true
+			} else if channels.inputHalo[direction] == nil {
+				// This worker is its own neighbour
+				wrapHalo(world, direction, depth)
+				halos[direction] = true
+			} else {
+				// Either receive the halo, or a command from distributor
+				receiveOrInterrupt(world, channels, turn, &halos[direction], &stopAtTurn, direction, depth)
+			}
+		}
+
+		// Move on to next turn, if all halos are present
+		if all(halos) {
+			// Cells computed beyond the tile in each direction, except beyond the edge of a bounded world
+			extra := depth - 1 - turn%depth
+			startI, endI := depth-extra, height+depth+extra
+			startJ, endJ := depth-extra, width+depth+extra
+			if wall[north] {
+				startI = depth
+			}
+			if wall[south] {
+				endI = height + depth
+			}
+			if wall[west] {
+				startJ = depth
+			}
+			if wall[east] {
+				endJ = width + depth
+			}
+
+			// Execute turn
+			for i := startI; i < endI; i++ {
+				for j := startJ; j < endJ; j++ {
+					// Compute alive neighbours
+					aliveNeighbours := int(world[i+1][j]) + int(world[i-1][j]) +
+						int(world[i][j+1]) + int(world[i][j-1]) +
+						int(world[i+1][j+1]) + int(world[i+1][j-1]) +
+						int(world[i-1][j+1]) + int(world[i-1][j-1])
+
+					switch getNewState(life, aliveNeighbours/255, world[i][j] == 0xFF) {
+					case -1:
+						newWorld[i][j] = 0x00
+					case 1:
+						newWorld[i][j] = 0xFF
+					case 0:
+						newWorld[i][j] = world[i][j]
+					}
+				}
+			}
+			turn++
+
+			if channels.report != nil {
+				// Tell the observers how the tile changed
+				rep := report{turn: turn}
+				for i := depth; i < height+depth; i++ {
+					for j := depth; j < width+depth; j++ {
+						rep.add(Cell{X: startY + j - depth, Y: startX + i - depth}, world[i][j] == 0xFF, newWorld[i][j] == 0xFF)
+					}
+				}
+				channels.report <- rep
+			}
+
+			// Try sending the halos, or a command from distributor, once the halos have run out
+			if turn%depth == 0 && turn < p.turns {
+				halos = [8]bool{}
+				var out [8]bool
+				for !all(out) {
+					for direction := range out {
+						if out[direction] {
+							continue
+						}
+						if channels.outputHalo[direction] == nil {
+							out[direction] = true
+						} else {
+							sendOrInterrupt(newWorld, channels, turn, &out[direction], &stopAtTurn, direction, depth)
+						}
+					}
+				}
+			}
+
+			// Update old world
+			for i := range world {
+				copy(world[i], newWorld[i])
+			}
+		}
+	}
+}
+
+// Splits length into parts, with the larger parts at the end
+// 16 into 10 parts: 4 parts of 1 followed by 6 parts of 2
+func splitBounds(length, parts int) []int {
+	bounds := make([]int, parts+1)
+	small := parts - length%parts
+	for i := 0; i < parts; i++ {
+		bounds[i+1] = bounds[i] + length/parts
+		if i >= small {
+			bounds[i+1]++
+		}
+	}
+	return bounds
+}
+
+// Chooses how many rows and columns of tiles the world is split into.
+// Strips are a single column of tiles, otherwise the grid exchanging the fewest halo cells is used.
+func tileGrid(p params) (rows, cols int) {
+	rows, cols = p.threads, 1
+	if !p.tiled {
+		return
+	}
+	best := -1
+	for r := 1; r <= p.threads; r++ {
+		c := p.threads / r
+		if p.threads%r != 0 || r > p.imageHeight || c > p.imageWidth {
+			continue
+		}
+		// Cells along the edge of the largest tile
+		perimeter := (p.imageHeight+r-1)/r + (p.imageWidth+c-1)/c
+		if best == -1 || perimeter < best {
+			best = perimeter
+			rows, cols = r, c
+		}
+	}
+	return
+}
+
+// Splits the world into tiles, one per worker, in row-major order
+func makeTiles(p params, rows, cols int) []tile {
+	xBounds := splitBounds(p.imageHeight, rows)
+	yBounds := splitBounds(p.imageWidth, cols)
+	tiles := make([]tile, 0, rows*cols)
+	for r := 0; r < rows; r++ {
+		for c := 0; c < cols; c++ {
+			tiles = append(tiles, tile{xBounds[r], xBounds[r+1], yBounds[c], yBounds[c+1]})
+		}
+	}
+	return tiles
+}
+
+// Returns how many rows of halo workers exchange at once.
+// This is at least 1, and at most the smallest side of a tile as halos only come from the neighbouring tiles.
+func haloDepth(p params, tiles []tile) int {
+	depth := p.haloDepth
+	for _, t := range tiles {
+		if t.endX-t.startX < depth {
+			depth = t.endX - t.startX
+		}
+		if t.endY-t.startY < depth {
+			depth = t.endY - t.startY
+		}
+	}
+	if depth < 1 {
+		depth = 1
+	}
+	return depth
+}
+
+// Initialise worker channels
+func initialiseChannels(workerChannels []workerChannel, tiles []tile, rows, cols int, p params, reports chan<- report) {
+	for i, t := range tiles {
+		height := t.endX - t.startX
+		width := t.endY - t.startY
+		workerChannels[i].inputByte = make(chan byte, width+2*p.haloDepth)
+		workerChannels[i].outputByte = make(chan byte, height*width)
+		workerChannels[i].distributorInput = make(chan int, 1)
+		workerChannels[i].distributorOutput = make(chan int, 1)
+		workerChannels[i].report = reports
+	}
+
+	for i := range tiles {
+		for direction, offset := range offsets {
+			row, col := i/cols+offset[0], i%cols+offset[1]
+			// Nothing lies beyond the edge of a bounded world
+			if p.topology == Bounded && (row < 0 || row >= rows || col < 0 || col >= cols) {
+				continue
+			}
+			neighbour := positiveModulo(row, rows)*cols + positiveModulo(col, cols)
+			// Workers which are their own neighbour wrap their halos locally
+			if neighbour == i {
+				continue
+			}
+			workerChannels[i].inputHalo[direction] = make(chan []byte, 1)
+
+			// Link channels
+			workerChannels[neighbour].outputHalo[opposite(direction)] = workerChannels[i].inputHalo[direction]
+		}
+	}
+}
+
+func pauseWorkers(workerChannels []workerChannel, stopAtTurn *int) {
+	// Pause and get current turns
+	for _, channel := range workerChannels {
+		channel.distributorInput <- pause
+	}
+	for _, channel := range workerChannels {
+		t := <-channel.distributorOutput
+		// Workers which reached the last turn said so before answering
+		if t == done {
+			t = <-channel.distributorOutput
+		}
+		if t > *stopAtTurn {
+			*stopAtTurn = t
+		}
+	}
+
+	// Tell all workers to stop after turn stopAtTurn
+	for _, channel := range workerChannels {
+		channel.distributorInput <- *stopAtTurn
+	}
+	for _, channel := range workerChannels {
+		r := <-channel.distributorOutput
+		if r != pause && r != done {
+			fmt.Println("Something has gone wrong, r =", r)
+		}
+	}
+}
+
+func receiveWorld(world [][]byte, workerChannels []workerChannel, tiles []tile) {
+	for i, channel := range workerChannels {
+		t := tiles[i]
+		for x := t.startX; x < t.endX; x++ {
+			for y := t.startY; y < t.endY; y++ {
+				world[x][y] = <-channel.outputByte
+			}
+		}
+	}
+}
+
+// Sends data over all worker channels
+func sendToWorkers(workerChannels []workerChannel, data int) {
+	for _, channel := range workerChannels {
+		channel.distributorInput <- data
+	}
+}
+
+// Waits until the workers reach the last turn, or stops them once ctx is cancelled.
+// Returns the turn the workers stopped at.
+func workerController(ctx context.Context, p params, workerChannels []workerChannel) (int, error) {
+	select {
+	case <-ctx.Done():
+		stopAtTurn := 0
+		pauseWorkers(workerChannels, &stopAtTurn)
+		turn := stopAtTurn + 1
+		if turn >= p.turns {
+			return p.turns, nil
+		}
+		return turn, ctx.Err()
+	case o := <-workerChannels[0].distributorOutput: // Workers are starting to finish
+		if o != done {
+			fmt.Println("Something has gone wrong, o =", o)
+		}
+		for _, channel := range workerChannels[1:] {
+			<-channel.distributorOutput
+		}
+		return p.turns, nil
+	}
+}
+
+// distributor divides the world between workers, and waits until they have run p.turns turns or ctx is cancelled.
+// The world is updated in place. observe, if not nil, is called with the reports of every turn.
+// Returns the number of turns run.
+func distributor(ctx context.Context, p params, world [][]byte, observe func(report)) (int, error) {
+	// Tile calculations
+	// 16x16 with 10 threads as strips: 4 small tiles with 1 height + 6 large tiles with 2 height
+	rows, cols := tileGrid(p)
+	tiles := makeTiles(p, rows, cols)
+	p.haloDepth = haloDepth(p, tiles)
+
+	var reports chan report
+	combined := make(chan struct{})
+	if observe != nil {
+		reports = make(chan report, p.threads)
+		go combineReports(reports, p.threads, observe, combined)
+	}
+
+	// Worker channels
+	workerChannels := make([]workerChannel, p.threads)
+	initialiseChannels(workerChannels, tiles, rows, cols, p, reports)
+
+	// Start workers
+	for i, t := range tiles {
+		go worker(p, workerChannels[i], t.startX, t.endX, t.startY, t.endY)
+		// Send initial world, with the surrounding halos, to worker
+		for x := t.startX - p.haloDepth; x < t.endX+p.haloDepth; x++ {
+			for y := t.startY - p.haloDepth; y < t.endY+p.haloDepth; y++ {
+				if p.topology == Bounded && (x < 0 || x >= p.imageHeight || y < 0 || y >= p.imageWidth) {
+					workerChannels[i].inputByte <- 0
+				} else {
+					workerChannels[i].inputByte <- world[positiveModulo(x, p.imageHeight)][positiveModulo(y, p.imageWidth)]
+				}
+			}
+		}
+	}
+
+	turn, err := workerController(ctx, p, workerChannels)
+
+	// Receive the world and quit
+	sendToWorkers(workerChannels, save)
+	receiveWorld(world, workerChannels, tiles)
+	sendToWorkers(workerChannels, quit)
+
+	// Every report has been sent once the workers have stopped
+	if reports != nil {
+		close(reports)
+		<-combined
+	}
+	return turn, err
+}
+
+// Runs the workers of each call to advance on the world, which they update in place
+type haloEngine struct {
+	p     params
+	world [][]byte
+}
+
+func (e *haloEngine) load(world [][]byte) {
+	e.world = copyWorld(world)
+}
+
+func (e *haloEngine) advance(ctx context.Context, n int, observe func(report)) (int, error) {
+	p := e.p
+	p.turns = n
+	return distributor(ctx, p, e.world, observe)
+}
+
+func (e *haloEngine) snapshot() [][]byte {
+	return copyWorld(e.world)
+}
+
+func (e *haloEngine) population() int {
+	return population(e.world)
+}
@@ -0,0 +1,999 @@
+package gol
+
+import (
+	"context"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"math/rand"
+	"strings"
+	"testing"
+)
+
+func TestRule(t *testing.T) {
+	tests := []struct {
+		notation string
+		expected string
+	}{
+		{"B3/S23", "B3/S23"},
+		{"b36/s23", "B36/S23"},
+		{"S23/B3", "B3/S23"},
+		{"23/3", "B3/S23"},
+		{"B/S", "B/S"},
+		{"B2/S", "B2/S"},
+	}
+	for _, test := range tests {
+		t.Run(test.notation, func(t *testing.T) {
+			r, err := ParseRule(test.notation)
+			assert.NoError(t, err)
+			assert.Equal(t, test.expected, r.String())
+		})
+	}
+
+	for _, notation := range []string{"", "B3", "B3/S29", "B3/X23", "B3/23"} {
+		_, err := ParseRule(notation)
+		assert.Error(t, err, notation)
+	}
+
+	r, _ := ParseRule("B3/S23")
+	assert.Equal(t, Conway, r)
+}
+
+// Runs one turn cell by cell, to check the workers against
+func referenceTurn(world [][]byte, r Rule, topology Topology) [][]byte {
+	height, width := len(world), len(world[0])
+	next := makeMatrix(width, height)
+	for y := range world {
+		for x := range world[y] {
+			n := 0
+			for _, offset := range offsets {
+				i, j := y+offset[0], x+offset[1]
+				if topology == Bounded && (i < 0 || i >= height || j < 0 || j >= width) {
+					continue
+				}
+				if world[positiveModulo(i, height)][positiveModulo(j, width)] == 0xFF {
+					n++
+				}
+			}
+			if world[y][x] == 0xFF && r.Survive[n] || world[y][x] == 0 && r.Born[n] {
+				next[y][x] = 0xFF
+			}
+		}
+	}
+	return next
+}
+
+// Engines which run without any clients
+var localEngines = []Engine{Halo, Shared, Reference, Sparse}
+
+// Returns cells which are alive with the given probability
+func randomCells(width, height int, density float64, seed int64) []Cell {
+	random := rand.New(rand.NewSource(seed))
+	var cells []Cell
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			if random.Float64() < density {
+				cells = append(cells, Cell{X: x, Y: y})
+			}
+		}
+	}
+	return cells
+}
+
+func TestSimulation(t *testing.T) {
+	highLife, _ := ParseRule("B36/S23")
+	tests := []struct {
+		threads, depth int
+		tiled          bool
+		topology       Topology
+		rule           Rule
+	}{
+		{1, 1, false, Torus, Conway},
+		{4, 1, false, Torus, Conway},
+		{6, 3, true, Torus, Conway},
+		{1, 1, false, Bounded, Conway},
+		{5, 1, false, Bounded, Conway},
+		{4, 2, true, Bounded, Conway},
+		{9, 4, true, Bounded, highLife},
+	}
+	for _, engine := range localEngines {
+		for _, test := range tests {
+			name := fmt.Sprintf("%v/%dx%d-tiled=%v-bounded=%v-%v", engine, test.threads, test.depth, test.tiled, test.topology == Bounded, test.rule)
+			t.Run(name, func(t *testing.T) {
+				cells := randomCells(30, 20, 0.4, 1)
+				sim, err := New(WithEngine(engine), WithSize(30, 20), WithThreads(test.threads), WithHaloDepth(test.depth),
+					WithTiles(test.tiled), WithTopology(test.topology), WithRule(test.rule), WithCells(cells))
+				assert.NoError(t, err)
+
+				// Engines asked for no turns run none, rather than stopping only at the end of one
+				n, err := sim.engine.advance(context.Background(), 0, nil)
+				assert.NoError(t, err)
+				assert.Equal(t, 0, n)
+
+				expected := sim.Snapshot().World
+				for _, n := range []int{1, 0, 5, 14} {
+					assert.NoError(t, sim.Step(n))
+					for i := 0; i < n; i++ {
+						expected = referenceTurn(expected, test.rule, test.topology)
+					}
+					snapshot := sim.Snapshot()
+					assert.Equal(t, expected, snapshot.World)
+					assert.Equal(t, snapshot.Turn, sim.Turn())
+				}
+				assert.Equal(t, 20, sim.Turn())
+			})
+		}
+	}
+}
+
+func TestBounded(t *testing.T) {
+	// A blinker against the edge dies when nothing lies beyond it, and oscillates when the edges wrap around
+	blinker := []Cell{{0, 3}, {0, 4}, {0, 5}}
+	for _, engine := range localEngines {
+		bounded, err := New(WithEngine(engine), WithSize(8, 8), WithTopology(Bounded), WithCells(blinker))
+		assert.NoError(t, err)
+		torus, err := New(WithEngine(engine), WithSize(8, 8), WithCells(blinker))
+		assert.NoError(t, err)
+
+		assert.NoError(t, bounded.Step(1))
+		assert.NoError(t, torus.Step(1))
+		assert.ElementsMatch(t, []Cell{{0, 4}, {1, 4}}, bounded.AliveCells(), engine)
+		assert.ElementsMatch(t, []Cell{{0, 4}, {1, 4}, {7, 4}}, torus.AliveCells(), engine)
+
+		assert.NoError(t, bounded.Step(1))
+		assert.NoError(t, torus.Step(1))
+		assert.Empty(t, bounded.AliveCells(), engine)
+		assert.ElementsMatch(t, blinker, torus.AliveCells(), engine)
+	}
+}
+
+func TestSparse(t *testing.T) {
+	// Gliders crossing the edges and blocks, a blinker and a block, in a world which is otherwise dead
+	cells := []Cell{{1, 0}, {2, 1}, {0, 2}, {1, 2}, {2, 2}, {150, 140}, {151, 140}, {152, 140}, {70, 70}, {71, 70}, {70, 71}, {71, 71}}
+	for _, c := range randomCells(20, 20, 0.4, 7) {
+		cells = append(cells, Cell{X: c.X + 100, Y: c.Y + 30})
+	}
+	for _, topology := range []Topology{Torus, Bounded} {
+		sparse, err := New(WithEngine(Sparse), WithSize(200, 150), WithThreads(3), WithTopology(topology), WithCells(cells))
+		assert.NoError(t, err)
+		dense, err := New(WithEngine(Shared), WithSize(200, 150), WithThreads(3), WithTopology(topology), WithCells(cells))
+		assert.NoError(t, err)
+
+		for _, n := range []int{1, 7, 40, 300} {
+			assert.NoError(t, sparse.Step(n))
+			assert.NoError(t, dense.Step(n))
+			assert.Equal(t, dense.Snapshot(), sparse.Snapshot(), topology)
+		}
+	}
+
+	// Once the world is still, nothing is computed
+	still, err := New(WithEngine(Sparse), WithSize(100, 100), WithCells([]Cell{{10, 10}, {11, 10}, {10, 11}, {11, 11}}))
+	assert.NoError(t, err)
+	assert.NoError(t, still.Step(2))
+	assert.Empty(t, still.engine.(*sparseEngine).active)
+	assert.NoError(t, still.Step(5))
+	assert.Len(t, still.AliveCells(), 4)
+}
+
+func TestPlane(t *testing.T) {
+	// A soup in the middle of a torus large enough that nothing reaches its edges, crossing the chunks of the plane
+	var cells []Cell
+	for _, c := range randomCells(40, 40, 0.4, 5) {
+		cells = append(cells, Cell{X: c.X - 20, Y: c.Y - 70})
+	}
+	plane, err := New(WithEngine(Sparse), WithThreads(3), WithTopology(Plane), WithCells(cells))
+	assert.NoError(t, err)
+	var shifted []Cell
+	for _, c := range cells {
+		shifted = append(shifted, Cell{X: c.X + 150, Y: c.Y + 150})
+	}
+	torus, err := New(WithEngine(Shared), WithSize(300, 300), WithThreads(3), WithCells(shifted))
+	assert.NoError(t, err)
+	for _, n := range []int{1, 9, 40} {
+		assert.NoError(t, plane.Step(n))
+		assert.NoError(t, torus.Step(n))
+		var expected []Cell
+		for _, c := range torus.AliveCells() {
+			expected = append(expected, Cell{X: c.X - 150, Y: c.Y - 150})
+		}
+		assert.ElementsMatch(t, expected, plane.AliveCells())
+		assert.Equal(t, len(expected), plane.Population())
+	}
+
+	// The flips of every turn give the cells alive after it, wherever they are
+	alive := map[Cell]bool{}
+	for _, c := range plane.AliveCells() {
+		alive[c] = true
+	}
+	unsubscribe := plane.Subscribe(ObserverFunc(func(e Event) {
+		if flipped, ok := e.(CellsFlipped); ok {
+			for _, c := range flipped.Cells {
+				alive[c] = !alive[c]
+			}
+		}
+	}), Block, 1)
+	assert.NoError(t, plane.Step(30))
+	unsubscribe()
+	var flipped []Cell
+	for c, a := range alive {
+		if a {
+			flipped = append(flipped, c)
+		}
+	}
+	assert.ElementsMatch(t, plane.AliveCells(), flipped)
+
+	// A glider flies up and left forever, and the snapshot is cropped to it
+	glider := []Cell{{0, 0}, {1, 0}, {2, 0}, {0, 1}, {1, 2}}
+	sim, err := New(WithEngine(Sparse), WithTopology(Plane), WithCells(glider))
+	assert.NoError(t, err)
+	assert.NoError(t, sim.Step(400))
+	var expected []Cell
+	for _, c := range glider {
+		expected = append(expected, Cell{X: c.X - 100, Y: c.Y - 100})
+	}
+	assert.ElementsMatch(t, expected, sim.AliveCells())
+	snapshot := sim.Snapshot()
+	assert.Equal(t, Cell{-100, -100}, snapshot.Origin)
+	assert.Equal(t, [][]byte{{0xFF, 0xFF, 0xFF}, {0xFF, 0, 0}, {0, 0xFF, 0}}, snapshot.World)
+	assert.Len(t, sim.engine.(*planeEngine).chunks, 1)
+
+	// Blocks a billion cells apart are hashed and measured from their chunks, as their bounds could never be a world
+	far := []Cell{{0, 0}, {1, 0}, {0, 1}, {1, 1}, {1e9, 1e9}, {1e9 + 1, 1e9}, {1e9, 1e9 + 1}, {1e9 + 1, 1e9 + 1}}
+	sim, err = New(WithEngine(Sparse), WithTopology(Plane), WithCells(far), WithCycleDetection(false), WithHeatmap())
+	assert.NoError(t, err)
+	var stabilised []Stabilised
+	unsubscribe = sim.Subscribe(ObserverFunc(func(e Event) {
+		if s, ok := e.(Stabilised); ok {
+			stabilised = append(stabilised, s)
+		}
+	}), Block, 1)
+	assert.NoError(t, sim.Step(3))
+	unsubscribe()
+	assert.Equal(t, []Stabilised{{Turn: 1, Start: 0, Period: 1}}, stabilised)
+	stats := sim.Statistics()
+	assert.Equal(t, 8, stats.Population)
+	assert.Equal(t, Bounds{Min: Cell{0, 0}, Max: Cell{1e9 + 1, 1e9 + 1}, set: true}, stats.Bounds)
+
+	_, err = New(WithEngine(Sparse), WithTopology(Plane))
+	assert.NoError(t, err)
+	_, err = New(WithEngine(Shared), WithTopology(Plane))
+	assert.Error(t, err)
+	b0, _ := ParseRule("B03/S23")
+	_, err = New(WithEngine(Sparse), WithTopology(Plane), WithRule(b0))
+	assert.Error(t, err)
+}
+
+func TestCycles(t *testing.T) {
+	// A glider on an 8x8 torus is back where it started after 32 turns, whichever workers hash it
+	glider := []Cell{{1, 0}, {2, 1}, {0, 2}, {1, 2}, {2, 2}}
+	for _, engine := range localEngines {
+		sim, err := New(WithEngine(engine), WithSize(8, 8), WithThreads(4), WithTiles(true), WithCells(glider),
+			WithCycleDetection(false))
+		assert.NoError(t, err)
+		assert.NoError(t, sim.Step(31))
+		_, _, found := sim.Cycle()
+		assert.False(t, found, engine)
+		assert.NoError(t, sim.Step(5))
+		start, period, found := sim.Cycle()
+		assert.True(t, found, engine)
+		assert.Equal(t, []int{0, 32}, []int{start, period}, engine)
+		assert.Equal(t, 36, sim.Turn())
+	}
+
+	// On a plane the glider never comes back, but a blinker does
+	sim, err := New(WithEngine(Sparse), WithTopology(Plane), WithCells(glider), WithCycleDetection(false))
+	assert.NoError(t, err)
+	assert.NoError(t, sim.Step(100))
+	_, _, found := sim.Cycle()
+	assert.False(t, found)
+	sim, err = New(WithEngine(Sparse), WithTopology(Plane), WithCells([]Cell{{-1, 5}, {0, 5}, {1, 5}}), WithCycleDetection(false))
+	assert.NoError(t, err)
+	assert.NoError(t, sim.Step(3))
+	start, period, found := sim.Cycle()
+	assert.True(t, found)
+	assert.Equal(t, []int{0, 2}, []int{start, period})
+
+	// Skipping the cycles of a soup ends with the world of the last turn
+	cells := randomCells(32, 32, 0.35, 11)
+	for _, engine := range localEngines {
+		skipping, err := New(WithEngine(engine), WithSize(32, 32), WithThreads(2), WithCells(cells), WithTurns(5001),
+			WithCycleDetection(true))
+		assert.NoError(t, err)
+		var stabilised []Stabilised
+		unsubscribe := skipping.Subscribe(ObserverFunc(func(e Event) {
+			if s, ok := e.(Stabilised); ok {
+				stabilised = append(stabilised, s)
+			}
+		}), Drop, 1)
+		assert.NoError(t, skipping.Run(context.Background()))
+		unsubscribe()
+		assert.Equal(t, 5001, skipping.Turn())
+
+		start, period, found := skipping.Cycle()
+		assert.True(t, found, engine)
+		assert.Equal(t, []Stabilised{{Turn: start + period, Start: start, Period: period}}, stabilised, engine)
+		assert.True(t, start+period < 5001, engine)
+
+		full, err := New(WithEngine(Shared), WithSize(32, 32), WithCells(cells))
+		assert.NoError(t, err)
+		assert.NoError(t, full.Step(5001))
+		assert.Equal(t, full.AliveCells(), skipping.AliveCells(), engine)
+	}
+
+	// Worlds whose hashes collide are told apart by their populations
+	c := &cycles{}
+	assert.False(t, c.Record(0, 42, 3))
+	assert.False(t, c.Record(1, 42, 5))
+	assert.True(t, c.Record(2, 42, 3))
+	assert.Equal(t, []int{0, 2}, []int{c.Start, c.Period})
+}
+
+// Returns the cells of a pattern drawn in rows separated by /, with its top left at x,y
+func pattern(x, y int, rows string) []Cell {
+	var cells []Cell
+	for i, row := range strings.Split(rows, "/") {
+		for j, c := range row {
+			if c == 'X' {
+				cells = append(cells, Cell{X: x + j, Y: y + i})
+			}
+		}
+	}
+	return cells
+}
+
+func TestCensus(t *testing.T) {
+	var cells []Cell
+	for _, p := range [][]Cell{
+		pattern(5, 5, "XX/XX"),
+		pattern(20, 5, "XX/XX"),
+		pattern(63, 63, "X"), pattern(0, 63, "X"), pattern(63, 0, "X"), pattern(0, 0, "X"), // A block across the corners
+		pattern(40, 5, "XXX"),
+		pattern(50, 20, "X/X/X"),
+		pattern(10, 30, ".X./..X/XXX"),
+		pattern(20, 30, "X.X/.XX/.X."), // A glider in another phase and orientation
+		pattern(30, 45, ".X..X/X..../X...X/XXXX."),
+		pattern(45, 50, ".XX./X..X/.XX."),
+		pattern(10, 50, "XX.X/X.XX"), // A snake, which has no common name here
+	} {
+		cells = append(cells, p...)
+	}
+	sim, err := New(WithSize(64, 64), WithCells(cells))
+	assert.NoError(t, err)
+	census := sim.Census()
+
+	names := strings.Split(census.String(), ", ")
+	assert.Equal(t, []string{"block x3", "blinker x2", "glider x2", "beehive x1", "lightweight spaceship x1"}, names[:5])
+	assert.Len(t, names, 6)
+	assert.True(t, strings.HasPrefix(names[5], "xs6_"), names[5])
+	for _, tally := range census {
+		switch tally.Name {
+		case "block":
+			assert.Equal(t, Object{Name: "block", Kind: StillLife, Period: 1, Cells: pattern(0, 0, "XX/XX")}, tally.Object)
+		case "blinker":
+			assert.Equal(t, Oscillator, tally.Kind)
+			assert.Equal(t, 2, tally.Period)
+		case "glider":
+			assert.Equal(t, Spaceship, tally.Kind)
+			assert.Equal(t, []int{4, 1, 1}, []int{tally.Period, tally.Displacement.X, tally.Displacement.Y})
+		case "lightweight spaceship":
+			assert.Equal(t, []int{4, 2, 0}, []int{tally.Period, tally.Displacement.X, tally.Displacement.Y})
+		}
+	}
+
+	// Objects close enough to touch are only counted apart if they run the same apart
+	sim, err = New(WithSize(32, 32), WithCells(append(append(pattern(2, 2, "XX../XX../..XX/..XX"), pattern(12, 2, "XX.XX/XX.XX")...),
+		pattern(22, 2, "XXX")...)))
+	assert.NoError(t, err)
+	assert.Equal(t, "block x2, beacon x1, blinker x1", sim.Census().String())
+
+	// The objects are found wherever they are on a plane, once they have settled
+	plane, err := New(WithEngine(Sparse), WithTopology(Plane), WithCells(append(pattern(0, 0, ".X./..X/XXX"), pattern(-30, 0, "XX/X.")...)))
+	assert.NoError(t, err)
+	census = plane.Census()
+	assert.Len(t, census, 2)
+	assert.Equal(t, Unstable, census[1].Kind)
+	assert.NoError(t, plane.Step(200))
+	assert.Equal(t, "block x1, glider x1", plane.Census().String())
+	census = TakeCensus(Snapshot{World: [][]byte{{0xFF, 0xFF, 0xFF, 0xFF}}}, Conway, Bounded)
+	assert.Equal(t, Unstable, census[0].Kind)
+	assert.True(t, strings.HasPrefix(census[0].Name, "zz4_"), census[0].Name)
+}
+
+func TestSoup(t *testing.T) {
+	for _, symmetry := range []Symmetry{C1, C2, C4, D8} {
+		soup := Soup{Density: 0.3, Seed: 42, Symmetry: symmetry, Size: 20}
+		cells, err := soup.Cells(64, 48)
+		assert.NoError(t, err)
+		again, err := soup.Cells(64, 48)
+		assert.NoError(t, err)
+		assert.Equal(t, cells, again, symmetry)
+		soup.Seed++
+		other, err := soup.Cells(64, 48)
+		assert.NoError(t, err)
+		assert.NotEqual(t, cells, other, symmetry)
+
+		// The soup is in the middle of the world, and looks the same however it is turned
+		alive := make(map[Cell]bool)
+		for _, c := range cells {
+			assert.True(t, c.X >= 22 && c.X < 42 && c.Y >= 14 && c.Y < 34, c)
+			alive[Cell{X: c.X - 22, Y: c.Y - 14}] = true
+		}
+		assert.InDelta(t, 0.3*400, len(cells), 40, symmetry)
+		for c := range alive {
+			for _, o := range soup.orbit(c, 20, 20) {
+				assert.True(t, alive[o], symmetry)
+			}
+		}
+		parsed, err := ParseSymmetry(strings.ToLower(symmetry.String()))
+		assert.NoError(t, err)
+		assert.Equal(t, symmetry, parsed)
+	}
+
+	cells, err := Soup{Density: 1}.Cells(5, 3)
+	assert.NoError(t, err)
+	assert.Len(t, cells, 15)
+	_, err = Soup{Density: 0.5, Symmetry: C4}.Cells(5, 3)
+	assert.Error(t, err)
+	_, err = Soup{Density: 0.5, Size: 6}.Cells(5, 3)
+	assert.Error(t, err)
+	_, err = Soup{Density: 1.5}.Cells(5, 3)
+	assert.Error(t, err)
+	_, err = ParseSymmetry("C3")
+	assert.Error(t, err)
+}
+
+func TestSearch(t *testing.T) {
+	search := Search{Soups: 20, Soup: Soup{Density: 0.5, Seed: 100, Size: 16}, Rule: Conway, Threads: 1, MaxTurns: 5000, Keep: 5}
+	alone, err := search.Run(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, 20, alone.Soups)
+	assert.Len(t, alone.Longest, 5)
+	for i := 1; i < len(alone.Longest); i++ {
+		assert.True(t, alone.Longest[i-1].Lifespan >= alone.Longest[i].Lifespan)
+	}
+	assert.Equal(t, "block", alone.Census[0].Name)
+
+	// The soups are shared out between workers, but what they find does not depend on which runs which
+	search.Threads = 3
+	shared, err := search.Run(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, alone, shared)
+
+	// The longest lived soup has settled by the turn it is said to have
+	longest := alone.Longest[0]
+	cells, err := longest.Soup.Cells(16, 16)
+	assert.NoError(t, err)
+	sim, err := New(WithEngine(Sparse), WithTopology(Plane), WithCells(cells))
+	assert.NoError(t, err)
+	assert.NoError(t, sim.Step(longest.Lifespan+200))
+	assert.Equal(t, longest.Census, sim.Census())
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = search.Run(ctx)
+	assert.Equal(t, context.Canceled, err)
+	search.Soup.Size = 0
+	_, err = search.Run(context.Background())
+	assert.Error(t, err)
+}
+
+func TestRun(t *testing.T) {
+	cells := randomCells(64, 64, 0.3, 2)
+	sim, err := New(WithSize(64, 64), WithThreads(4), WithCells(cells), WithTurns(300))
+	assert.NoError(t, err)
+	assert.NoError(t, sim.Run(context.Background()))
+	assert.Equal(t, 300, sim.Turn())
+
+	world := makeMatrix(64, 64)
+	for _, c := range cells {
+		world[c.Y][c.X] = 0xFF
+	}
+	for i := 0; i < 300; i++ {
+		world = referenceTurn(world, Conway, Torus)
+	}
+	assert.Equal(t, world, sim.Snapshot().World)
+
+	// Running again past the last turn does nothing
+	assert.NoError(t, sim.Run(context.Background()))
+	assert.Equal(t, 300, sim.Turn())
+}
+
+func TestPause(t *testing.T) {
+	for _, engine := range localEngines {
+		t.Run(engine.String(), func(t *testing.T) {
+			sim, err := New(WithEngine(engine), WithSize(64, 64), WithThreads(3), WithTiles(true), WithCells(randomCells(64, 64, 0.3, 3)))
+			assert.NoError(t, err)
+
+			ctx, cancel := context.WithCancel(context.Background())
+			finished := make(chan error, 1)
+			go func() {
+				finished <- sim.Run(ctx)
+			}()
+			for sim.Turn() == 0 {
+			}
+
+			// Nothing changes while paused
+			sim.Pause()
+			first := sim.Snapshot()
+			assert.Equal(t, ErrRunning, sim.Step(1))
+			assert.Equal(t, first, sim.Snapshot())
+			assert.Equal(t, first.Turn, sim.Turn())
+			population := 0
+			for _, row := range first.World {
+				for _, c := range row {
+					if c == 0xFF {
+						population++
+					}
+				}
+			}
+			assert.Equal(t, population, sim.Population())
+
+			sim.Resume()
+			for sim.Turn() <= first.Turn {
+			}
+
+			// Cancelling keeps the world of the turn the workers stopped at
+			sim.Pause()
+			second := sim.Snapshot()
+			cancel()
+			assert.Equal(t, context.Canceled, <-finished)
+			assert.Equal(t, second, sim.Snapshot())
+
+			// The simulation stays paused, so stepping waits until it is resumed, and starts from the same turn
+			stepped := make(chan error, 1)
+			go func() {
+				stepped <- sim.Step(10)
+			}()
+			assert.Equal(t, second, sim.Snapshot())
+			sim.Resume()
+			assert.NoError(t, <-stepped)
+			assert.Equal(t, second.Turn+10, sim.Turn())
+		})
+	}
+}
+
+func TestNew(t *testing.T) {
+	_, err := New()
+	assert.Error(t, err)
+	_, err = New(WithSize(16, 16), WithThreads(17))
+	assert.Error(t, err)
+	_, err = New(WithSize(16, 16), WithThreads(0))
+	assert.Error(t, err)
+	_, err = New(WithSize(16, 16), WithCells([]Cell{{16, 0}}))
+	assert.Error(t, err)
+	_, err = New(WithSize(16, 16), WithThreads(16), WithTiles(true))
+	assert.NoError(t, err)
+	_, err = New(WithSize(16, 16), WithEngine(Engine(len(Engines))))
+	assert.Error(t, err)
+	_, err = New(WithSize(16, 16), WithEngine(Remote))
+	assert.Error(t, err)
+
+	for _, engine := range Engines {
+		e, err := ParseEngine(engine.String())
+		assert.NoError(t, err)
+		assert.Equal(t, engine, e)
+	}
+	_, err = ParseEngine("gpu")
+	assert.Error(t, err)
+}
+
+// Returns the world with the cells of each CellsFlipped event flipped
+func applyFlips(world [][]byte, events []Event) [][]byte {
+	world = copyWorld(world)
+	for _, e := range events {
+		if flipped, ok := e.(CellsFlipped); ok {
+			for _, c := range flipped.Cells {
+				world[c.Y][c.X] ^= 0xFF
+			}
+		}
+	}
+	return world
+}
+
+func TestObserver(t *testing.T) {
+	for _, engine := range localEngines {
+		t.Run(engine.String(), func(t *testing.T) {
+			sim, err := New(WithEngine(engine), WithSize(30, 20), WithThreads(4), WithTiles(true), WithHaloDepth(2), WithTopology(Bounded),
+				WithCells(randomCells(30, 20, 0.4, 4)))
+			assert.NoError(t, err)
+			start := sim.Snapshot().World
+
+			var events []Event
+			unsubscribe := sim.Subscribe(ObserverFunc(func(e Event) {
+				events = append(events, e)
+			}), Block, 1)
+			assert.NoError(t, sim.Step(20))
+			unsubscribe()
+
+			// Every turn is reported in order, and the flips of the turns so far give its world
+			assert.Len(t, events, 2*20+1)
+			expected := start
+			for turn := 1; turn <= 20; turn++ {
+				expected = referenceTurn(expected, Conway, Bounded)
+				assert.Equal(t, TurnComplete{Turn: turn, Population: population(expected)}, events[2*turn-2])
+				assert.Equal(t, turn, events[2*turn-1].CompletedTurns())
+				assert.Equal(t, expected, applyFlips(start, events[:2*turn]))
+			}
+			assert.Equal(t, Finished{Turn: 20, Population: population(expected)}, events[len(events)-1])
+
+			// Nothing is sent after unsubscribing
+			assert.NoError(t, sim.Step(1))
+			assert.Len(t, events, 2*20+1)
+		})
+	}
+}
+
+func TestObserverEvents(t *testing.T) {
+	sim, err := New(WithSize(64, 64), WithThreads(4), WithCells(randomCells(64, 64, 0.3, 5)), WithTurns(500))
+	assert.NoError(t, err)
+
+	var events []Event
+	unsubscribe := sim.Subscribe(ObserverFunc(func(e Event) {
+		events = append(events, e)
+	}), Block, 16)
+	finished := make(chan error, 1)
+	go func() {
+		finished <- sim.Run(context.Background())
+	}()
+	for sim.Turn() == 0 {
+	}
+	sim.Pause()
+	snapshot := sim.Snapshot()
+	sim.Resume()
+	assert.NoError(t, <-finished)
+	unsubscribe()
+
+	// Turns are reported up to the pause, then resume after it
+	paused := snapshot.Turn
+	var kinds []string
+	turn := 0
+	for _, e := range events {
+		switch e := e.(type) {
+		case TurnComplete:
+			turn++
+			assert.Equal(t, turn, e.Turn)
+		case CellsFlipped:
+		default:
+			kinds = append(kinds, fmt.Sprintf("%T %d", e, e.CompletedTurns()))
+		}
+	}
+	assert.Equal(t, 500, turn)
+	assert.Equal(t, []string{
+		fmt.Sprint("gol.Paused ", paused),
+		fmt.Sprint("gol.Saved ", paused),
+		fmt.Sprint("gol.Resumed ", paused),
+		"gol.Finished 500",
+	}, kinds)
+}
+
+func TestObserverPolicy(t *testing.T) {
+	for _, policy := range []Policy{Drop, Coalesce} {
+		sim, err := New(WithSize(32, 32), WithThreads(2), WithCells(randomCells(32, 32, 0.4, 6)))
+		assert.NoError(t, err)
+		start := sim.Snapshot().World
+
+		// The observer holds up the first event until the simulation is done, which it does not wait for
+		var events []Event
+		release := make(chan struct{})
+		unsubscribe := sim.Subscribe(ObserverFunc(func(e Event) {
+			<-release
+			events = append(events, e)
+		}), policy, 2)
+		assert.NoError(t, sim.Step(50))
+		close(release)
+		unsubscribe()
+
+		final := sim.Snapshot().World
+		assert.True(t, len(events) < 2*50, policy)
+		assert.Equal(t, Finished{Turn: 50, Population: population(final)}, events[len(events)-1])
+		if policy == Coalesce {
+			// Merged flips still add up to the final world, and no event comes before one of an earlier turn
+			assert.Equal(t, final, applyFlips(start, events))
+			for i := 1; i < len(events); i++ {
+				assert.True(t, events[i-1].CompletedTurns() <= events[i].CompletedTurns(), "%v before %v", events[i-1], events[i])
+			}
+			last := events[len(events)-2]
+			if _, ok := last.(CellsFlipped); ok {
+				last = events[len(events)-3]
+			}
+			assert.Equal(t, TurnComplete{Turn: 50, Population: population(final)}, last)
+		}
+	}
+
+	// Flips are merged in the order they came, so observers see the same cells however often they run
+	a, b, c, d := Cell{X: 1}, Cell{X: 2}, Cell{X: 3}, Cell{X: 4}
+	assert.Equal(t, []Cell{a, c, d}, mergeFlips([]Cell{a, b, c}, []Cell{b, d}))
+}
+
+// Returns the bounds of the alive cells of a world
+func boundsOf(world [][]byte) Bounds {
+	var b Bounds
+	for y, row := range world {
+		for x, c := range row {
+			if c == 0xFF {
+				b.add(Cell{X: x, Y: y})
+			}
+		}
+	}
+	return b
+}
+
+func TestStatistics(t *testing.T) {
+	for _, engine := range localEngines {
+		t.Run(engine.String(), func(t *testing.T) {
+			sim, err := New(WithEngine(engine), WithSize(30, 20), WithThreads(4), WithTopology(Bounded),
+				WithCells(randomCells(30, 20, 0.1, 8)), WithStatistics(3))
+			assert.NoError(t, err)
+			world := sim.Snapshot().World
+			assert.Equal(t, Statistics{Population: population(world), Bounds: boundsOf(world),
+				Density: float64(population(world)) / 600}, sim.Statistics())
+
+			var events []Statistics
+			unsubscribe := sim.Subscribe(ObserverFunc(func(e Event) {
+				if stats, ok := e.(Statistics); ok {
+					events = append(events, stats)
+				}
+			}), Block, 1)
+			// Births and deaths carry on adding up when the engine stops for a request
+			assert.NoError(t, sim.Step(10))
+			sim.Population()
+			assert.NoError(t, sim.Step(10))
+			unsubscribe()
+
+			var expected []Statistics
+			births, deaths := 0, 0
+			for turn := 1; turn <= 20; turn++ {
+				next := referenceTurn(world, Conway, Bounded)
+				for y := range next {
+					for x := range next[y] {
+						if next[y][x] > world[y][x] {
+							births++
+						} else if next[y][x] < world[y][x] {
+							deaths++
+						}
+					}
+				}
+				world = next
+				if turn%3 == 0 {
+					expected = append(expected, Statistics{Turn: turn, Population: population(world), Births: births,
+						Deaths: deaths, Bounds: boundsOf(world), Density: float64(population(world)) / 600})
+					births, deaths = 0, 0
+				}
+			}
+			assert.Equal(t, expected, events)
+		})
+	}
+
+	// On a plane the density is of the bounds, which follow a glider
+	glider := []Cell{{0, 0}, {1, 0}, {2, 0}, {0, 1}, {1, 2}}
+	sim, err := New(WithEngine(Sparse), WithTopology(Plane), WithCells(glider), WithStatistics(4))
+	assert.NoError(t, err)
+	var events []Statistics
+	unsubscribe := sim.Subscribe(ObserverFunc(func(e Event) {
+		if stats, ok := e.(Statistics); ok {
+			events = append(events, stats)
+		}
+	}), Block, 1)
+	assert.NoError(t, sim.Step(12))
+	unsubscribe()
+	assert.Len(t, events, 3)
+	for i, stats := range events {
+		assert.Equal(t, 4*(i+1), stats.Turn)
+		assert.Equal(t, 5, stats.Population)
+		assert.Equal(t, stats.Births, stats.Deaths)
+		assert.Equal(t, Cell{-i - 1, -i - 1}, stats.Bounds.Min)
+		assert.Equal(t, Cell{1 - i, 1 - i}, stats.Bounds.Max)
+		assert.Equal(t, 5.0/9, stats.Density)
+	}
+
+	_, err = New(WithSize(8, 8), WithStatistics(0))
+	assert.Error(t, err)
+}
+
+func TestHeatmap(t *testing.T) {
+	for _, engine := range localEngines {
+		t.Run(engine.String(), func(t *testing.T) {
+			sim, err := New(WithEngine(engine), WithSize(20, 16), WithThreads(4), WithTopology(Bounded),
+				WithCells(randomCells(20, 16, 0.3, 9)), WithHeatmap())
+			assert.NoError(t, err)
+			world := sim.Snapshot().World
+			// The heat carries on adding up when the engine stops for a request, observed or not
+			assert.NoError(t, sim.Step(7))
+			sim.Population()
+			unsubscribe := sim.Subscribe(ObserverFunc(func(e Event) {}), Drop, 1)
+			assert.NoError(t, sim.Step(8))
+			unsubscribe()
+
+			expected := &Heatmap{Turns: 15, Alive: make([][]int, 16), Changed: make([][]int, 16)}
+			for y := range expected.Alive {
+				expected.Alive[y], expected.Changed[y] = make([]int, 20), make([]int, 20)
+			}
+			for turn := 1; turn <= 15; turn++ {
+				next := referenceTurn(world, Conway, Bounded)
+				for y := range next {
+					for x := range next[y] {
+						if next[y][x] == 0xFF {
+							expected.Alive[y][x]++
+						}
+						if next[y][x] != world[y][x] {
+							expected.Changed[y][x]++
+						}
+					}
+				}
+				world = next
+			}
+			assert.Equal(t, expected, sim.Heatmap())
+		})
+	}
+
+	// On a plane it is cropped to the cells a glider has passed through
+	glider := []Cell{{0, 0}, {1, 0}, {2, 0}, {0, 1}, {1, 2}}
+	sim, err := New(WithEngine(Sparse), WithTopology(Plane), WithCells(glider), WithHeatmap())
+	assert.NoError(t, err)
+	assert.NoError(t, sim.Step(40))
+	h := sim.Heatmap()
+	assert.Equal(t, 40, h.Turns)
+	assert.Equal(t, Cell{-10, -10}, h.Origin)
+	assert.Len(t, h.Alive, 13)
+	total := 0
+	for _, row := range h.Alive {
+		assert.Len(t, row, 13)
+		for _, alive := range row {
+			total += alive
+		}
+	}
+	assert.Equal(t, 5*40, total)
+
+	sim, err = New(WithSize(8, 8))
+	assert.NoError(t, err)
+	assert.Nil(t, sim.Heatmap())
+}
+
+func TestFrames(t *testing.T) {
+	for _, engine := range localEngines {
+		t.Run(engine.String(), func(t *testing.T) {
+			sim, err := New(WithEngine(engine), WithSize(20, 16), WithThreads(4), WithCells(randomCells(20, 16, 0.3, 10)),
+				WithFrames(4), WithTurns(16))
+			assert.NoError(t, err)
+			world := sim.Snapshot().World
+
+			var frames []Frame
+			unsubscribe := sim.Subscribe(ObserverFunc(func(e Event) {
+				if frame, ok := e.(Frame); ok {
+					frames = append(frames, frame)
+				}
+			}), Block, 1)
+			// Frames carry on at the same turns whatever the steps
+			assert.NoError(t, sim.Step(10))
+			assert.NoError(t, sim.Run(context.Background()))
+			unsubscribe()
+
+			var expected []Frame
+			for turn := 1; turn <= 16; turn++ {
+				world = referenceTurn(world, Conway, Torus)
+				if turn%4 == 0 {
+					expected = append(expected, Frame{Turn: turn, World: world})
+				}
+			}
+			assert.Equal(t, expected, frames)
+		})
+	}
+
+	_, err := New(WithSize(8, 8), WithFrames(-1))
+	assert.Error(t, err)
+}
+
+func TestMacrocell(t *testing.T) {
+	// A glider as Golly writes it, in the bottom right quarter of a 16x16 root centred on 0,0
+	glider := []Cell{{1, 0}, {2, 1}, {0, 2}, {1, 2}, {2, 2}}
+	cells, rule, err := ReadMacrocell(strings.NewReader("[M2] (golly 2.8)\n#R B36/S23\n#C A glider\n.*$..*$***$\n4 0 0 0 1\n"))
+	assert.NoError(t, err)
+	assert.ElementsMatch(t, glider, cells)
+	assert.Equal(t, "B36/S23", rule.String())
+
+	// It fits in a single leaf, which is the root
+	var b strings.Builder
+	assert.NoError(t, WriteMacrocell(&b, glider, Conway))
+	assert.Equal(t, "[M2] (uk.ac.bris.cs/gameoflife)\n#R B3/S23\n$$$$.....*$......*$....***$\n", b.String())
+
+	// Blocks repeated across a large area, on both sides of 0,0, are written as a few nodes
+	var blocks []Cell
+	for y := -500; y < 500; y += 50 {
+		for x := -500; x < 500; x += 50 {
+			blocks = append(blocks, pattern(x, y, "OO\nOO")...)
+		}
+	}
+	b.Reset()
+	assert.NoError(t, WriteMacrocell(&b, blocks, Conway))
+	assert.True(t, strings.Count(b.String(), "\n") < 100, b.String())
+	cells, rule, err = ReadMacrocell(strings.NewReader(b.String()))
+	assert.NoError(t, err)
+	assert.ElementsMatch(t, blocks, cells)
+	assert.Equal(t, Conway, rule)
+
+	// A pattern loaded into a plane is written as it is after running
+	sim, err := New(WithEngine(Sparse), WithTopology(Plane), WithCells(glider))
+	assert.NoError(t, err)
+	assert.NoError(t, sim.Step(4))
+	b.Reset()
+	assert.NoError(t, WriteMacrocell(&b, sim.AliveCells(), Conway))
+	cells, _, err = ReadMacrocell(strings.NewReader(b.String()))
+	assert.NoError(t, err)
+	var moved []Cell
+	for _, c := range glider {
+		moved = append(moved, Cell{X: c.X + 1, Y: c.Y + 1})
+	}
+	assert.ElementsMatch(t, moved, cells)
+
+	b.Reset()
+	assert.NoError(t, WriteMacrocell(&b, nil, Conway))
+	cells, _, err = ReadMacrocell(strings.NewReader(b.String()))
+	assert.NoError(t, err)
+	assert.Empty(t, cells)
+
+	for _, bad := range []string{"x = 3, y = 3\n", "[M2]\n", "[M2]\n.*$\n5 0 0 0 1\n", "[M2]\n.*$\n4 0 0 0 2\n", "[M2]\n.o$\n",
+		"[M2]\n.*$\n63 0 0 0 0\n"} {
+		_, _, err = ReadMacrocell(strings.NewReader(bad))
+		assert.Error(t, err, bad)
+	}
+
+	// A full leaf repeated up to the given level, which fills its whole square
+	full := func(level int) string {
+		file := "[M2]\n" + strings.Repeat("********$", 8) + "\n"
+		for l := 4; l <= level; l++ {
+			id := l - 3
+			file += fmt.Sprintf("%d %d %d %d %d\n", l, id, id, id, id)
+		}
+		return file
+	}
+
+	// A plane loads the pattern chunk by chunk, without listing its cells
+	m, err := ParseMacrocell(strings.NewReader(full(10)))
+	assert.NoError(t, err)
+	sim, err = New(WithEngine(Sparse), WithTopology(Plane), WithMacrocell(m), WithCells([]Cell{{-512, -512}, {600, 0}}))
+	assert.NoError(t, err)
+	assert.Equal(t, 1024*1024+1, sim.Population())
+	for _, cells := range [][]Cell{moved, blocks} {
+		b.Reset()
+		assert.NoError(t, WriteMacrocell(&b, cells, Conway))
+		m, err = ParseMacrocell(strings.NewReader(b.String()))
+		assert.NoError(t, err)
+		sim, err = New(WithEngine(Sparse), WithTopology(Plane), WithMacrocell(m))
+		assert.NoError(t, err)
+		assert.ElementsMatch(t, cells, sim.AliveCells())
+	}
+	m, err = ParseMacrocell(strings.NewReader(full(8)))
+	assert.NoError(t, err)
+	sim, err = New(WithSize(256, 256), WithMacrocell(m))
+	assert.Error(t, err)
+
+	// A few lines can describe more cells than fit in memory, which are refused rather than expanded
+	_, _, err = ReadMacrocell(strings.NewReader(full(40)))
+	assert.Error(t, err)
+	m, err = ParseMacrocell(strings.NewReader(full(40)))
+	assert.NoError(t, err)
+	_, err = New(WithEngine(Sparse), WithTopology(Plane), WithMacrocell(m))
+	assert.Error(t, err)
+}
+
+// Compares the dense and sparse engines on a world which is mostly dead, holding a few gliders
+func BenchmarkSparse(b *testing.B) {
+	var cells []Cell
+	for i := 0; i < 8; i++ {
+		x, y := 60*i, 40*i
+		cells = append(cells, Cell{x + 1, y}, Cell{x + 2, y + 1}, Cell{x, y + 2}, Cell{x + 1, y + 2}, Cell{x + 2, y + 2})
+	}
+	for _, engine := range []Engine{Shared, Sparse} {
+		b.Run(engine.String(), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				sim, err := New(WithEngine(engine), WithSize(512, 512), WithThreads(8), WithCells(cells))
+				if err != nil {
+					b.Fatal(err)
+				}
+				err = sim.Step(1000)
+				if err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,112 @@
+package gol
+
+// WithHeatmap counts, for every cell, the turns it was alive after and the turns it changed in, read with Heatmap
+func WithHeatmap() Option {
+	return func(c *config) {
+		c.heatmap = true
+	}
+}
+
+// Heatmap is how active every cell of the world was over the turns counted
+type Heatmap struct {
+	Turns   int     // Turns counted, from the turn the simulation was created at
+	Origin  Cell    // Position of the top left cell, which is only moved from 0,0 on a Plane
+	Alive   [][]int // Turns each cell was alive after, row by row
+	Changed [][]int // Turns each cell was born or died in, row by row
+}
+
+// Counts of a cell which has been alive
+type heatCounts struct {
+	alive   int // Turns alive after, up to the last time it died
+	changed int
+	since   int // First turn of the current time alive, 0 while dead
+}
+
+// Counts of the cells which have been alive, added to from the reports of every turn.
+// Only the cells which flip are looked at, so each turn costs as little as sending CellsFlipped.
+type heat struct {
+	start, turn int
+	cells       map[Cell]*heatCounts
+}
+
+// Starts counting from the world the simulation starts from
+func (s *Simulation) startHeat() {
+	h := &heat{start: s.turn, turn: s.turn, cells: make(map[Cell]*heatCounts)}
+	alive := func(c Cell) {
+		h.cells[c] = &heatCounts{since: s.turn + 1}
+	}
+	if plane, ok := s.engine.(*planeEngine); ok {
+		plane.each(alive)
+	} else {
+		for y, row := range s.engine.snapshot() {
+			for x, c := range row {
+				if c == 0xFF {
+					alive(Cell{X: x, Y: y})
+				}
+			}
+		}
+	}
+	s.heat = h
+}
+
+// Adds the cells which flipped in a turn
+func (h *heat) record(turn int, flipped []Cell) {
+	h.turn = turn
+	for _, c := range flipped {
+		counts := h.cells[c]
+		if counts == nil {
+			counts = &heatCounts{}
+			h.cells[c] = counts
+		}
+		counts.changed++
+		if counts.since == 0 {
+			counts.since = turn
+		} else {
+			counts.alive += turn - counts.since
+			counts.since = 0
+		}
+	}
+}
+
+// Heatmap returns the activity of every cell since the simulation was created, or nil without WithHeatmap.
+// On a Plane it is cropped to the cells which have been alive.
+// Turns skipped with WithCycleDetection are counted as if the world had stayed the same.
+func (s *Simulation) Heatmap() *Heatmap {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.heat == nil {
+		return nil
+	}
+	// Skipped turns are only added to the turn of the simulation
+	turn := s.heat.turn
+	if s.turn > turn {
+		turn = s.turn
+	}
+
+	var bounds Bounds
+	if s.p.topology == Plane {
+		for c := range s.heat.cells {
+			bounds.add(c)
+		}
+		if bounds.Empty() {
+			bounds.add(Cell{})
+		}
+	} else {
+		bounds = Bounds{Max: Cell{X: s.p.imageWidth - 1, Y: s.p.imageHeight - 1}, set: true}
+	}
+
+	h := &Heatmap{Turns: turn - s.heat.start, Origin: bounds.Min}
+	h.Alive, h.Changed = make([][]int, bounds.Height()), make([][]int, bounds.Height())
+	for y := range h.Alive {
+		h.Alive[y], h.Changed[y] = make([]int, bounds.Width()), make([]int, bounds.Width())
+	}
+	for c, counts := range s.heat.cells {
+		alive := counts.alive
+		if counts.since != 0 {
+			alive += turn - counts.since + 1
+		}
+		h.Alive[c.Y-bounds.Min.Y][c.X-bounds.Min.X] = alive
+		h.Changed[c.Y-bounds.Min.Y][c.X-bounds.Min.X] = counts.changed
+	}
+	return h
+}
@@ -0,0 +1,260 @@
+package gol
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// Level of the leaves of a macrocell file, which are 8x8 cells
+const leafLevel = 3
+
+// Level of the nodes of a macrocell file which are the size of a chunk of a plane
+const chunkLevel = 6
+
+// Highest level of a node, so the positions of the cells of the root fit in an int
+const maxMacrocellLevel = 62
+
+// Most alive cells a macrocell pattern is listed as, and most chunks it is loaded into on a plane.
+// A file of a few lines can repeat a node enough times to fill any memory, so larger patterns are refused.
+const (
+	maxMacrocellCells  = 1 << 24
+	maxMacrocellChunks = 1 << 16
+)
+
+// A node of a macrocell file: a leaf holding its alive cells, or four nodes of the level below, 0 when empty
+type macrocellNode struct {
+	level      int
+	cells      []Cell // Alive cells of a leaf, from its top left cell
+	children   [4]int // Top left, top right, bottom left and bottom right
+	population int    // Alive cells of the node, counted up to one more than maxMacrocellCells
+	chunks     int    // Chunks of a plane the node covers, counted up to one more than maxMacrocellChunks
+}
+
+// Macrocell is a pattern in Golly's macrocell format, placed with the centre of its root at 0,0 as Golly places it.
+// It is kept as the tree of nodes of the file, where each repeated node is stored once.
+type Macrocell struct {
+	Rule  Rule // Rule of the #R line, or Conway's without one
+	nodes []macrocellNode
+}
+
+// ReadMacrocell reads a pattern in Golly's macrocell format, returning its alive cells and the rule of its #R line,
+// or Conway's without one. The pattern is placed with the centre of its root at 0,0, as Golly places it.
+// Each copy of a repeated node is expanded into cells, so patterns with more than millions of alive cells are refused.
+func ReadMacrocell(r io.Reader) ([]Cell, Rule, error) {
+	m, err := ParseMacrocell(r)
+	if err != nil {
+		return nil, Conway, err
+	}
+	cells, err := m.Cells()
+	return cells, m.Rule, err
+}
+
+// ParseMacrocell reads a pattern in Golly's macrocell format without expanding it into cells
+func ParseMacrocell(r io.Reader) (*Macrocell, error) {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	rule := Conway
+	// Nodes are numbered from 1 in the order they appear, with 0 the empty node
+	nodes := []macrocellNode{{}}
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		switch {
+		case line == 1:
+			if !strings.HasPrefix(text, "[M2]") {
+				return nil, fmt.Errorf("not a macrocell file, which starts with [M2]")
+			}
+		case text == "":
+		case strings.HasPrefix(text, "#R"):
+			var err error
+			rule, err = ParseRule(strings.TrimSpace(text[2:]))
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %v", line, err)
+			}
+		case text[0] == '#':
+		case text[0] == '.' || text[0] == '*' || text[0] == '$':
+			n, err := parseLeaf(text)
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %v", line, err)
+			}
+			nodes = append(nodes, n)
+		default:
+			n := macrocellNode{}
+			c := &n.children
+			_, err := fmt.Sscanf(text, "%d %d %d %d %d", &n.level, &c[0], &c[1], &c[2], &c[3])
+			if err != nil || n.level <= leafLevel {
+				return nil, fmt.Errorf("line %d is not a node of four nodes, or a leaf of 8x8 cells", line)
+			}
+			if n.level > maxMacrocellLevel {
+				return nil, fmt.Errorf("line %d has a node of level %d, above the highest of %d", line, n.level, maxMacrocellLevel)
+			}
+			for _, child := range c {
+				if child < 0 || child >= len(nodes) || child > 0 && nodes[child].level != n.level-1 {
+					return nil, fmt.Errorf("line %d has a node which is not one of level %d before it", line, n.level-1)
+				}
+			}
+			n.chunks = 1
+			if n.level > chunkLevel {
+				n.chunks = 0
+			}
+			for _, child := range c {
+				n.population = countUpTo(n.population+nodes[child].population, maxMacrocellCells)
+				if n.level > chunkLevel {
+					n.chunks = countUpTo(n.chunks+nodes[child].chunks, maxMacrocellChunks)
+				}
+			}
+			nodes = append(nodes, n)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(nodes) == 1 {
+		return nil, fmt.Errorf("no nodes")
+	}
+	return &Macrocell{Rule: rule, nodes: nodes}, nil
+}
+
+// Returns count, or one more than limit if it is above it, so counts of repeated nodes cannot overflow
+func countUpTo(count, limit int) int {
+	if count > limit {
+		return limit + 1
+	}
+	return count
+}
+
+// Cells returns the alive cells of the pattern, or an error if there are too many to list
+func (m *Macrocell) Cells() ([]Cell, error) {
+	root := len(m.nodes) - 1
+	if m.nodes[root].population > maxMacrocellCells {
+		return nil, fmt.Errorf("the pattern has more than %d alive cells", maxMacrocellCells)
+	}
+	half := 1 << uint(m.nodes[root].level-1)
+	cells := make([]Cell, 0, m.nodes[root].population)
+	expandNode(m.nodes, root, -half, -half, &cells)
+	return cells, nil
+}
+
+// Reads a leaf, which has a row of . for dead and * for alive cells ending with $ for each of its rows.
+// Dead cells at the end of a row and empty rows at the end are left out.
+func parseLeaf(text string) (macrocellNode, error) {
+	n := macrocellNode{level: leafLevel, chunks: 1}
+	x, y := 0, 0
+	for _, c := range text {
+		switch c {
+		case '.':
+			x++
+		case '*':
+			if x >= 8 || y >= 8 {
+				return n, fmt.Errorf("leaf has cells beyond its 8x8")
+			}
+			n.cells = append(n.cells, Cell{X: x, Y: y})
+			x++
+		case '$':
+			x, y = 0, y+1
+		default:
+			return n, fmt.Errorf("leaf has a cell %q which is not . or *", c)
+		}
+	}
+	n.population = len(n.cells)
+	return n, nil
+}
+
+// Adds the alive cells of a node with its top left cell at x,y
+func expandNode(nodes []macrocellNode, id, x, y int, cells *[]Cell) {
+	n := nodes[id]
+	for _, c := range n.cells {
+		*cells = append(*cells, Cell{X: x + c.X, Y: y + c.Y})
+	}
+	if n.level > leafLevel {
+		half := 1 << uint(n.level-1)
+		for i, child := range n.children {
+			if child != 0 {
+				expandNode(nodes, child, x+i%2*half, y+i/2*half, cells)
+			}
+		}
+	}
+}
+
+// WriteMacrocell writes cells in Golly's macrocell format, with the rule on its #R line.
+// The root is the smallest with its centre at 0,0 holding every cell, and each node which appears more than once
+// is only written the first time, so repetitive patterns stay small.
+func WriteMacrocell(w io.Writer, cells []Cell, rule Rule) error {
+	level, half := leafLevel, 1<<(leafLevel-1)
+	for _, c := range cells {
+		for c.X < -half || c.X >= half || c.Y < -half || c.Y >= half {
+			level, half = level+1, half*2
+		}
+	}
+
+	m := &macrocellWriter{w: bufio.NewWriter(w), ids: make(map[string]int)}
+	_, _ = m.w.WriteString("[M2] (uk.ac.bris.cs/gameoflife)\n#R " + rule.String() + "\n")
+	root := m.node(level, -half, -half, cells)
+	if root == 0 {
+		// An empty pattern is an empty leaf, as the root has to be written
+		_, _ = m.w.WriteString("$\n")
+	}
+	return m.w.Flush()
+}
+
+// Writes the nodes of a macrocell file, numbering them in the order they are written
+type macrocellWriter struct {
+	w   *bufio.Writer
+	ids map[string]int // Number of each node written, by its line
+}
+
+// Writes the node of the given level with its top left cell at x,y and the nodes below it, unless written already.
+// cells are the alive cells within it. Returns its number, or 0 if it is empty.
+func (m *macrocellWriter) node(level, x, y int, cells []Cell) int {
+	if len(cells) == 0 {
+		return 0
+	}
+	var line string
+	if level == leafLevel {
+		var rows [8][]byte
+		for _, c := range cells {
+			row := rows[c.Y-y]
+			for len(row) <= c.X-x {
+				row = append(row, '.')
+			}
+			row[c.X-x] = '*'
+			rows[c.Y-y] = row
+		}
+		last := 7
+		for len(rows[last]) == 0 {
+			last--
+		}
+		var b strings.Builder
+		for _, row := range rows[:last+1] {
+			b.Write(row)
+			b.WriteByte('$')
+		}
+		line = b.String()
+	} else {
+		half := 1 << uint(level-1)
+		var quadrants [4][]Cell
+		for _, c := range cells {
+			i := 0
+			if c.X >= x+half {
+				i++
+			}
+			if c.Y >= y+half {
+				i += 2
+			}
+			quadrants[i] = append(quadrants[i], c)
+		}
+		var children [4]int
+		for i, q := range quadrants {
+			children[i] = m.node(level-1, x+i%2*half, y+i/2*half, q)
+		}
+		line = fmt.Sprintf("%d %d %d %d %d", level, children[0], children[1], children[2], children[3])
+	}
+
+	if id, ok := m.ids[line]; ok {
+		return id
+	}
+	_, _ = m.w.WriteString(line + "\n")
+	m.ids[line] = len(m.ids) + 1
+	return len(m.ids)
+}
@@ -0,0 +1,399 @@
+package gol
+
+import (
+	"sync"
+	"uk.ac.bris.cs/gameoflife/protocol"
+)
+
+// Event is sent to the observers of a simulation
+type Event interface {
+	// CompletedTurns returns the number of turns completed when the event happened
+	CompletedTurns() int
+}
+
+// TurnComplete is sent once every worker has finished a turn, with the number of alive cells after it
+type TurnComplete struct {
+	Turn       int
+	Population int
+}
+
+// CellsFlipped is sent after every turn, with the cells which were born or died in it
+type CellsFlipped struct {
+	Turn  int
+	Cells []Cell
+}
+
+// Statistics is sent after every few turns with WithStatistics, describing the world after the turn
+type Statistics struct {
+	Turn       int
+	Population int
+	Births     int     // Cells born since the last Statistics
+	Deaths     int     // Cells which died since the last Statistics
+	Bounds     Bounds  // Smallest rectangle holding every alive cell
+	Density    float64 // Alive cells per cell of the world, or of Bounds on a Plane
+}
+
+// Frame is sent with WithFrames after every few turns, with a copy of the world gathered from the workers.
+// On a Plane, World is cropped to the alive cells, and Origin is the position of its top left cell.
+type Frame struct {
+	Turn   int
+	World  [][]byte
+	Origin Cell
+}
+
+// Paused is sent when the workers stop for Pause
+type Paused struct {
+	Turn int
+}
+
+// Resumed is sent when the workers carry on after Resume
+type Resumed struct {
+	Turn int
+}
+
+// Saved is sent when Snapshot copies the world
+type Saved struct {
+	Turn int
+}
+
+// Stabilised is sent when the world is the same as at an earlier turn, so it goes round the same Period worlds
+// forever from turn Start. It is only sent with WithCycleDetection.
+type Stabilised struct {
+	Turn   int
+	Start  int
+	Period int
+}
+
+// Finished is sent when a call to Step or Run returns, with the error it returned
+type Finished struct {
+	Turn       int
+	Population int
+	Err        error
+}
+
+func (e TurnComplete) CompletedTurns() int { return e.Turn }
+func (e CellsFlipped) CompletedTurns() int { return e.Turn }
+func (e Statistics) CompletedTurns() int   { return e.Turn }
+func (e Frame) CompletedTurns() int        { return e.Turn }
+func (e Paused) CompletedTurns() int       { return e.Turn }
+func (e Resumed) CompletedTurns() int      { return e.Turn }
+func (e Saved) CompletedTurns() int        { return e.Turn }
+func (e Stabilised) CompletedTurns() int   { return e.Turn }
+func (e Finished) CompletedTurns() int     { return e.Turn }
+
+// Observer receives the events of a simulation
+type Observer interface {
+	Notify(e Event)
+}
+
+// ObserverFunc lets a function be used as an Observer
+type ObserverFunc func(e Event)
+
+// Notify calls f(e)
+func (f ObserverFunc) Notify(e Event) {
+	f(e)
+}
+
+// Policy says what happens to the events of each turn when an observer falls behind.
+// Paused, Resumed, Saved and Finished are always delivered.
+type Policy int
+
+const (
+	// Block makes the workers wait for the observer
+	Block Policy = iota
+	// Drop leaves out the events which do not fit
+	Drop
+	// Coalesce merges the events of consecutive turns, so the observer gets the latest population and every cell
+	// which changed since the last event it got, with the births and deaths of the merged Statistics added up.
+	// Only the latest Frame is kept. Events still arrive in the order of their turns.
+	Coalesce
+)
+
+// Events waiting for an observer, delivered by their own goroutine
+type subscription struct {
+	observer Observer
+	policy   Policy
+	buffer   int
+
+	mutex   sync.Mutex
+	changed *sync.Cond
+	queue   []Event
+	closed  bool
+	done    chan struct{}
+}
+
+// Subscribe sends the events of the simulation to o, from a goroutine of its own.
+// Up to buffer events of turns wait for o, after which policy applies.
+// The events of each turn are sent once the engine next starts, after a request such as Population or at the latest
+// the next call to Step or Run, as only then does it start to report them.
+// Returns a function which waits for o to get the events already sent, then unsubscribes it.
+// With Block, o must not call the methods of the simulation, as the simulation may be waiting for o.
+func (s *Simulation) Subscribe(o Observer, policy Policy, buffer int) (unsubscribe func()) {
+	if buffer < 1 {
+		buffer = 1
+	}
+	sub := &subscription{observer: o, policy: policy, buffer: buffer, done: make(chan struct{})}
+	sub.changed = sync.NewCond(&sub.mutex)
+	go sub.deliver()
+
+	s.observers.Lock()
+	if s.subscriptions == nil {
+		s.subscriptions = make(map[*subscription]bool)
+	}
+	s.subscriptions[sub] = true
+	s.observers.Unlock()
+
+	return func() {
+		s.observers.Lock()
+		delete(s.subscriptions, sub)
+		s.observers.Unlock()
+
+		sub.mutex.Lock()
+		sub.closed = true
+		sub.changed.Broadcast()
+		sub.mutex.Unlock()
+		<-sub.done
+	}
+}
+
+// Returns true if anything observes the simulation
+func (s *Simulation) observed() bool {
+	s.observers.Lock()
+	defer s.observers.Unlock()
+	return len(s.subscriptions) > 0
+}
+
+// Sends an event to every observer
+func (s *Simulation) publish(e Event) {
+	s.observers.Lock()
+	subscriptions := make([]*subscription, 0, len(s.subscriptions))
+	for sub := range s.subscriptions {
+		subscriptions = append(subscriptions, sub)
+	}
+	s.observers.Unlock()
+
+	for _, sub := range subscriptions {
+		sub.push(e)
+	}
+}
+
+// Returns true for the events of each turn, which the policy applies to
+func perTurn(e Event) bool {
+	switch e.(type) {
+	case TurnComplete, CellsFlipped, Statistics, Frame:
+		return true
+	}
+	return false
+}
+
+// Queues an event, applying the policy if the queue is full
+func (sub *subscription) push(e Event) {
+	sub.mutex.Lock()
+	defer sub.mutex.Unlock()
+	if sub.closed {
+		return
+	}
+
+	if perTurn(e) && len(sub.queue) >= sub.buffer {
+		switch sub.policy {
+		case Block:
+			for len(sub.queue) >= sub.buffer && !sub.closed {
+				sub.changed.Wait()
+			}
+		case Drop:
+			return
+		case Coalesce:
+			if sub.coalesce(e) {
+				return
+			}
+		}
+	}
+	sub.queue = append(sub.queue, e)
+	sub.changed.Broadcast()
+}
+
+// Merges an event into the last queued event of the same kind, unless an event of another kind than those of each
+// turn follows it. The merged event is of the turn of e, so it moves to the end of the queue, after the events of
+// earlier turns. Returns false if there was nothing to merge into.
+func (sub *subscription) coalesce(e Event) bool {
+	for i := len(sub.queue) - 1; i >= 0; i-- {
+		merged := e
+		switch queued := sub.queue[i].(type) {
+		case TurnComplete:
+			if _, ok := e.(TurnComplete); !ok {
+				continue
+			}
+		case Frame:
+			if _, ok := e.(Frame); !ok {
+				continue
+			}
+		case CellsFlipped:
+			flipped, ok := e.(CellsFlipped)
+			if !ok {
+				continue
+			}
+			merged = CellsFlipped{Turn: flipped.Turn, Cells: mergeFlips(queued.Cells, flipped.Cells)}
+		case Statistics:
+			stats, ok := e.(Statistics)
+			if !ok {
+				continue
+			}
+			stats.Births += queued.Births
+			stats.Deaths += queued.Deaths
+			merged = stats
+		default:
+			return false
+		}
+		copy(sub.queue[i:], sub.queue[i+1:])
+		sub.queue[len(sub.queue)-1] = merged
+		return true
+	}
+	return false
+}
+
+// Returns the cells which flipped over two turns: a cell which flipped in both is back where it started.
+// The cells keep their order, those of the first turn before those only flipped in the second.
+func mergeFlips(first, second []Cell) []Cell {
+	flipped := make(map[Cell]bool, len(first)+len(second))
+	for _, c := range first {
+		flipped[c] = true
+	}
+	for _, c := range second {
+		flipped[c] = !flipped[c]
+	}
+	var cells []Cell
+	for _, turn := range [][]Cell{first, second} {
+		for _, c := range turn {
+			if flipped[c] {
+				cells = append(cells, c)
+				// Only the first time it is seen
+				flipped[c] = false
+			}
+		}
+	}
+	return cells
+}
+
+// Passes queued events to the observer, until unsubscribed and the queue is empty
+func (sub *subscription) deliver() {
+	for {
+		sub.mutex.Lock()
+		for len(sub.queue) == 0 && !sub.closed {
+			sub.changed.Wait()
+		}
+		if len(sub.queue) == 0 {
+			sub.mutex.Unlock()
+			close(sub.done)
+			return
+		}
+		e := sub.queue[0]
+		sub.queue = sub.queue[1:]
+		sub.changed.Broadcast()
+		sub.mutex.Unlock()
+
+		sub.observer.Notify(e)
+	}
+}
+
+// Sent by a worker after each turn, to be combined for the observers
+type report struct {
+	turn           int
+	population     int
+	flipped        []Cell
+	births, deaths int
+	bounds         Bounds
+	hash           uint64 // Hash of the alive cells, see protocol.CellHash
+}
+
+// Adds a cell of the world after the turn, which was alive before it if was is set
+func (r *report) add(c Cell, was, alive bool) {
+	if alive {
+		r.population++
+		r.hash ^= protocol.CellHash(c.X, c.Y)
+		r.bounds.add(c)
+	}
+	if alive != was {
+		r.flipped = append(r.flipped, c)
+		if alive {
+			r.births++
+		} else {
+			r.deaths++
+		}
+	}
+}
+
+// Adds the report of another part of the world in the same turn
+func (r *report) combine(o report) {
+	r.population += o.population
+	r.flipped = append(r.flipped, o.flipped...)
+	r.births += o.births
+	r.deaths += o.deaths
+	r.bounds.union(o.bounds)
+	r.hash ^= o.hash
+}
+
+// Combines the reports of the workers into one for each turn, passed to observe once every worker has finished it
+func combineReports(reports <-chan report, workers int, observe func(report), done chan<- struct{}) {
+	turns := make(map[int]*report)
+	counts := make(map[int]int)
+	for rep := range reports {
+		t, ok := turns[rep.turn]
+		if !ok {
+			t = &report{turn: rep.turn}
+			turns[rep.turn] = t
+		}
+		t.combine(rep)
+		counts[rep.turn]++
+		if counts[rep.turn] == workers {
+			observe(*t)
+			delete(turns, rep.turn)
+			delete(counts, rep.turn)
+		}
+	}
+	close(done)
+}
+
+// Returns the function the engine reports each turn to, publishing the events of turns counted from start
+// looking for cycles and counting heat. stop is called to stop the engine once a cycle can be skipped.
+// Returns nil when nothing observes the simulation and there are no cycles to look for or heat to count,
+// so the engine can leave out the work.
+func (s *Simulation) observer(start int, stop func()) func(report) {
+	observed := s.observed()
+	s.mutex.Lock()
+	detecting := s.cycles != nil && s.cycles.Period == 0
+	heating := s.heat != nil
+	s.mutex.Unlock()
+	if !observed && !detecting && !heating {
+		return nil
+	}
+	return func(r report) {
+		turn := start + r.turn
+		if observed {
+			s.publish(TurnComplete{Turn: turn, Population: r.population})
+			s.publish(CellsFlipped{Turn: turn, Cells: r.flipped})
+			if s.statistics != nil {
+				if stats, due := s.statistics.record(s.p, turn, r); due {
+					s.publish(stats)
+				}
+			}
+		}
+		if heating {
+			s.mutex.Lock()
+			s.heat.record(turn, r.flipped)
+			s.mutex.Unlock()
+		}
+		if detecting {
+			s.mutex.Lock()
+			found := s.cycles.Record(turn, r.hash, r.population)
+			c := *s.cycles
+			s.mutex.Unlock()
+			if found {
+				detecting = false
+				s.publish(Stabilised{Turn: turn, Start: c.Start, Period: c.Period})
+				if c.skip {
+					stop()
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,356 @@
+package gol
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"uk.ac.bris.cs/gameoflife/protocol"
+)
+
+// Side of the square chunks a plane is stored in
+const chunkSize = 64
+
+// Position of a chunk, in chunks from the one holding cell 0,0
+type chunkKey struct {
+	x, y int
+}
+
+// Cells of a chunk, row by row, which are 0xFF when alive
+type chunk [chunkSize][chunkSize]byte
+
+// Runs on a Plane, which has no edges. Only the chunks with alive cells are stored, in a map which grows and shrinks
+// as patterns spread and die, so spaceships carry on forever instead of wrapping into themselves.
+// Each turn computes the chunks with alive cells and the ones next to their alive edges, shared out between workers.
+type planeEngine struct {
+	p      params
+	chunks map[chunkKey]*chunk
+	alive  int
+}
+
+// Returns a divided by b, rounded down instead of towards zero
+func floorDiv(a, b int) int {
+	if a < 0 {
+		return -((b - 1 - a) / b)
+	}
+	return a / b
+}
+
+// Returns the chunk holding a cell, and the position of the cell within it
+func chunkOf(c Cell) (chunkKey, int, int) {
+	k := chunkKey{floorDiv(c.X, chunkSize), floorDiv(c.Y, chunkSize)}
+	return k, c.X - k.x*chunkSize, c.Y - k.y*chunkSize
+}
+
+// Sets the given cells alive, adding the chunks they are in
+func (e *planeEngine) set(cells []Cell) {
+	for _, c := range cells {
+		k, x, y := chunkOf(c)
+		ch := e.chunks[k]
+		if ch == nil {
+			ch = new(chunk)
+			e.chunks[k] = ch
+		}
+		if ch[y][x] == 0 {
+			ch[y][x] = 0xFF
+			e.alive++
+		}
+	}
+}
+
+// Sets the alive cells of a macrocell pattern. Each node the size of a chunk is built once however often it repeats,
+// and copied to every chunk it is in, so the cells of the pattern are never listed.
+func (e *planeEngine) setMacrocell(m *Macrocell) error {
+	root := len(m.nodes) - 1
+	if m.nodes[root].chunks > maxMacrocellChunks {
+		return fmt.Errorf("the pattern covers more than %d chunks of %dx%d cells", maxMacrocellChunks, chunkSize, chunkSize)
+	}
+	if m.nodes[root].level <= chunkLevel {
+		// A root no larger than a chunk is not lined up with the chunks, so its few cells are set one by one
+		cells, err := m.Cells()
+		if err != nil {
+			return err
+		}
+		e.set(cells)
+		return nil
+	}
+	half := 1 << uint(m.nodes[root].level-1)
+	e.setNode(m.nodes, root, -half, -half, make(map[int]*chunk))
+	return nil
+}
+
+// Sets the alive cells of a node with its top left cell at x,y, which is lined up with the chunks.
+// built holds the chunk of each node the size of one which has been built so far.
+func (e *planeEngine) setNode(nodes []macrocellNode, id, x, y int, built map[int]*chunk) {
+	n := nodes[id]
+	if n.level > chunkLevel {
+		half := 1 << uint(n.level-1)
+		for i, child := range n.children {
+			if child != 0 {
+				e.setNode(nodes, child, x+i%2*half, y+i/2*half, built)
+			}
+		}
+		return
+	}
+	if n.population == 0 {
+		// Only chunks with alive cells are stored
+		return
+	}
+
+	ch, ok := built[id]
+	if !ok {
+		var cells []Cell
+		expandNode(nodes, id, 0, 0, &cells)
+		ch = new(chunk)
+		for _, c := range cells {
+			ch[c.Y][c.X] = 0xFF
+		}
+		built[id] = ch
+	}
+	k := chunkKey{floorDiv(x, chunkSize), floorDiv(y, chunkSize)}
+	existing := e.chunks[k]
+	if existing == nil {
+		copied := *ch
+		e.chunks[k] = &copied
+		e.alive += n.population
+		return
+	}
+	// Cells set before the pattern are kept
+	for cy := range ch {
+		for cx, c := range ch[cy] {
+			if c != 0 && existing[cy][cx] == 0 {
+				existing[cy][cx] = 0xFF
+				e.alive++
+			}
+		}
+	}
+}
+
+// Loads a world with its top left cell at 0,0
+func (e *planeEngine) load(world [][]byte) {
+	e.chunks = make(map[chunkKey]*chunk)
+	e.alive = 0
+	var cells []Cell
+	for y, row := range world {
+		for x, c := range row {
+			if c == 0xFF {
+				cells = append(cells, Cell{X: x, Y: y})
+			}
+		}
+	}
+	e.set(cells)
+}
+
+// Returns the chunks which can have alive cells in the next turn: those with alive cells, and those next to an edge
+// or corner which has some
+func (e *planeEngine) candidates() []chunkKey {
+	marked := make(map[chunkKey]bool, len(e.chunks))
+	var keys []chunkKey
+	add := func(k chunkKey) {
+		if !marked[k] {
+			marked[k] = true
+			keys = append(keys, k)
+		}
+	}
+	last := chunkSize - 1
+	for k, ch := range e.chunks {
+		add(k)
+		for i := 0; i < chunkSize; i++ {
+			if ch[0][i] != 0 {
+				add(chunkKey{k.x, k.y - 1})
+			}
+			if ch[last][i] != 0 {
+				add(chunkKey{k.x, k.y + 1})
+			}
+			if ch[i][0] != 0 {
+				add(chunkKey{k.x - 1, k.y})
+			}
+			if ch[i][last] != 0 {
+				add(chunkKey{k.x + 1, k.y})
+			}
+		}
+		if ch[0][0] != 0 {
+			add(chunkKey{k.x - 1, k.y - 1})
+		}
+		if ch[0][last] != 0 {
+			add(chunkKey{k.x + 1, k.y - 1})
+		}
+		if ch[last][0] != 0 {
+			add(chunkKey{k.x - 1, k.y + 1})
+		}
+		if ch[last][last] != 0 {
+			add(chunkKey{k.x + 1, k.y + 1})
+		}
+	}
+	return keys
+}
+
+// Returns the range of a neighbouring chunk's rows or columns which border a chunk, at offset d of -1, 0 or 1,
+// and where they start in the chunk surrounded by a one cell border
+func borderSpan(d int) (int, int, int) {
+	switch d {
+	case -1:
+		return chunkSize - 1, chunkSize, 0
+	case 1:
+		return 0, 1, chunkSize + 1
+	}
+	return 0, chunkSize, 1
+}
+
+// Computes a chunk for the next turn. Returns nil if none of its cells are alive, and otherwise the chunk
+// and a report of its number of alive cells and, if observed is set, the cells which flipped, its bounds and its hash.
+func (e *planeEngine) compute(k chunkKey, observed bool) (*chunk, report) {
+	var padded [chunkSize + 2][chunkSize + 2]byte
+	for dy := -1; dy <= 1; dy++ {
+		for dx := -1; dx <= 1; dx++ {
+			ch := e.chunks[chunkKey{k.x + dx, k.y + dy}]
+			if ch == nil {
+				continue
+			}
+			startY, endY, toY := borderSpan(dy)
+			startX, endX, toX := borderSpan(dx)
+			for y := startY; y < endY; y++ {
+				copy(padded[toY+y-startY][toX:], ch[y][startX:endX])
+			}
+		}
+	}
+
+	next := new(chunk)
+	var r report
+	for y := 1; y <= chunkSize; y++ {
+		above, row, below := &padded[y-1], &padded[y], &padded[y+1]
+		for x := 1; x <= chunkSize; x++ {
+			aliveNeighbours := int(above[x-1]) + int(above[x]) + int(above[x+1]) +
+				int(row[x-1]) + int(row[x+1]) +
+				int(below[x-1]) + int(below[x]) + int(below[x+1])
+			state := row[x]
+			switch getNewState(e.p.rule, aliveNeighbours/255, state == 0xFF) {
+			case -1:
+				state = 0x00
+			case 1:
+				state = 0xFF
+			}
+			next[y-1][x-1] = state
+			if observed {
+				r.add(Cell{X: k.x*chunkSize + x - 1, Y: k.y*chunkSize + y - 1}, row[x] == 0xFF, state == 0xFF)
+			} else if state == 0xFF {
+				r.population++
+			}
+		}
+	}
+	if r.population == 0 {
+		next = nil
+	}
+	return next, r
+}
+
+// Computes the next turn, and reports it. Only the population is set unless observed is set.
+func (e *planeEngine) step(observed bool) report {
+	keys := e.candidates()
+	chunks := make([]*chunk, len(keys))
+	reports := make([]report, len(keys))
+	workers := e.p.threads
+
+	var finished sync.WaitGroup
+	finished.Add(workers)
+	for w := 0; w < workers; w++ {
+		go func(w int) {
+			for i := w * len(keys) / workers; i < (w+1)*len(keys)/workers; i++ {
+				chunks[i], reports[i] = e.compute(keys[i], observed)
+			}
+			finished.Done()
+		}(w)
+	}
+	finished.Wait()
+
+	e.chunks = make(map[chunkKey]*chunk, len(e.chunks))
+	var combined report
+	for i, k := range keys {
+		if chunks[i] != nil {
+			e.chunks[k] = chunks[i]
+		}
+		combined.combine(reports[i])
+	}
+	e.alive = combined.population
+	return combined
+}
+
+func (e *planeEngine) advance(ctx context.Context, n int, observe func(report)) (int, error) {
+	for turn := 1; turn <= n; turn++ {
+		r := e.step(observe != nil)
+		if observe != nil {
+			r.turn = turn
+			observe(r)
+		}
+
+		if ctx.Err() != nil && turn < n {
+			return turn, ctx.Err()
+		}
+	}
+	return n, nil
+}
+
+// Calls visit with every alive cell, chunk by chunk
+func (e *planeEngine) each(visit func(Cell)) {
+	for k, ch := range e.chunks {
+		for y := range ch {
+			for x, c := range ch[y] {
+				if c == 0xFF {
+					visit(Cell{X: k.x*chunkSize + x, Y: k.y*chunkSize + y})
+				}
+			}
+		}
+	}
+}
+
+// Returns a report of the number of alive cells, their bounds and their hash, read from the chunks. Cells spread far
+// apart are measured without making a world as big as their bounds.
+func (e *planeEngine) survey() report {
+	var r report
+	e.each(func(c Cell) {
+		r.population++
+		r.bounds.add(c)
+		r.hash ^= protocol.CellHash(c.X, c.Y)
+	})
+	return r
+}
+
+// Returns the smallest world holding every alive cell, and the position of its top left cell.
+// With no alive cells, it is a single dead cell at 0,0.
+// The world is as big as the bounds of the cells, so it is only made for Snapshot and Frame, which return it.
+func (e *planeEngine) crop() (Cell, [][]byte) {
+	if e.alive == 0 {
+		return Cell{}, makeMatrix(1, 1)
+	}
+	bounds := e.survey().bounds
+	min := bounds.Min
+	world := makeMatrix(bounds.Width(), bounds.Height())
+	e.each(func(c Cell) {
+		world[c.Y-min.Y][c.X-min.X] = 0xFF
+	})
+	return min, world
+}
+
+// Returns the alive cells row by row
+func (e *planeEngine) cells() []Cell {
+	cells := make([]Cell, 0, e.alive)
+	e.each(func(c Cell) {
+		cells = append(cells, c)
+	})
+	sort.Slice(cells, func(i, j int) bool {
+		if cells[i].Y != cells[j].Y {
+			return cells[i].Y < cells[j].Y
+		}
+		return cells[i].X < cells[j].X
+	})
+	return cells
+}
+
+func (e *planeEngine) snapshot() [][]byte {
+	_, world := e.crop()
+	return world
+}
+
+func (e *planeEngine) population() int {
+	return e.alive
+}
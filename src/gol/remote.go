@@ -0,0 +1,527 @@
+package gol
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/gob"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+	"uk.ac.bris.cs/gameoflife/protocol"
+)
+
+// Cluster is a set of stage5 clients connected over TCP, which the Remote engine runs its workers on.
+// Clients run several jobs at once, so a cluster can be shared by simulations running at the same time.
+type Cluster struct {
+	clients []*client
+}
+
+// Connection to a client
+type client struct {
+	conn    net.Conn
+	encoder *gob.Encoder
+	ip      string
+	jobs    *router // Jobs running on the client
+}
+
+// Accept waits for the given number of clients to connect to ln, and agrees with each one on the protocol.
+// Clients have to present token to join. Clients from a different build or without the token are turned away,
+// and another client is waited for instead. ln may be a TLS listener.
+func Accept(ln net.Listener, clients int, token string) (*Cluster, error) {
+	authorise := func(h protocol.Hello) error {
+		if !protocol.ValidToken(h.Token, token) {
+			return errors.New("wrong token")
+		}
+		return nil
+	}
+
+	c := &Cluster{}
+	for len(c.clients) < clients {
+		conn, err := ln.Accept()
+		if err != nil {
+			c.Close()
+			return nil, err
+		}
+
+		cl := &client{conn: conn, encoder: gob.NewEncoder(conn), jobs: &router{jobs: make(map[int]route)}}
+		cl.ip, _, _ = net.SplitHostPort(conn.RemoteAddr().String())
+		decoder := gob.NewDecoder(conn)
+
+		// Worlds are sent uncompressed, so no capabilities are offered
+		_, _, err = protocol.AcceptHello(cl.encoder, decoder, nil, authorise)
+		if err != nil {
+			_ = conn.Close()
+			continue
+		}
+		go routeMessages(decoder, cl.jobs)
+		c.clients = append(c.clients, cl)
+	}
+	return c, nil
+}
+
+// Close disconnects every client, which stops the jobs running on them
+func (c *Cluster) Close() error {
+	var first error
+	for _, cl := range c.clients {
+		err := cl.conn.Close()
+		if err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
+
+// Returns why the cluster cannot run a simulation with the given settings, or nil
+func (c *Cluster) check(p params) error {
+	if c == nil || len(c.clients) == 0 {
+		return errors.New("the remote engine needs a cluster with at least one client")
+	}
+	if p.topology != Torus {
+		return errors.New("the remote engine only supports a torus")
+	}
+	p = c.spread(p)
+	rows, cols := tileGrid(p)
+	if rows > p.imageHeight || cols > p.imageWidth {
+		return fmt.Errorf("a %dx%d world cannot be split between %d clients", p.imageWidth, p.imageHeight, len(c.clients))
+	}
+	return nil
+}
+
+// Returns the settings with at least one worker for every client
+func (c *Cluster) spread(p params) params {
+	if p.threads < len(c.clients) {
+		p.threads = len(c.clients)
+	}
+	return p
+}
+
+// Passes the messages from a client to the job they belong to, so several jobs can share a client
+type router struct {
+	mutex sync.Mutex
+	jobs  map[int]route
+	err   error // Why the connection was lost, nil while it is open
+}
+
+// Where the messages of one job go. Each job has its own queue, so a job which stalls does not hold up the others.
+type route struct {
+	queue chan<- protocol.Message
+	stop  chan struct{} // Closed when the job is removed, dropping the messages it has not read
+}
+
+// Used to give every job a different id
+var lastJob int32
+
+// Reads the messages from a client and passes them to their jobs, until the client disconnects.
+// The jobs still running are then sent a message without a kind, holding the error.
+func routeMessages(decoder *gob.Decoder, r *router) {
+	for {
+		var m protocol.Message
+		err := decoder.Decode(&m)
+		if err != nil {
+			r.mutex.Lock()
+			r.err = err
+			for job, route := range r.jobs {
+				route.queue <- protocol.Message{Job: job, Error: err.Error()}
+			}
+			r.mutex.Unlock()
+			return
+		}
+
+		// The queue is only stopped once the job is removed, so it takes the message straight away
+		r.mutex.Lock()
+		if route, running := r.jobs[m.Job]; running {
+			route.queue <- m
+		}
+		r.mutex.Unlock()
+	}
+}
+
+// Passes the messages of a job from a client to c, or returns an error if the client has disconnected
+func addJob(r *router, job int, c chan protocol.Message) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if r.err != nil {
+		return fmt.Errorf("connection to client lost: %v", r.err)
+	}
+	stop := make(chan struct{})
+	r.jobs[job] = route{protocol.Queue(c, stop), stop}
+	return nil
+}
+
+func removeJob(r *router, job int) {
+	r.mutex.Lock()
+	if route, running := r.jobs[job]; running {
+		close(route.stop)
+		delete(r.jobs, job)
+	}
+	r.mutex.Unlock()
+}
+
+// Returns a random secret
+func randomToken() (string, error) {
+	b := make([]byte, 16)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// Runs each call to advance as a job on the clients of a cluster, keeping the world between them
+type remoteEngine struct {
+	p       params
+	cluster *Cluster
+	world   [][]byte
+}
+
+func (e *remoteEngine) load(world [][]byte) {
+	e.world = copyWorld(world)
+}
+
+// When observed, the workers report their tiles after every turn, which are combined as those of local workers are
+func (e *remoteEngine) advance(ctx context.Context, n int, observe func(report)) (int, error) {
+	return e.runJob(ctx, n, observe)
+}
+
+func (e *remoteEngine) snapshot() [][]byte {
+	return copyWorld(e.world)
+}
+
+func (e *remoteEngine) population() int {
+	return population(e.world)
+}
+
+// A job running on the clients, with the messages they send about it
+type remoteJob struct {
+	id       int
+	clients  []*client
+	in       chan protocol.Message
+	tiles    []tile
+	turns    int
+	world    [][]byte
+	finished []bool        // Workers which have sent done
+	reports  chan<- report // Reports of the workers after every turn, nil when not observed
+}
+
+// Sends a message of the job to a client
+func (j *remoteJob) send(c *client, m protocol.Message) error {
+	m.Job = j.id
+	return c.encoder.Encode(m)
+}
+
+// Sends a command to every worker of the job which has not finished
+func (j *remoteJob) command(owners []int, data int) error {
+	for w, owner := range owners {
+		if j.finished[w] {
+			continue
+		}
+		err := j.send(j.clients[owner], protocol.Message{Kind: protocol.CommandMessage, Worker: w, Data: data})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Keeps the world sent by a worker, passes on its reports and notes the workers which have finished
+func (j *remoteJob) handle(m protocol.Message) error {
+	switch m.Kind {
+	case 0:
+		return fmt.Errorf("connection to client lost: %s", m.Error)
+	case protocol.ReportMessage:
+		if j.reports == nil || m.Report == nil || m.Report.Turn < 1 || m.Report.Turn > j.turns {
+			return fmt.Errorf("worker %d sent a report which was not asked for", m.Worker)
+		}
+		j.reports <- tileReport(*m.Report)
+	case protocol.WorldMessage:
+		t := j.tiles[m.Worker]
+		for x := range m.World {
+			copy(j.world[t.startX+x][t.startY:t.endY], m.World[x])
+		}
+	case protocol.DoneMessage:
+		j.finished[m.Worker] = true
+	}
+	return nil
+}
+
+// Returns the report of a worker's tile in the form the local workers send
+func tileReport(t protocol.TurnReport) report {
+	r := report{turn: t.Turn, population: t.Population, births: t.Births, deaths: t.Deaths, hash: t.Hash}
+	if t.Population > 0 {
+		r.bounds.add(Cell(t.Min))
+		r.bounds.add(Cell(t.Max))
+	}
+	for _, c := range t.Flipped {
+		r.flipped = append(r.flipped, Cell(c))
+	}
+	return r
+}
+
+// Waits for the next message of the job, and handles it
+func (j *remoteJob) receive() (protocol.Message, error) {
+	m := <-j.in
+	return m, j.handle(m)
+}
+
+// Returns true if every worker has finished
+func (j *remoteJob) done() bool {
+	for _, f := range j.finished {
+		if !f {
+			return false
+		}
+	}
+	return true
+}
+
+// Runs n turns as a job on the clients of the cluster, which then send back the world.
+// Once ctx is cancelled the workers are stopped at the end of a turn. observe is nil or called after every turn.
+func (e *remoteEngine) runJob(ctx context.Context, n int, observe func(report)) (int, error) {
+	p := e.cluster.spread(e.p)
+	clients := e.cluster.clients
+	rows, cols := tileGrid(p)
+	tiles := makeTiles(p, rows, cols)
+	p.haloDepth = haloDepth(p, tiles)
+
+	// Workers are given to clients in order, the first clients get the smaller share
+	small := len(clients) - p.threads%len(clients)
+	owners := make([]int, 0, p.threads)
+	ips := make([]string, len(clients))
+	peers := make([]map[int]string, len(clients))
+	for i := range clients {
+		workers := p.threads / len(clients)
+		if i >= small {
+			workers++
+		}
+		for w := 0; w < workers; w++ {
+			owners = append(owners, i)
+		}
+		ips[i] = clients[i].ip
+		peers[i] = make(map[int]string)
+	}
+
+	packages := make([]protocol.WorkerPackage, p.threads)
+	for i, t := range tiles {
+		// Copy of the tile, with its surrounding halos
+		tileWorld := makeMatrix(t.endY-t.startY+2*p.haloDepth, t.endX-t.startX+2*p.haloDepth)
+		for x := range tileWorld {
+			for y := range tileWorld[x] {
+				tileWorld[x][y] = e.world[positiveModulo(t.startX+x-p.haloDepth, p.imageHeight)][positiveModulo(t.startY+y-p.haloDepth, p.imageWidth)]
+			}
+		}
+		packages[i] = protocol.WorkerPackage{StartX: t.startX, EndX: t.endX, StartY: t.startY, EndY: t.endY, World: tileWorld, Index: i}
+
+		for direction, offset := range offsets {
+			neighbour := positiveModulo(i/cols+offset[0], rows)*cols + positiveModulo(i%cols+offset[1], cols)
+			packages[i].Neighbours[direction] = neighbour
+
+			// Each pair of clients exchanging halos shares a secret, so other halo connections are refused
+			a, b := owners[i], owners[neighbour]
+			if a != b && peers[a][b] == "" {
+				token, err := randomToken()
+				if err != nil {
+					return 0, err
+				}
+				peers[a][b] = token
+				peers[b][a] = token
+			}
+		}
+	}
+
+	j := &remoteJob{
+		id:       int(atomic.AddInt32(&lastJob, 1)),
+		clients:  clients,
+		in:       make(chan protocol.Message, 2*p.threads+2*len(clients)),
+		tiles:    tiles,
+		turns:    n,
+		world:    e.world,
+		finished: make([]bool, p.threads),
+	}
+	reports := protocol.NoReports
+	if observe != nil {
+		reports = protocol.FlipReports
+		r := make(chan report, p.threads)
+		combined := make(chan struct{})
+		go combineReports(r, p.threads, observe, combined)
+		j.reports = r
+		// Every report has been handled once the job is over
+		defer func() {
+			close(r)
+			<-combined
+		}()
+	}
+	for _, c := range clients {
+		err := addJob(c.jobs, j.id, j.in)
+		if err != nil {
+			return 0, err
+		}
+		defer removeJob(c.jobs, j.id)
+	}
+
+	// Start the job on every client, then give each client its workers
+	for i, c := range clients {
+		initP := protocol.InitPackage{Clients: len(clients), Index: i, Ips: ips, Owners: owners, Turns: n, Depth: p.haloDepth, Peers: peers[i],
+			Rule: p.rule, Reports: reports}
+		for _, owner := range owners {
+			if owner == i {
+				initP.Workers++
+			}
+		}
+		err := j.send(c, protocol.Message{Kind: protocol.InitMessage, Init: &initP})
+		if err != nil {
+			return 0, err
+		}
+		for w := range packages {
+			if owners[w] == i {
+				err = j.send(c, protocol.Message{Kind: protocol.AssignMessage, Worker: w, Assign: &packages[w]})
+				if err != nil {
+					return 0, err
+				}
+			}
+		}
+	}
+
+	// Wait until every client listens for halo connections, then let them connect to each other.
+	// Clients which are busy refuse the job, which is then shut down everywhere.
+	var refusal error
+	running := 0
+	for range clients {
+		m, err := j.receive()
+		if err != nil {
+			return 0, err
+		}
+		if m.Kind == protocol.RejectMessage {
+			refusal = fmt.Errorf("a client refused the job: %s", m.Error)
+		} else {
+			running++
+		}
+	}
+	turn := 0
+	var err error
+	if refusal == nil {
+		for _, c := range clients {
+			err = j.send(c, protocol.Message{Kind: protocol.ReadyMessage})
+			if err != nil {
+				return 0, err
+			}
+		}
+		turn, err = j.control(ctx, owners, n)
+	}
+
+	// Free the job on every client which accepted it
+	for _, c := range clients {
+		shutdownErr := j.send(c, protocol.Message{Kind: protocol.ShutdownMessage})
+		if shutdownErr != nil {
+			return turn, shutdownErr
+		}
+	}
+	for running > 0 {
+		m, receiveErr := j.receive()
+		if receiveErr != nil {
+			return turn, receiveErr
+		}
+		if m.Kind == protocol.ShutdownMessage {
+			running--
+		}
+	}
+	if refusal != nil {
+		return 0, refusal
+	}
+	return turn, err
+}
+
+// Waits until the workers of a job have sent their worlds after the last turn, or stops them once ctx is cancelled.
+// Returns the turn the workers stopped at.
+func (j *remoteJob) control(ctx context.Context, owners []int, turns int) (int, error) {
+	for !j.done() {
+		select {
+		case m := <-j.in:
+			err := j.handle(m)
+			if err == nil && m.Kind == protocol.RejectMessage {
+				err = fmt.Errorf("a client failed the job: %s", m.Error)
+			}
+			if err != nil {
+				return 0, err
+			}
+		case <-ctx.Done():
+			return j.stop(ctx, owners, turns)
+		}
+	}
+	return turns, nil
+}
+
+// Stops the workers of a job at the end of a turn, and gets their worlds.
+// The workers of stage5 clients leave the job after the last turn, so only the ones still running are sent commands.
+func (j *remoteJob) stop(ctx context.Context, owners []int, turns int) (int, error) {
+	// Pause and get current turns. Workers which reach the last turn in between finish instead.
+	err := j.command(owners, pause)
+	if err != nil {
+		return 0, err
+	}
+	answered := append([]bool(nil), j.finished...)
+	stopAtTurn := 0
+	for w := range owners {
+		for !answered[w] && !j.finished[w] {
+			m, err := j.receive()
+			if err != nil {
+				return 0, err
+			}
+			if m.Kind == protocol.StatusMessage {
+				answered[m.Worker] = true
+				if m.Data > stopAtTurn {
+					stopAtTurn = m.Data
+				}
+			}
+		}
+	}
+
+	// Once a worker has finished the others have to as well, so they carry on to the last turn
+	for _, finished := range j.finished {
+		if finished {
+			stopAtTurn = turns
+		}
+	}
+
+	// Tell all workers to stop after turn stopAtTurn. Workers reaching the last turn first finish instead.
+	err = j.command(owners, stopAtTurn)
+	if err != nil {
+		return 0, err
+	}
+	paused := make([]bool, len(owners))
+	for w := range owners {
+		for !paused[w] && !j.finished[w] {
+			m, err := j.receive()
+			if err != nil {
+				return 0, err
+			}
+			if m.Kind == protocol.StatusMessage {
+				paused[m.Worker] = true
+			}
+		}
+	}
+	if j.done() {
+		return turns, nil
+	}
+
+	// Receive the world and quit
+	err = j.command(owners, save)
+	if err != nil {
+		return 0, err
+	}
+	for saved := 0; saved < len(owners); {
+		m, err := j.receive()
+		if err != nil {
+			return 0, err
+		}
+		if m.Kind == protocol.WorldMessage {
+			saved++
+		}
+	}
+	err = j.command(owners, quit)
+	if err != nil {
+		return 0, err
+	}
+	return stopAtTurn + 1, ctx.Err()
+}
@@ -0,0 +1,16 @@
+package gol
+
+import "uk.ac.bris.cs/gameoflife/protocol"
+
+// Rule is a life-like rule, saying for which numbers of alive neighbours a dead cell is born and an alive cell survives.
+// It is the rule of the protocol, so it is sent to the clients of the Remote engine as it is.
+type Rule = protocol.Rule
+
+// Conway is the rule of Conway's Game of Life, B3/S23
+var Conway = protocol.Conway
+
+// ParseRule parses a rule in B/S notation, such as B3/S23 for Conway's Game of Life or B36/S23 for HighLife.
+// The S/B notation without letters, such as 23/3, is also accepted.
+func ParseRule(s string) (Rule, error) {
+	return protocol.ParseRule(s)
+}
@@ -0,0 +1,229 @@
+package gol
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Search runs many random soups on a plane until they stabilise, like apgsearch, and keeps the soups which last
+// longest or leave objects rarely seen
+type Search struct {
+	Soups    int  // Number of soups to run
+	Soup     Soup // First soup, which has to have a size. Each soup after it has the next seed.
+	Rule     Rule
+	Threads  int // Soups run at once, one per worker
+	MaxTurns int // Turns after which a soup which is still changing is given up on
+	Keep     int // Soups kept in each list of the hall of fame
+}
+
+// Find is a soup kept by a search
+type Find struct {
+	Soup     Soup    `json:"soup"`
+	Lifespan int     `json:"lifespan"`       // Turns before it stabilised, MaxTurns if it never did
+	Rare     []Tally `json:"rare,omitempty"` // Objects it left which are not common
+	Census   Census  `json:"census"`
+}
+
+// HallOfFame is what a search found
+type HallOfFame struct {
+	Soups    int    `json:"soups"`    // Soups run
+	Longest  []Find `json:"longest"`  // Longest lived soups, the longest first
+	Rare     []Find `json:"rare"`     // Soups which left rare objects, by seed
+	Census   Census `json:"census"`   // Objects left by every soup
+	Unstable int    `json:"unstable"` // Soups which had not stabilised after MaxTurns
+}
+
+// Objects which most soups leave, so are not worth keeping soups for
+var commonObjects = map[string]bool{
+	"block": true, "blinker": true, "beehive": true, "loaf": true, "boat": true, "ship": true, "tub": true,
+	"pond": true, "long boat": true, "barge": true, "toad": true, "beacon": true, "glider": true,
+}
+
+// Largest period of the population a soup is checked for once it stabilises
+const searchPeriod = 30
+
+// Run runs the soups, and returns what they found. Once ctx is cancelled it returns what the soups so far found
+// with ctx.Err().
+func (s Search) Run(ctx context.Context) (*HallOfFame, error) {
+	if s.Soup.Size < 1 {
+		return nil, fmt.Errorf("the soups of a search have to have a size")
+	}
+	if s.Rule.Born[0] {
+		return nil, fmt.Errorf("%v would fill the whole plane in one turn", s.Rule)
+	}
+	if s.Threads < 1 || s.Soups < 0 || s.MaxTurns < 1 {
+		return nil, fmt.Errorf("a search needs soups, threads and turns")
+	}
+	// Checked once, so workers cannot fail
+	_, err := s.Soup.Cells(s.Soup.Size, s.Soup.Size)
+	if err != nil {
+		return nil, err
+	}
+
+	seeds := make(chan int64)
+	finds := make(chan Find)
+	var workers sync.WaitGroup
+	workers.Add(s.Threads)
+	for w := 0; w < s.Threads; w++ {
+		go func() {
+			for seed := range seeds {
+				soup := s.Soup
+				soup.Seed = seed
+				finds <- s.run(ctx, soup)
+			}
+			workers.Done()
+		}()
+	}
+	go func() {
+		defer close(seeds)
+		for i := 0; i < s.Soups; i++ {
+			select {
+			case seeds <- s.Soup.Seed + int64(i):
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	go func() {
+		workers.Wait()
+		close(finds)
+	}()
+
+	h := &HallOfFame{}
+	totals := make(map[string]*Tally)
+	for f := range finds {
+		if ctx.Err() != nil {
+			// A soup cut short did not stabilise
+			continue
+		}
+		h.Soups++
+		if f.Lifespan >= s.MaxTurns {
+			h.Unstable++
+		}
+		for _, t := range f.Census {
+			total, ok := totals[t.Name]
+			if !ok {
+				total = &Tally{Object: t.Object}
+				totals[t.Name] = total
+			}
+			total.Count += t.Count
+			if !commonObjects[t.Name] && t.Kind != Unstable {
+				f.Rare = append(f.Rare, t)
+			}
+		}
+		if len(f.Rare) > 0 {
+			h.Rare = keepFind(h.Rare, f, s.Keep, func(a, b Find) bool {
+				return a.Soup.Seed < b.Soup.Seed
+			})
+		}
+		h.Longest = keepFind(h.Longest, f, s.Keep, func(a, b Find) bool {
+			return a.Lifespan > b.Lifespan || a.Lifespan == b.Lifespan && a.Soup.Seed < b.Soup.Seed
+		})
+	}
+
+	for _, t := range totals {
+		h.Census = append(h.Census, *t)
+	}
+	sort.Slice(h.Census, func(i, j int) bool {
+		if h.Census[i].Count != h.Census[j].Count {
+			return h.Census[i].Count > h.Census[j].Count
+		}
+		return h.Census[i].Name < h.Census[j].Name
+	})
+	return h, ctx.Err()
+}
+
+// Adds a find to a list sorted by before, keeping only the first keep finds.
+// Finds come from the workers in any order, so this keeps the same ones whichever finishes first.
+func keepFind(finds []Find, f Find, keep int, before func(a, b Find) bool) []Find {
+	i := sort.Search(len(finds), func(i int) bool {
+		return before(f, finds[i])
+	})
+	if i >= keep {
+		return finds
+	}
+	finds = append(finds, Find{})
+	copy(finds[i+1:], finds[i:])
+	finds[i] = f
+	if len(finds) > keep {
+		finds = finds[:keep]
+	}
+	return finds
+}
+
+// Runs a soup until its population has gone round the same cycle for a while, and takes a census of what it left.
+// The population is used rather than the world, as the world never repeats once spaceships fly off.
+func (s Search) run(ctx context.Context, soup Soup) Find {
+	cells, _ := soup.Cells(soup.Size, soup.Size)
+	e := &planeEngine{p: params{threads: 1, rule: s.Rule, topology: Plane}, chunks: make(map[chunkKey]*chunk)}
+	e.set(cells)
+
+	f := Find{Soup: soup, Lifespan: s.MaxTurns}
+	populations := []int{e.population()}
+	for turn := 1; turn <= s.MaxTurns && ctx.Err() == nil; turn++ {
+		e.step(false)
+		populations = append(populations, e.population())
+		if e.population() == 0 {
+			f.Lifespan = turn
+			break
+		}
+		if period := populationPeriod(populations); period > 0 {
+			// The population was already repeating for the turns it was checked over
+			f.Lifespan = turn - populationWindow(period)
+			break
+		}
+	}
+
+	origin, world := e.crop()
+	f.Census = TakeCensus(Snapshot{World: world, Origin: origin}, s.Rule, Plane)
+	return f
+}
+
+// Turns the population has to repeat with a period for, before it is taken to have stabilised
+func populationWindow(period int) int {
+	if 4*period > 2*searchPeriod {
+		return 4 * period
+	}
+	return 2 * searchPeriod
+}
+
+// Returns the smallest period the latest populations have repeated with, or 0 if they have not
+func populationPeriod(populations []int) int {
+	last := len(populations) - 1
+	for period := 1; period <= searchPeriod; period++ {
+		window := populationWindow(period)
+		if last < window+period {
+			return 0
+		}
+		repeats := true
+		for i := last - window + 1; i <= last && repeats; i++ {
+			repeats = populations[i] == populations[i-period]
+		}
+		if repeats {
+			return period
+		}
+	}
+	return 0
+}
+
+// String reports the hall of fame as text
+func (h *HallOfFame) String() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "Searched %d soups, %d of which had not stabilised\n", h.Soups, h.Unstable)
+	b.WriteString("\nLongest lived:\n")
+	for _, f := range h.Longest {
+		fmt.Fprintf(&b, "  %d turns: %v\n", f.Lifespan, f.Soup)
+	}
+	b.WriteString("\nRare objects:\n")
+	for _, f := range h.Rare {
+		fmt.Fprintf(&b, "  %v: %v\n", Census(f.Rare), f.Soup)
+	}
+	b.WriteString("\nCensus:\n")
+	for _, t := range h.Census {
+		fmt.Fprintf(&b, "  %s (%v): %d\n", t.Name, t.Kind, t.Count)
+	}
+	return b.String()
+}
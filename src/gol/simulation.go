@@ -0,0 +1,575 @@
+// Package gol simulates life-like cellular automata, splitting the world between workers which exchange halos.
+package gol
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+)
+
+// Topology says what lies beyond the edges of the world
+type Topology int
+
+const (
+	// Torus wraps the edges around, so cells on opposite edges are neighbours
+	Torus Topology = iota
+	// Bounded surrounds the world with cells which are always dead
+	Bounded
+	// Plane has no edges, so the world grows as patterns spread and cells can have negative positions.
+	// It only runs on the Sparse engine.
+	Plane
+)
+
+// Cell is the position of a cell, in column x and row y
+type Cell struct {
+	X, Y int
+}
+
+// Snapshot is the world at the end of a turn, as rows of cells which are 0xFF when alive.
+// On a Plane, World is cropped to the alive cells.
+type Snapshot struct {
+	Turn   int
+	World  [][]byte
+	Origin Cell // Position of the top left cell of World, which is only moved from 0,0 on a Plane
+}
+
+// Pattern is the alive cells at the end of a turn, row by row, listed without drawing the world they are in
+type Pattern struct {
+	Turn  int
+	Cells []Cell
+}
+
+// ErrRunning is returned when a simulation is stepped or run while it is already running
+var ErrRunning = errors.New("the simulation is already running")
+
+// Runs with no limit on the number of turns
+const forever = int(^uint(0) >> 1)
+
+// Settings given by options
+type config struct {
+	params
+	cells      []Cell
+	macrocell  *Macrocell
+	limit      int
+	engine     Engine
+	cluster    *Cluster
+	cycles     *cycles
+	statistics *statistics
+	heatmap    bool
+	frames     int
+}
+
+// Option sets up a simulation
+type Option func(*config)
+
+// WithSize sets the width and height of the world. It has to be set, except on a Plane, which has no size.
+func WithSize(width, height int) Option {
+	return func(c *config) {
+		c.imageWidth = width
+		c.imageHeight = height
+	}
+}
+
+// WithRule sets the rule, Conway's Game of Life by default
+func WithRule(r Rule) Option {
+	return func(c *config) {
+		c.rule = r
+	}
+}
+
+// WithTopology sets what lies beyond the edges of the world, a torus by default
+func WithTopology(t Topology) Option {
+	return func(c *config) {
+		c.topology = t
+	}
+}
+
+// WithThreads sets the number of workers the world is split between, 1 by default
+func WithThreads(threads int) Option {
+	return func(c *config) {
+		c.threads = threads
+	}
+}
+
+// WithTiles splits the world into 2D tiles instead of horizontal strips
+func WithTiles(tiled bool) Option {
+	return func(c *config) {
+		c.tiled = tiled
+	}
+}
+
+// WithHaloDepth sets the number of halo rows workers exchange at once, every depth turns
+func WithHaloDepth(depth int) Option {
+	return func(c *config) {
+		c.haloDepth = depth
+	}
+}
+
+// WithCells sets the cells which are alive at the start
+func WithCells(cells []Cell) Option {
+	return func(c *config) {
+		c.cells = cells
+	}
+}
+
+// WithMacrocell sets the cells of a macrocell pattern alive at the start, as well as any set with WithCells.
+// On a Plane the pattern is loaded chunk by chunk without listing its cells, so it can be far larger.
+func WithMacrocell(m *Macrocell) Option {
+	return func(c *config) {
+		c.macrocell = m
+	}
+}
+
+// WithTurns sets the turn Run stops at. Without it, Run carries on until cancelled.
+func WithTurns(turns int) Option {
+	return func(c *config) {
+		c.limit = turns
+	}
+}
+
+// WithEngine sets the engine computing the turns, Halo by default
+func WithEngine(e Engine) Option {
+	return func(c *config) {
+		c.engine = e
+	}
+}
+
+// WithFrames stops the workers after every turn which is a multiple of every, to send a Frame with their world
+func WithFrames(every int) Option {
+	return func(c *config) {
+		c.frames = every
+	}
+}
+
+// WithCluster sets the clients the Remote engine runs its workers on
+func WithCluster(cluster *Cluster) Option {
+	return func(c *config) {
+		c.cluster = cluster
+	}
+}
+
+// Simulation is a world and the turns it has run.
+// Its methods may be called from any goroutine, so a simulation can be paused or inspected while it runs.
+type Simulation struct {
+	p      params
+	limit  int
+	frames int     // Turns between Frame events, 0 without WithFrames
+	engine backend // Holds the world, used by the run while there is one
+
+	mutex  sync.Mutex
+	turn   int
+	paused bool
+	run    *run    // The current run, nil when the simulation is idle
+	cycles *cycles // Hashes of the worlds so far, nil without WithCycleDetection
+	heat   *heat   // Activity of the cells so far, nil without WithHeatmap
+
+	statistics *statistics // Births and deaths since the last Statistics, nil without WithStatistics
+
+	observers     sync.Mutex
+	subscriptions map[*subscription]bool
+}
+
+// A call to Step or Run, which stops the engine at the end of a turn to serve each request of the other methods
+type run struct {
+	requests chan request
+	done     chan struct{}
+}
+
+// Request for a run, using the worker commands pause, resume, ping, save, list and survey
+type request struct {
+	command int
+	quiet   bool // Whether to leave out the event of the command
+	reply   chan reply
+}
+
+type reply struct {
+	turn   int
+	alive  int
+	world  [][]byte
+	origin Cell
+	cells  []Cell // Alive cells row by row, for list
+	bounds Bounds // Bounds of the alive cells, for survey
+}
+
+// New creates a simulation from its options
+func New(options ...Option) (*Simulation, error) {
+	c := config{params: params{threads: 1, haloDepth: 1, rule: Conway}, limit: forever}
+	for _, option := range options {
+		option(&c)
+	}
+
+	p := c.params
+	if p.topology != Torus && p.topology != Bounded && p.topology != Plane {
+		return nil, fmt.Errorf("unknown topology %d", p.topology)
+	}
+	if _, ok := engineNames[c.engine]; !ok {
+		return nil, fmt.Errorf("unknown engine %d", c.engine)
+	}
+	if c.frames < 0 {
+		return nil, fmt.Errorf("frames cannot be sent every %d turns", c.frames)
+	}
+	if c.statistics != nil && c.statistics.every < 1 {
+		return nil, fmt.Errorf("statistics cannot be sent every %d turns", c.statistics.every)
+	}
+	if p.topology == Plane {
+		return newPlane(c)
+	}
+	if c.macrocell != nil {
+		cells, err := c.macrocell.Cells()
+		if err != nil {
+			return nil, err
+		}
+		c.cells = append(cells, c.cells...)
+	}
+	if p.imageWidth < 1 || p.imageHeight < 1 {
+		return nil, fmt.Errorf("the world has to be at least 1x1, not %dx%d", p.imageWidth, p.imageHeight)
+	}
+	rows, cols := 0, 0
+	if p.threads > 0 {
+		rows, cols = tileGrid(p)
+	}
+	if p.threads < 1 || rows > p.imageHeight || cols > p.imageWidth {
+		return nil, fmt.Errorf("a %dx%d world cannot be split between %d threads", p.imageWidth, p.imageHeight, p.threads)
+	}
+	if c.engine == Remote {
+		err := c.cluster.check(p)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	world := makeMatrix(p.imageWidth, p.imageHeight)
+	for _, cell := range c.cells {
+		if cell.X < 0 || cell.X >= p.imageWidth || cell.Y < 0 || cell.Y >= p.imageHeight {
+			return nil, fmt.Errorf("cell %d,%d is outside the %dx%d world", cell.X, cell.Y, p.imageWidth, p.imageHeight)
+		}
+		world[cell.Y][cell.X] = 0xFF
+	}
+
+	engine := newBackend(c)
+	engine.load(world)
+	s := &Simulation{p: p, limit: c.limit, frames: c.frames, engine: engine, statistics: c.statistics}
+	s.startCycles(c.cycles)
+	if c.heatmap {
+		s.startHeat()
+	}
+	return s, nil
+}
+
+// Creates a simulation on a Plane, where the cells can be anywhere
+func newPlane(c config) (*Simulation, error) {
+	if c.engine != Sparse {
+		return nil, fmt.Errorf("a plane only runs on the sparse engine, not %v", c.engine)
+	}
+	if c.rule.Born[0] {
+		return nil, fmt.Errorf("%v would fill the whole plane in one turn", c.rule)
+	}
+	if c.threads < 1 {
+		return nil, fmt.Errorf("a plane cannot be split between %d threads", c.threads)
+	}
+
+	engine := &planeEngine{p: c.params, chunks: make(map[chunkKey]*chunk)}
+	engine.set(c.cells)
+	if c.macrocell != nil {
+		err := engine.setMacrocell(c.macrocell)
+		if err != nil {
+			return nil, err
+		}
+	}
+	s := &Simulation{p: c.params, limit: c.limit, frames: c.frames, engine: engine, statistics: c.statistics}
+	s.startCycles(c.cycles)
+	if c.heatmap {
+		s.startHeat()
+	}
+	return s, nil
+}
+
+// Records the world the simulation starts from, to look for cycles in if c is not nil
+func (s *Simulation) startCycles(c *cycles) {
+	if c == nil {
+		return
+	}
+	if plane, ok := s.engine.(*planeEngine); ok {
+		r := plane.survey()
+		c.Record(0, r.hash, r.population)
+	} else {
+		world := s.engine.snapshot()
+		c.Record(0, hashWorld(Cell{}, world), population(world))
+	}
+	s.cycles = c
+}
+
+// Step runs n turns, and returns once they are done. While paused, it waits to be resumed.
+func (s *Simulation) Step(n int) error {
+	if n < 0 {
+		return fmt.Errorf("cannot step %d turns", n)
+	}
+	return s.advance(context.Background(), n)
+}
+
+// Run runs turns until the turn set by WithTurns, or until ctx is cancelled, in which case it returns ctx.Err().
+func (s *Simulation) Run(ctx context.Context) error {
+	s.mutex.Lock()
+	turns := s.limit - s.turn
+	s.mutex.Unlock()
+	if turns <= 0 {
+		return nil
+	}
+	return s.advance(ctx, turns)
+}
+
+// Runs the engine for the given number of turns, serving requests until they are done
+func (s *Simulation) advance(ctx context.Context, turns int) error {
+	s.mutex.Lock()
+	if s.run != nil {
+		s.mutex.Unlock()
+		return ErrRunning
+	}
+	r := &run{requests: make(chan request), done: make(chan struct{})}
+	s.run = r
+	last := s.turn + turns
+	s.mutex.Unlock()
+
+	err := s.control(ctx, r, last)
+
+	s.mutex.Lock()
+	s.run = nil
+	finished := Finished{Turn: s.turn, Population: s.engine.population(), Err: err}
+	s.mutex.Unlock()
+	close(r.done)
+	s.publish(finished)
+	return err
+}
+
+// Result of a call to advance of the engine
+type advanced struct {
+	turns int
+	err   error
+}
+
+// Runs the engine until the turn last, or until ctx is cancelled.
+// Each request stops the engine at the end of a turn, and it starts again once the request is served unless paused.
+func (s *Simulation) control(ctx context.Context, r *run, last int) error {
+	for {
+		s.mutex.Lock()
+		turn, paused := s.turn, s.paused
+		s.mutex.Unlock()
+		if turn >= last {
+			return nil
+		}
+
+		if paused {
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case req := <-r.requests:
+				s.answer(req)
+			}
+			continue
+		}
+
+		s.mutex.Lock()
+		skipped := s.skipCycles(last)
+		s.mutex.Unlock()
+		if skipped {
+			continue
+		}
+
+		// The engine stops at the next frame, which is gathered once it has
+		stopAt := last
+		if s.frames > 0 && (turn/s.frames+1)*s.frames < last {
+			stopAt = (turn/s.frames + 1) * s.frames
+		}
+
+		engineCtx, stop := context.WithCancel(ctx)
+		observe := s.observer(turn, stop)
+		result := make(chan advanced, 1)
+		go func() {
+			n, err := s.engine.advance(engineCtx, stopAt-turn, observe)
+			result <- advanced{n, err}
+		}()
+
+		var req *request
+		var a advanced
+		select {
+		case a = <-result:
+		case rq := <-r.requests:
+			req = &rq
+			stop()
+			a = <-result
+		case <-ctx.Done():
+			a = <-result
+		}
+		stop()
+
+		s.mutex.Lock()
+		s.turn += a.turns
+		var frame *Frame
+		if s.frames > 0 && a.turns > 0 && s.turn%s.frames == 0 {
+			rep := s.serve(save, true)
+			frame = &Frame{Turn: rep.turn, World: rep.world, Origin: rep.origin}
+		}
+		s.mutex.Unlock()
+		if frame != nil {
+			s.publish(*frame)
+		}
+		if req != nil {
+			s.answer(*req)
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if a.err != nil && a.err != engineCtx.Err() {
+			return a.err
+		}
+	}
+}
+
+// Serves a request while the engine is stopped, and replies to it
+func (s *Simulation) answer(req request) {
+	s.mutex.Lock()
+	rep := s.serve(req.command, req.quiet)
+	s.mutex.Unlock()
+	req.reply <- rep
+}
+
+// Sends a request to the current run, or serves it directly when the simulation is idle
+func (s *Simulation) request(command int, quiet bool) reply {
+	for {
+		s.mutex.Lock()
+		r := s.run
+		if r == nil {
+			rep := s.serve(command, quiet)
+			s.mutex.Unlock()
+			return rep
+		}
+		s.mutex.Unlock()
+
+		req := request{command: command, quiet: quiet, reply: make(chan reply, 1)}
+		select {
+		case r.requests <- req:
+			return <-req.reply
+		case <-r.done:
+			// The run finished first, so try again
+		}
+	}
+}
+
+// Serves a request while the engine is stopped. The mutex must be held.
+func (s *Simulation) serve(command int, quiet bool) reply {
+	rep := reply{turn: s.turn}
+	switch command {
+	case pause:
+		if !s.paused {
+			s.publish(Paused{Turn: s.turn})
+		}
+		s.paused = true
+	case resume:
+		if s.paused {
+			s.publish(Resumed{Turn: s.turn})
+		}
+		s.paused = false
+	case ping:
+		rep.alive = s.engine.population()
+	case save:
+		if plane, ok := s.engine.(*planeEngine); ok {
+			rep.origin, rep.world = plane.crop()
+		} else {
+			rep.world = s.engine.snapshot()
+		}
+		if !quiet {
+			s.publish(Saved{Turn: s.turn})
+		}
+	case survey:
+		if plane, ok := s.engine.(*planeEngine); ok {
+			r := plane.survey()
+			rep.alive, rep.bounds = r.population, r.bounds
+		} else {
+			for y, row := range s.engine.snapshot() {
+				for x, c := range row {
+					if c == 0xFF {
+						rep.alive++
+						rep.bounds.add(Cell{X: x, Y: y})
+					}
+				}
+			}
+		}
+	case list:
+		if plane, ok := s.engine.(*planeEngine); ok {
+			rep.cells = plane.cells()
+		} else {
+			for y, row := range s.engine.snapshot() {
+				for x, c := range row {
+					if c != 0 {
+						rep.cells = append(rep.cells, Cell{X: x, Y: y})
+					}
+				}
+			}
+		}
+		if !quiet {
+			s.publish(Saved{Turn: s.turn})
+		}
+	}
+	return rep
+}
+
+// Pause stops the workers at the end of a turn, and returns once they have. Step and Run wait until Resume.
+func (s *Simulation) Pause() {
+	s.request(pause, false)
+}
+
+// Resume lets the workers carry on after Pause
+func (s *Simulation) Resume() {
+	s.request(resume, false)
+}
+
+// Turn returns the number of turns run so far
+func (s *Simulation) Turn() int {
+	return s.request(ping, false).turn
+}
+
+// Population returns the number of alive cells
+func (s *Simulation) Population() int {
+	return s.request(ping, false).alive
+}
+
+// Snapshot returns a copy of the world at the end of the current turn
+func (s *Simulation) Snapshot() Snapshot {
+	rep := s.request(save, false)
+	return Snapshot{Turn: rep.turn, World: rep.world, Origin: rep.origin}
+}
+
+// Pattern returns the alive cells at the end of the current turn, saving them like Snapshot.
+// A Plane lists them from its chunks, so a pattern spread too far apart to crop into a world can still be saved.
+func (s *Simulation) Pattern() Pattern {
+	rep := s.request(list, false)
+	return Pattern{Turn: rep.turn, Cells: rep.cells}
+}
+
+// AliveCells returns the alive cells at the end of the current turn, row by row
+func (s *Simulation) AliveCells() []Cell {
+	return s.request(list, true).cells
+}
+
+// Returns the number of alive cells in a world
+func population(world [][]byte) int {
+	alive := 0
+	for _, row := range world {
+		for _, c := range row {
+			if c == 0xFF {
+				alive++
+			}
+		}
+	}
+	return alive
+}
+
+// Makes a copy of a world, so it can be handed out while the workers carry on
+func copyWorld(world [][]byte) [][]byte {
+	c := makeMatrix(len(world[0]), len(world))
+	for i := range world {
+		copy(c[i], world[i])
+	}
+	return c
+}
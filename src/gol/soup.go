@@ -0,0 +1,135 @@
+package gol
+
+import (
+	"fmt"
+	"math/rand"
+	"strings"
+)
+
+// Symmetry of a soup
+type Symmetry int
+
+const (
+	// C1 has no symmetry
+	C1 Symmetry = iota
+	// C2 looks the same when turned half way round
+	C2
+	// C4 looks the same when turned a quarter of the way round
+	C4
+	// D8 looks the same when turned a quarter of the way round or reflected in a line through its centre
+	D8
+)
+
+var symmetryNames = map[Symmetry]string{
+	C1: "C1",
+	C2: "C2",
+	C4: "C4",
+	D8: "D8",
+}
+
+// ParseSymmetry returns the symmetry with the given name, such as C1 or D8
+func ParseSymmetry(name string) (Symmetry, error) {
+	for s, n := range symmetryNames {
+		if strings.EqualFold(name, n) {
+			return s, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown symmetry %q", name)
+}
+
+// String returns the name of the symmetry
+func (s Symmetry) String() string {
+	if name, ok := symmetryNames[s]; ok {
+		return name
+	}
+	return fmt.Sprintf("symmetry %d", int(s))
+}
+
+// MarshalText lets a symmetry be written by name, such as in JSON
+func (s Symmetry) MarshalText() ([]byte, error) {
+	return []byte(s.String()), nil
+}
+
+// UnmarshalText reads a symmetry written by MarshalText
+func (s *Symmetry) UnmarshalText(text []byte) error {
+	symmetry, err := ParseSymmetry(string(text))
+	if err != nil {
+		return err
+	}
+	*s = symmetry
+	return nil
+}
+
+// Soup is a random world, which is always the same for the same seed
+type Soup struct {
+	Density  float64 // Chance of each cell being alive
+	Seed     int64
+	Symmetry Symmetry
+	Size     int // Side of the square of random cells in the centre of an otherwise dead world, or 0 to fill it
+}
+
+// String describes the soup, with everything needed to make it again
+func (s Soup) String() string {
+	size := "filling the world"
+	if s.Size > 0 {
+		size = fmt.Sprintf("%dx%d", s.Size, s.Size)
+	}
+	return fmt.Sprintf("%v soup %s of density %g with seed %d", s.Symmetry, size, s.Density, s.Seed)
+}
+
+// Cells returns the alive cells of the soup in a world of the given size
+func (s Soup) Cells(width, height int) ([]Cell, error) {
+	if s.Density < 0 || s.Density > 1 {
+		return nil, fmt.Errorf("the density of a soup has to be between 0 and 1, not %g", s.Density)
+	}
+	if _, ok := symmetryNames[s.Symmetry]; !ok {
+		return nil, fmt.Errorf("unknown symmetry %d", s.Symmetry)
+	}
+	w, h := width, height
+	if s.Size != 0 {
+		w, h = s.Size, s.Size
+	}
+	if w < 1 || h < 1 || w > width || h > height {
+		return nil, fmt.Errorf("a %dx%d soup does not fit in a %dx%d world", w, h, width, height)
+	}
+	if (s.Symmetry == C4 || s.Symmetry == D8) && w != h {
+		return nil, fmt.Errorf("a %v soup has to be square, not %dx%d", s.Symmetry, w, h)
+	}
+
+	// Each cell is drawn in turn, and the cells it is turned or reflected onto are given the same state
+	random := rand.New(rand.NewSource(s.Seed))
+	drawn := makeMatrix(w, h)
+	left, top := (width-w)/2, (height-h)/2
+	var cells []Cell
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			if drawn[y][x] != 0 {
+				continue
+			}
+			alive := random.Float64() < s.Density
+			for _, c := range s.orbit(Cell{X: x, Y: y}, w, h) {
+				if drawn[c.Y][c.X] == 0 {
+					drawn[c.Y][c.X] = 1
+					if alive {
+						cells = append(cells, Cell{X: left + c.X, Y: top + c.Y})
+					}
+				}
+			}
+		}
+	}
+	return cells, nil
+}
+
+// Returns the cells of a w x h soup which a cell is turned or reflected onto by the symmetry, including itself
+func (s Soup) orbit(c Cell, w, h int) []Cell {
+	x, y, right, bottom := c.X, c.Y, w-1-c.X, h-1-c.Y
+	switch s.Symmetry {
+	case C2:
+		return []Cell{{x, y}, {right, bottom}}
+	case C4:
+		return []Cell{{x, y}, {bottom, x}, {right, bottom}, {y, right}}
+	case D8:
+		return []Cell{{x, y}, {bottom, x}, {right, bottom}, {y, right}, {right, y}, {x, bottom}, {y, x}, {bottom, right}}
+	}
+	return []Cell{c}
+}
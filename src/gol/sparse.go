@@ -0,0 +1,203 @@
+package gol
+
+import (
+	"bytes"
+	"context"
+	"sync"
+	"uk.ac.bris.cs/gameoflife/protocol"
+)
+
+// Side of the square blocks the sparse engine tracks changes in.
+// Smaller blocks skip more of a world which is mostly dead, but cost more to track in one which is busy.
+const blockSize = 16
+
+// Splits the world into blocks, and each turn only computes the blocks which changed in the last turn or border one
+// which did, as the cells of every other block see the same neighbours as before.
+// The blocks to compute are shared out between the workers, which wait for each other at a barrier like Shared.
+type sparseEngine struct {
+	p           params
+	blocks      []tile
+	neighbours  [][]int  // Blocks around each block, including itself
+	active      []int    // Blocks computed in the next turn
+	bounds      []Bounds // Alive cells of each block, kept up to date while observed
+	world, next [][]byte
+}
+
+func (e *sparseEngine) load(world [][]byte) {
+	rows := (e.p.imageHeight + blockSize - 1) / blockSize
+	cols := (e.p.imageWidth + blockSize - 1) / blockSize
+	e.blocks = make([]tile, 0, rows*cols)
+	for r := 0; r < rows; r++ {
+		for c := 0; c < cols; c++ {
+			endX, endY := (r+1)*blockSize, (c+1)*blockSize
+			if endX > e.p.imageHeight {
+				endX = e.p.imageHeight
+			}
+			if endY > e.p.imageWidth {
+				endY = e.p.imageWidth
+			}
+			e.blocks = append(e.blocks, tile{r * blockSize, endX, c * blockSize, endY})
+		}
+	}
+
+	e.neighbours = make([][]int, len(e.blocks))
+	for b := range e.blocks {
+		around := map[int]bool{b: true}
+		e.neighbours[b] = []int{b}
+		for _, offset := range offsets {
+			r, c := b/cols+offset[0], b%cols+offset[1]
+			if e.p.topology == Bounded && (r < 0 || r >= rows || c < 0 || c >= cols) {
+				continue
+			}
+			neighbour := positiveModulo(r, rows)*cols + positiveModulo(c, cols)
+			if !around[neighbour] {
+				around[neighbour] = true
+				e.neighbours[b] = append(e.neighbours[b], neighbour)
+			}
+		}
+	}
+
+	// Every block is computed in the first turn, as nothing is known about the last one
+	e.active = make([]int, len(e.blocks))
+	for b := range e.active {
+		e.active[b] = b
+	}
+	e.world = copyWorld(world)
+	e.next = makeMatrix(e.p.imageWidth, e.p.imageHeight)
+}
+
+// Returns true if any cell of a tile differs between world and next
+func tileChanged(world, next [][]byte, t tile) bool {
+	for i := t.startX; i < t.endX; i++ {
+		if !bytes.Equal(world[i][t.startY:t.endY], next[i][t.startY:t.endY]) {
+			return true
+		}
+	}
+	return false
+}
+
+func (e *sparseEngine) advance(ctx context.Context, n int, observe func(report)) (int, error) {
+	// The workers only decide to stop at the end of a turn, so none are started for no turns
+	if n <= 0 {
+		return 0, nil
+	}
+	workers := e.p.threads
+	changed := make([][]int, workers)
+	flips := make([][]Cell, workers)
+	var r report
+	if observe != nil {
+		r.population = e.population()
+		r.hash = hashWorld(Cell{}, e.world)
+		e.bounds = make([]Bounds, len(e.blocks))
+		for b, t := range e.blocks {
+			e.bounds[b] = compareTile(e.world, e.world, t).bounds
+		}
+	}
+
+	// Run by the last worker to finish each turn, choosing the blocks of the next turn and whether the workers stop
+	turn := 0
+	stop := false
+	marked := make([]bool, len(e.blocks))
+	endOfTurn := func() {
+		turn++
+		var active []int
+		for _, blocks := range changed {
+			for _, b := range blocks {
+				for _, neighbour := range e.neighbours[b] {
+					if !marked[neighbour] {
+						marked[neighbour] = true
+						active = append(active, neighbour)
+					}
+				}
+			}
+		}
+		for _, b := range active {
+			marked[b] = false
+		}
+		e.active = active
+
+		if observe != nil {
+			r.turn = turn
+			r.flipped = nil
+			r.births, r.deaths = 0, 0
+			for _, f := range flips {
+				r.flipped = append(r.flipped, f...)
+			}
+			for _, c := range r.flipped {
+				// The flipped cells of this turn are the ones which changed from the world the workers read
+				if e.cell(turn, c) == 0xFF {
+					r.population++
+					r.births++
+				} else {
+					r.population--
+					r.deaths++
+				}
+				r.hash ^= protocol.CellHash(c.X, c.Y)
+			}
+			r.bounds = Bounds{}
+			for _, b := range e.bounds {
+				r.bounds.union(b)
+			}
+			observe(r)
+		}
+		stop = turn == n || ctx.Err() != nil
+	}
+
+	b := newBarrier(workers)
+	var finished sync.WaitGroup
+	finished.Add(workers)
+	for w := 0; w < workers; w++ {
+		go func(w int) {
+			world, next := e.world, e.next
+			for {
+				// Each worker computes its share of the blocks
+				active := e.active
+				changed[w] = changed[w][:0]
+				flips[w] = nil
+				for _, block := range active[w*len(active)/workers : (w+1)*len(active)/workers] {
+					t := e.blocks[block]
+					computeTile(e.p, world, next, t)
+					if tileChanged(world, next, t) {
+						changed[w] = append(changed[w], block)
+						if observe != nil {
+							rep := compareTile(world, next, t)
+							flips[w] = append(flips[w], rep.flipped...)
+							e.bounds[block] = rep.bounds
+						}
+					}
+				}
+				b.wait(endOfTurn)
+				world, next = next, world
+				if stop {
+					break
+				}
+			}
+			finished.Done()
+		}(w)
+	}
+	finished.Wait()
+
+	if turn%2 == 1 {
+		e.world, e.next = e.next, e.world
+	}
+	if turn < n {
+		return turn, ctx.Err()
+	}
+	return n, nil
+}
+
+// Returns a cell of the world computed in the given turn of the current call to advance, before the worlds are swapped
+func (e *sparseEngine) cell(turn int, c Cell) byte {
+	if turn%2 == 1 {
+		return e.next[c.Y][c.X]
+	}
+	return e.world[c.Y][c.X]
+}
+
+func (e *sparseEngine) snapshot() [][]byte {
+	return copyWorld(e.world)
+}
+
+func (e *sparseEngine) population() int {
+	return population(e.world)
+}
@@ -0,0 +1,103 @@
+package gol
+
+// Bounds is the smallest rectangle holding a set of cells, from its top left cell Min to its bottom right cell Max.
+// The zero value holds no cells.
+type Bounds struct {
+	Min, Max Cell
+	set      bool
+}
+
+// Empty returns true if the bounds hold no cells
+func (b Bounds) Empty() bool {
+	return !b.set
+}
+
+// Width returns the number of columns of the bounds
+func (b Bounds) Width() int {
+	if !b.set {
+		return 0
+	}
+	return b.Max.X - b.Min.X + 1
+}
+
+// Height returns the number of rows of the bounds
+func (b Bounds) Height() int {
+	if !b.set {
+		return 0
+	}
+	return b.Max.Y - b.Min.Y + 1
+}
+
+// Grows the bounds to hold a cell
+func (b *Bounds) add(c Cell) {
+	if !b.set {
+		*b = Bounds{Min: c, Max: c, set: true}
+		return
+	}
+	if c.X < b.Min.X {
+		b.Min.X = c.X
+	}
+	if c.Y < b.Min.Y {
+		b.Min.Y = c.Y
+	}
+	if c.X > b.Max.X {
+		b.Max.X = c.X
+	}
+	if c.Y > b.Max.Y {
+		b.Max.Y = c.Y
+	}
+}
+
+// Grows the bounds to hold every cell of o
+func (b *Bounds) union(o Bounds) {
+	if o.set {
+		b.add(o.Min)
+		b.add(o.Max)
+	}
+}
+
+// WithStatistics sends Statistics to the observers after every turn which is a multiple of every
+func WithStatistics(every int) Option {
+	return func(c *config) {
+		c.statistics = &statistics{every: every}
+	}
+}
+
+// Births and deaths of the turns since the last Statistics event
+type statistics struct {
+	every          int
+	births, deaths int
+}
+
+// Adds up the births and deaths of a turn. Returns the Statistics of the turn if they are due, and true.
+func (st *statistics) record(p params, turn int, r report) (Statistics, bool) {
+	st.births += r.births
+	st.deaths += r.deaths
+	if turn%st.every != 0 {
+		return Statistics{}, false
+	}
+	stats := measure(p, turn, r.population, r.bounds)
+	stats.Births, stats.Deaths = st.births, st.deaths
+	st.births, st.deaths = 0, 0
+	return stats, true
+}
+
+// Returns the statistics of a world with the given alive cells, leaving out the births and deaths
+func measure(p params, turn, population int, bounds Bounds) Statistics {
+	area := p.imageWidth * p.imageHeight
+	if p.topology == Plane {
+		area = bounds.Width() * bounds.Height()
+	}
+	stats := Statistics{Turn: turn, Population: population, Bounds: bounds}
+	if area > 0 {
+		stats.Density = float64(population) / float64(area)
+	}
+	return stats
+}
+
+// Statistics returns the statistics of the world at the end of the current turn.
+// Births and Deaths are 0, as they are counted by the workers while the turns run.
+func (s *Simulation) Statistics() Statistics {
+	rep := s.request(survey, true)
+	return measure(s.p, rep.turn, rep.alive, rep.bounds)
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"os"
+	"path/filepath"
+	"strconv"
+	"uk.ac.bris.cs/gameoflife/gol"
+)
+
+// Colours of the png heatmap from the least to the most active cells, with the colours in between blended
+var heatStops = []color.RGBA{
+	{0, 0, 0, 255},
+	{80, 0, 140, 255},
+	{220, 30, 30, 255},
+	{250, 160, 0, 255},
+	{255, 255, 255, 255},
+}
+
+// Returns a palette of 256 colours running through heatStops
+func heatPalette() color.Palette {
+	palette := make(color.Palette, 256)
+	segments := len(heatStops) - 1
+	for i := range palette {
+		position := float64(i) * float64(segments) / 255
+		s := int(position)
+		if s == segments {
+			s--
+		}
+		f := position - float64(s)
+		from, to := heatStops[s], heatStops[s+1]
+		blend := func(a, b uint8) uint8 {
+			return uint8(float64(a) + f*(float64(b)-float64(a)) + 0.5)
+		}
+		palette[i] = color.RGBA{blend(from.R, to.R), blend(from.G, to.G), blend(from.B, to.B), 255}
+	}
+	return palette
+}
+
+// Returns an error unless counter is a count heatmaps can show, or empty for none
+func checkHeatmap(counter string) error {
+	if counter != "" && counter != "alive" && counter != "changed" {
+		return fmt.Errorf("unknown heatmap %q, expected alive or changed", counter)
+	}
+	return nil
+}
+
+// Writes the heatmap of sim so far, if p asks for one, and prints where
+func reportHeatmap(p golParams, sim *gol.Simulation) error {
+	if p.heatmap == "" {
+		return nil
+	}
+	h := sim.Heatmap()
+	paths, err := writeHeatmap(p, h)
+	if err != nil {
+		return err
+	}
+	fmt.Println("Heatmap of turn", h.Turns, "written to", paths[0], "and", paths[1])
+	return nil
+}
+
+// Writes the counts of a heatmap chosen by p.heatmap as a grey pgm and a colour png, next to the images.
+// The most active cells are white, and cells which were never alive are black. Returns the paths of the files.
+func writeHeatmap(p golParams, h *gol.Heatmap) ([]string, error) {
+	counts := h.Changed
+	if p.heatmap == "alive" {
+		counts = h.Alive
+	}
+	height, width := len(counts), len(counts[0])
+	most := 0
+	for _, row := range counts {
+		for _, n := range row {
+			if n > most {
+				most = n
+			}
+		}
+	}
+	levels := make([]byte, width*height)
+	if most > 0 {
+		for y, row := range counts {
+			for x, n := range row {
+				levels[y*width+x] = byte(n * 255 / most)
+			}
+		}
+	}
+
+	dir := "out"
+	if p.outputDir != "" {
+		dir = p.outputDir
+	}
+	err := os.MkdirAll(dir, os.ModePerm)
+	if err != nil {
+		return nil, err
+	}
+	name := filepath.Join(dir, strconv.Itoa(width)+"x"+strconv.Itoa(height)+"_heatmap_"+strconv.Itoa(h.Turns))
+	paths := []string{name + ".pgm", name + ".png"}
+	err = writePgmPixels(paths[0], width, height, levels)
+	if err != nil {
+		return nil, err
+	}
+
+	img := image.NewPaletted(image.Rect(0, 0, width, height), heatPalette())
+	copy(img.Pix, levels)
+	file, err := os.Create(paths[1])
+	if err != nil {
+		return nil, err
+	}
+	err = png.Encode(file, img)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	return paths, err
+}
@@ -1,6 +1,17 @@
 package main
 
-import "flag"
+import (
+	"context"
+	"flag"
+	"fmt"
+	"image"
+	"net"
+	"path/filepath"
+	"strings"
+	"time"
+	"uk.ac.bris.cs/gameoflife/batch"
+	"uk.ac.bris.cs/gameoflife/gol"
+)
 
 // golParams provides the details of how to run the Game of Life and which image to load.
 type golParams struct {
@@ -8,6 +19,26 @@ type golParams struct {
 	threads     int
 	imageWidth  int
 	imageHeight int
+	tiled       bool
+	haloDepth   int
+	rule        *gol.Rule // Conway's B3/S23 when nil
+	topology    gol.Topology
+	engine      gol.Engine
+	cluster     *gol.Cluster    // Clients of the remote engine
+	cycles      bool            // Whether to look for the world repeating itself
+	skipCycles  bool            // Whether to skip to the last turn once it does
+	census      bool            // Whether to take a census of the objects in the final world
+	stats       string          // Format the statistics of every turn are written in, csv or jsonl, or none when empty
+	statsEvery  int             // Turns between rows of the statistics, every turn when 0
+	heatmap     string          // Count shown by the heatmaps written on saving and at the end, alive or changed, or none when empty
+	record      string          // Format the frames of the run are recorded in, gif or png, or none when empty
+	recordEvery int             // Turns between frames, every turn when 0
+	crop        image.Rectangle // Cells recorded in each frame, the whole world when empty
+	scale       int             // Pixels per cell in each frame, 1 when 0
+	soup        *gol.Soup       // Random world to start from instead of an image
+	input       string          // Image to start from, images/[width]x[height].pgm when empty
+	format      string          // Format images are written in, and read in when their extension is unknown, pgm when empty
+	outputDir   string          // Directory images are written to, out when empty
 }
 
 // ioCommand allows requesting behaviour from the io (pgm) goroutine.
@@ -24,6 +55,12 @@ const (
 	ioCheckIdle
 )
 
+// ioImage is a world sent to the io goroutine to be written, as a whole so the distributor is free once it is sent.
+type ioImage struct {
+	filename string
+	world    [][]byte // Rows of cells, cropped on a plane, which the io goroutine owns once sent
+}
+
 // cell is used as the return type for the testing framework.
 type cell struct {
 	x, y int
@@ -33,22 +70,24 @@ type cell struct {
 // Note the restrictions on chans being send-only or receive-only to prevent bugs.
 type distributorToIo struct {
 	command chan<- ioCommand
-	idle    <-chan bool
+	idle    <-chan error // The first error writing an image since the last check, or nil
 
 	filename chan<- string
-	inputVal <-chan uint8
-	world    chan<- byte
+	inputErr <-chan error  // Why the image cannot be read, or nil before its data
+	input    <-chan []byte // Rows of the image read, from the top
+	output   chan<- ioImage
 }
 
 // ioToDistributor defines all chans that the io goroutine will have to communicate with the distributor goroutine.
 // Note the restrictions on chans being send-only or receive-only to prevent bugs.
 type ioToDistributor struct {
 	command <-chan ioCommand
-	idle    chan<- bool
+	idle    chan<- error
 
 	filename <-chan string
-	inputVal chan<- uint8
-	world    <-chan byte
+	inputErr chan<- error
+	input    chan<- []byte
+	output   <-chan ioImage
 }
 
 // distributorChans stores all the chans that the distributor goroutine will use.
@@ -62,10 +101,14 @@ type ioChans struct {
 }
 
 // gameOfLife is the function called by the testing framework.
-// It makes some channels and starts relevant goroutines.
+// It makes some channels and starts the io goroutine, then runs a simulation of the image it reads.
 // It places the created channels in the relevant structs.
-// It returns an array of alive cells returned by the distributor.
-func gameOfLife(p golParams, keyChan <-chan rune) []cell {
+// It returns an array of alive cells at the end of the simulation.
+// When ctx is cancelled, every goroutine it started stops, and it returns the cells alive at that turn with ctx.Err().
+func gameOfLife(ctx context.Context, p golParams, keyChan <-chan rune) ([]cell, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
 	var dChans distributorChans
 	var ioChans ioChans
 
@@ -73,7 +116,7 @@ func gameOfLife(p golParams, keyChan <-chan rune) []cell {
 	dChans.io.command = ioCommand
 	ioChans.distributor.command = ioCommand
 
-	ioIdle := make(chan bool)
+	ioIdle := make(chan error)
 	dChans.io.idle = ioIdle
 	ioChans.distributor.idle = ioIdle
 
@@ -81,27 +124,137 @@ func gameOfLife(p golParams, keyChan <-chan rune) []cell {
 	dChans.io.filename = ioFilename
 	ioChans.distributor.filename = ioFilename
 
-	inputVal := make(chan uint8)
-	dChans.io.inputVal = inputVal
-	ioChans.distributor.inputVal = inputVal
+	inputErr := make(chan error)
+	dChans.io.inputErr = inputErr
+	ioChans.distributor.inputErr = inputErr
+
+	input := make(chan []byte)
+	dChans.io.input = input
+	ioChans.distributor.input = input
+
+	output := make(chan ioImage)
+	dChans.io.output = output
+	ioChans.distributor.output = output
 
-	worldChan := make(chan byte)
-	dChans.io.world = worldChan
-	ioChans.distributor.world = worldChan
+	go pgmIo(ctx, p, ioChans)
 
-	aliveCells := make(chan []cell)
+	var cells []gol.Cell
+	var macrocell *gol.Macrocell
+	var err error
+	if p.soup != nil {
+		fmt.Println("Starting from a", p.soup)
+		cells, err = p.soup.Cells(p.imageWidth, p.imageHeight)
+	} else if p.topology == gol.Plane && strings.ToLower(filepath.Ext(p.input)) == ".mc" {
+		// A plane has room for the whole of a macrocell pattern, so it is loaded where it is, however large
+		macrocell, err = readMacrocellFile(p.input)
+	} else {
+		cells, err = readWorld(ctx, p, dChans)
+	}
+	if err != nil {
+		return nil, err
+	}
+	options := []gol.Option{
+		gol.WithSize(p.imageWidth, p.imageHeight),
+		gol.WithThreads(p.threads),
+		gol.WithTiles(p.tiled),
+		gol.WithHaloDepth(p.haloDepth),
+		gol.WithTopology(p.topology),
+		gol.WithCells(cells),
+		gol.WithTurns(p.turns),
+		gol.WithEngine(p.engine),
+		gol.WithCluster(p.cluster),
+	}
+	if macrocell != nil {
+		options = append(options, gol.WithMacrocell(macrocell))
+	}
+	if p.rule != nil {
+		options = append(options, gol.WithRule(*p.rule))
+	}
+	if p.cycles || p.skipCycles {
+		options = append(options, gol.WithCycleDetection(p.skipCycles))
+	}
+	if p.stats != "" {
+		every := p.statsEvery
+		if every == 0 {
+			every = 1
+		}
+		options = append(options, gol.WithStatistics(every))
+	}
+	if p.heatmap != "" {
+		options = append(options, gol.WithHeatmap())
+	}
+	if p.record != "" {
+		every := p.recordEvery
+		if every == 0 {
+			every = 1
+		}
+		options = append(options, gol.WithFrames(every))
+	}
+	sim, err := gol.New(options...)
+	if err != nil {
+		return nil, err
+	}
 
-	go distributor(p, dChans, aliveCells, keyChan)
-	go pgmIo(p, ioChans)
+	var stopStats func() error
+	if p.stats != "" {
+		var path string
+		stopStats, path, err = recordStats(p, sim)
+		if err != nil {
+			return nil, err
+		}
+		fmt.Println("Writing statistics to", path)
+	}
+	var stopRecording func() error
+	if p.record != "" {
+		var path string
+		stopRecording, path, err = startRecording(p, sim)
+		if err != nil {
+			if stopStats != nil {
+				_ = stopStats()
+			}
+			return nil, err
+		}
+		fmt.Println("Recording frames to", path)
+	}
+	err = controlSimulation(ctx, p, sim, dChans, keyChan)
+	for _, stop := range []func() error{stopStats, stopRecording} {
+		if stop != nil {
+			stopErr := stop()
+			if err == nil {
+				err = stopErr
+			}
+		}
+	}
+	if start, period, found := sim.Cycle(); found {
+		fmt.Println("Stabilised at turn", start, "with period", period)
+	}
+	if err == nil && p.census {
+		err = reportCensus(p, sim)
+	}
+	if err == nil {
+		err = reportHeatmap(p, sim)
+	}
 
-	alive := <-aliveCells
-	return alive
+	var alive []cell
+	for _, c := range sim.AliveCells() {
+		alive = append(alive, cell{x: c.X, y: c.Y})
+	}
+
+	// Make sure that the Io has finished any output before exiting.
+	if err == nil {
+		err = checkIdle(ctx, dChans)
+	}
+	return alive, err
 }
 
 // main is the function called when starting Game of Life with 'make gol'
 // Do not edit until Stage 2.
 func main() {
 	var params golParams
+	var ruleName, jobFile, manifest, engineName, token, symmetry, crop string
+	var parallel, clients, search int
+	var soup gol.Soup
+	var bounded, plane bool
 
 	flag.IntVar(
 		&params.threads,
@@ -121,13 +274,284 @@ func main() {
 		512,
 		"Specify the height of the image. Defaults to 512.")
 
+	flag.BoolVar(
+		&params.tiled,
+		"tiles",
+		false,
+		"Split the world into 2D tiles instead of horizontal strips. Defaults to false.")
+
+	flag.IntVar(
+		&params.haloDepth,
+		"depth",
+		1,
+		"Specify the number of halo rows exchanged at once. Workers exchange halos every depth turns. Defaults to 1.")
+
+	flag.BoolVar(
+		&bounded,
+		"bounded",
+		false,
+		"Treat the cells beyond the edges as dead instead of wrapping around. Defaults to false.")
+
+	flag.BoolVar(
+		&plane,
+		"plane",
+		false,
+		"Run on a plane without edges, which grows as patterns spread. Always uses the sparse engine. Defaults to false.")
+
+	flag.BoolVar(
+		&params.cycles,
+		"cycles",
+		false,
+		"Look for the world repeating itself, and report the turn it stabilised at and its period. Defaults to false.")
+
+	flag.BoolVar(
+		&params.skipCycles,
+		"skip",
+		false,
+		"Look for the world repeating itself, and once it does skip straight to the last turn. Defaults to false.")
+
+	flag.BoolVar(
+		&params.census,
+		"census",
+		false,
+		"Count the still lifes, oscillators and spaceships of the final world, written as JSON next to the images. Defaults to false.")
+
+	flag.StringVar(
+		&params.input,
+		"input",
+		"",
+		"Specify the image to start from, in the format of its extension. Patterns smaller than the world are placed at "+
+			"its top left. Defaults to images/[width]x[height].pgm.")
+
+	flag.StringVar(
+		&params.format,
+		"format",
+		"pgm",
+		"Specify the format images are written in: pgm, pbm, plainpbm, png, cells, life for Life 1.06 or mc for "+
+			"Golly's macrocell. Images are read in the format of their extension. Defaults to pgm.")
+
+	flag.StringVar(
+		&params.stats,
+		"stats",
+		"",
+		"Write the population, births, deaths, bounding box and density of every turn next to the images as they run, "+
+			"in the format csv or jsonl. Defaults to none.")
+
+	flag.IntVar(
+		&params.statsEvery,
+		"statsevery",
+		1,
+		"Specify the number of turns between rows of the statistics, which add up the births and deaths in between. Defaults to 1.")
+
+	flag.StringVar(
+		&params.heatmap,
+		"heatmap",
+		"",
+		"Write a heatmap of the turns each cell was alive or changed in, as a grey pgm and a colour png next to the images "+
+			"on saving and at the end. Specify alive or changed. Defaults to none.")
+
+	flag.StringVar(
+		&params.record,
+		"record",
+		"",
+		"Record every few turns as an animated gif, or as numbered png frames in a directory, next to the images. "+
+			"Specify gif or png. Defaults to none.")
+
+	flag.IntVar(&params.recordEvery, "recordevery", 1, "Specify the number of turns between recorded frames. Defaults to 1.")
+
+	flag.StringVar(
+		&crop,
+		"crop",
+		"",
+		"Record only the cells x,y,width,height, which a plane has to be given. Defaults to the whole world.")
+
+	flag.IntVar(&params.scale, "scale", 1, "Specify the number of pixels along each side of a recorded cell. Defaults to 1.")
+
+	flag.StringVar(
+		&symmetry,
+		"soup",
+		"",
+		"Start from a random soup with the given symmetry: C1, C2, C4 or D8, instead of an image. Defaults to none.")
+
+	flag.Float64Var(&soup.Density, "density", 0.5, "Specify the chance of each cell of a soup being alive. Defaults to 0.5.")
+
+	flag.Int64Var(&soup.Seed, "seed", 0, "Specify the seed of a soup. Defaults to one from the time, which is printed.")
+
+	flag.IntVar(
+		&soup.Size,
+		"soupsize",
+		0,
+		"Specify the side of a square soup in the middle of an otherwise dead world. Defaults to filling the world.")
+
+	flag.IntVar(
+		&search,
+		"search",
+		0,
+		"Search the given number of soups for long lived ones and rare objects instead, one soup per thread. "+
+			"The soups are C1 and 16x16 unless set with the other soup flags. Defaults to none.")
+
+	flag.StringVar(
+		&engineName,
+		"engine",
+		"halo",
+		"Specify the engine: halo, shared, sparse, reference or remote, which runs the workers on stage5 clients. Defaults to halo.")
+
+	flag.IntVar(
+		&clients,
+		"clients",
+		1,
+		"Specify the number of stage5 clients the remote engine waits for on port 4000. Defaults to 1.")
+
+	flag.StringVar(&token, "token", "", "Secret stage5 clients have to present to join. Defaults to none.")
+
+	flag.StringVar(
+		&ruleName,
+		"rule",
+		"B3/S23",
+		"Specify the rule in B/S notation. Defaults to B3/S23, Conway's Game of Life.")
+
+	flag.StringVar(
+		&jobFile,
+		"batch",
+		"",
+		"Run the jobs of a job file instead, with the columns: input rule size turns threads output.")
+
+	flag.StringVar(
+		&manifest,
+		"manifest",
+		"manifest.csv",
+		"Specify the file the results of a batch are written to. Defaults to manifest.csv.")
+
+	flag.IntVar(
+		&parallel,
+		"parallel",
+		1,
+		"Specify the number of batch jobs run at once. Defaults to 1.")
+
 	flag.Parse()
 
+	r, err := gol.ParseRule(ruleName)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	params.rule = &r
+	if bounded {
+		params.topology = gol.Bounded
+	}
+	params.engine, err = gol.ParseEngine(engineName)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	_, err = formatByName(params.format)
+	if err == nil {
+		err = checkStatsFormat(params.stats)
+	}
+	if err == nil {
+		err = checkHeatmap(params.heatmap)
+	}
+	if err == nil {
+		err = checkRecordFormat(params.record)
+	}
+	if err == nil && crop != "" {
+		params.crop, err = parseCrop(crop)
+	}
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	if plane {
+		if bounded {
+			fmt.Println("The world cannot be both bounded and a plane")
+			return
+		}
+		params.topology = gol.Plane
+		params.engine = gol.Sparse
+	}
+
+	if symmetry != "" || search > 0 {
+		if symmetry != "" {
+			soup.Symmetry, err = gol.ParseSymmetry(symmetry)
+			if err != nil {
+				fmt.Println(err)
+				return
+			}
+		}
+		if jobFile != "" {
+			fmt.Println("The jobs of a batch start from their own images, not a soup")
+			return
+		}
+		if soup.Seed == 0 {
+			soup.Seed = time.Now().UnixNano()
+		}
+		params.soup = &soup
+	}
+
+	if search > 0 {
+		if soup.Size == 0 {
+			soup.Size = 16
+		}
+		err = runSearch(params, search)
+		if err != nil {
+			fmt.Println(err)
+		}
+		return
+	}
+
+	var jobs []batch.Job
+	if jobFile != "" {
+		// Checked before waiting for clients, as a mistake in the file would waste their time
+		jobs, err = batch.ReadJobFile(jobFile)
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+	}
+
+	if params.engine == gol.Remote {
+		ln, err := net.Listen("tcp4", ":4000")
+		if err != nil {
+			fmt.Println("Could not listen to port 4000", err)
+			return
+		}
+		fmt.Println("Waiting for", clients, "clients to connect.")
+		params.cluster, err = gol.Accept(ln, clients, token)
+		_ = ln.Close()
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+		defer params.cluster.Close()
+	}
+
+	if jobFile != "" {
+		results, err := runBatch(jobs, parallel, params, func(p golParams) ([]cell, error) {
+			return gameOfLife(context.Background(), p, nil)
+		})
+		if err == nil {
+			err = batch.WriteManifest(manifest, results)
+		}
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+		fmt.Println("Ran", len(results), "jobs, results are in", manifest)
+		return
+	}
+
 	params.turns = 50000
 
-	startControlServer(params)
+	err = startControlServer(params)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
 	keyChan := make(chan rune)
 	go getKeyboardCommand(keyChan)
-	gameOfLife(params, keyChan)
+	_, err = gameOfLife(context.Background(), params, keyChan)
 	StopControlServer()
+	if err != nil {
+		fmt.Println(err)
+	}
 }
@@ -1,11 +1,31 @@
 package main
 
 import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"flag"
 	"github.com/stretchr/testify/assert"
+	"image"
+	"image/color"
+	"image/gif"
+	"image/png"
+	"io/ioutil"
+	"net"
 	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
 	"testing"
+	"time"
+	"uk.ac.bris.cs/gameoflife/batch"
+	"uk.ac.bris.cs/gameoflife/gol"
 )
 
+// Also runs Test on the remote engine, once this many stage5 clients have connected to port 4000
+var remoteClients = flag.Int("remote", 0, "number of stage5 clients to run Test on")
+
 func Test(t *testing.T) {
 	type args struct {
 		p             golParams
@@ -31,44 +51,512 @@ func Test(t *testing.T) {
 			},
 		}},
 
-		{"16x16x4-0", args{
+		{"16x16x4-0", args{
+			p: golParams{
+				turns:       0,
+				threads:     4,
+				imageWidth:  16,
+				imageHeight: 16,
+			},
+			expectedAlive: []cell{
+				{x: 4, y: 5},
+				{x: 5, y: 6},
+				{x: 3, y: 7},
+				{x: 4, y: 7},
+				{x: 5, y: 7},
+			},
+		}},
+
+		{"16x16x8-0", args{
+			p: golParams{
+				turns:       0,
+				threads:     8,
+				imageWidth:  16,
+				imageHeight: 16,
+			},
+			expectedAlive: []cell{
+				{x: 4, y: 5},
+				{x: 5, y: 6},
+				{x: 3, y: 7},
+				{x: 4, y: 7},
+				{x: 5, y: 7},
+			},
+		}},
+
+		{"16x16x2-1", args{
+			p: golParams{
+				turns:       1,
+				threads:     2,
+				imageWidth:  16,
+				imageHeight: 16,
+			},
+			expectedAlive: []cell{
+				{x: 3, y: 6},
+				{x: 5, y: 6},
+				{x: 4, y: 7},
+				{x: 5, y: 7},
+				{x: 4, y: 8},
+			},
+		}},
+
+		{"16x16x4-1", args{
+			p: golParams{
+				turns:       1,
+				threads:     4,
+				imageWidth:  16,
+				imageHeight: 16,
+			},
+			expectedAlive: []cell{
+				{x: 3, y: 6},
+				{x: 5, y: 6},
+				{x: 4, y: 7},
+				{x: 5, y: 7},
+				{x: 4, y: 8},
+			},
+		}},
+
+		{"16x16x8-1", args{
+			p: golParams{
+				turns:       1,
+				threads:     8,
+				imageWidth:  16,
+				imageHeight: 16,
+			},
+			expectedAlive: []cell{
+				{x: 3, y: 6},
+				{x: 5, y: 6},
+				{x: 4, y: 7},
+				{x: 5, y: 7},
+				{x: 4, y: 8},
+			},
+		}},
+
+		{"16x16x2-100", args{
+			p: golParams{
+				turns:       100,
+				threads:     2,
+				imageWidth:  16,
+				imageHeight: 16,
+			},
+			expectedAlive: []cell{
+				{x: 12, y: 0},
+				{x: 13, y: 0},
+				{x: 14, y: 0},
+				{x: 13, y: 14},
+				{x: 14, y: 15},
+			},
+		}},
+
+		{"16x16x4-100", args{
+			p: golParams{
+				turns:       100,
+				threads:     4,
+				imageWidth:  16,
+				imageHeight: 16,
+			},
+			expectedAlive: []cell{
+				{x: 12, y: 0},
+				{x: 13, y: 0},
+				{x: 14, y: 0},
+				{x: 13, y: 14},
+				{x: 14, y: 15},
+			},
+		}},
+
+		{"16x16x8-100", args{
+			p: golParams{
+				turns:       100,
+				threads:     8,
+				imageWidth:  16,
+				imageHeight: 16,
+			},
+			expectedAlive: []cell{
+				{x: 12, y: 0},
+				{x: 13, y: 0},
+				{x: 14, y: 0},
+				{x: 13, y: 14},
+				{x: 14, y: 15},
+			},
+		}},
+
+		// New 6, 10, 12 thread tests
+		{"16x16x6-1", args{
+			p: golParams{
+				turns:       1,
+				threads:     6,
+				imageWidth:  16,
+				imageHeight: 16,
+			},
+			expectedAlive: []cell{
+				{x: 3, y: 6},
+				{x: 5, y: 6},
+				{x: 4, y: 7},
+				{x: 5, y: 7},
+				{x: 4, y: 8},
+			},
+		}},
+
+		{"16x16x10-1", args{
+			p: golParams{
+				turns:       1,
+				threads:     10,
+				imageWidth:  16,
+				imageHeight: 16,
+			},
+			expectedAlive: []cell{
+				{x: 3, y: 6},
+				{x: 5, y: 6},
+				{x: 4, y: 7},
+				{x: 5, y: 7},
+				{x: 4, y: 8},
+			},
+		}},
+
+		{"16x16x12-1", args{
+			p: golParams{
+				turns:       1,
+				threads:     12,
+				imageWidth:  16,
+				imageHeight: 16,
+			},
+			expectedAlive: []cell{
+				{x: 3, y: 6},
+				{x: 5, y: 6},
+				{x: 4, y: 7},
+				{x: 5, y: 7},
+				{x: 4, y: 8},
+			},
+		}},
+
+		{"16x16x6-100", args{
+			p: golParams{
+				turns:       100,
+				threads:     6,
+				imageWidth:  16,
+				imageHeight: 16,
+			},
+			expectedAlive: []cell{
+				{x: 12, y: 0},
+				{x: 13, y: 0},
+				{x: 14, y: 0},
+				{x: 13, y: 14},
+				{x: 14, y: 15},
+			},
+		}},
+
+		{"16x16x10-100", args{
+			p: golParams{
+				turns:       100,
+				threads:     10,
+				imageWidth:  16,
+				imageHeight: 16,
+			},
+			expectedAlive: []cell{
+				{x: 12, y: 0},
+				{x: 13, y: 0},
+				{x: 14, y: 0},
+				{x: 13, y: 14},
+				{x: 14, y: 15},
+			},
+		}},
+
+		{"16x16x12-100", args{
+			p: golParams{
+				turns:       100,
+				threads:     12,
+				imageWidth:  16,
+				imageHeight: 16,
+			},
+			expectedAlive: []cell{
+				{x: 12, y: 0},
+				{x: 13, y: 0},
+				{x: 14, y: 0},
+				{x: 13, y: 14},
+				{x: 14, y: 15},
+			},
+		}},
+
+		// 2D tile tests
+		{"16x16x1-1-tiles", args{
+			p: golParams{
+				turns:       1,
+				threads:     1,
+				imageWidth:  16,
+				imageHeight: 16,
+				tiled:       true,
+			},
+			expectedAlive: []cell{
+				{x: 3, y: 6},
+				{x: 5, y: 6},
+				{x: 4, y: 7},
+				{x: 5, y: 7},
+				{x: 4, y: 8},
+			},
+		}},
+
+		{"16x16x4-1-tiles", args{
+			p: golParams{
+				turns:       1,
+				threads:     4,
+				imageWidth:  16,
+				imageHeight: 16,
+				tiled:       true,
+			},
+			expectedAlive: []cell{
+				{x: 3, y: 6},
+				{x: 5, y: 6},
+				{x: 4, y: 7},
+				{x: 5, y: 7},
+				{x: 4, y: 8},
+			},
+		}},
+
+		{"16x16x6-1-tiles", args{
+			p: golParams{
+				turns:       1,
+				threads:     6,
+				imageWidth:  16,
+				imageHeight: 16,
+				tiled:       true,
+			},
+			expectedAlive: []cell{
+				{x: 3, y: 6},
+				{x: 5, y: 6},
+				{x: 4, y: 7},
+				{x: 5, y: 7},
+				{x: 4, y: 8},
+			},
+		}},
+
+		{"16x16x8-1-tiles", args{
+			p: golParams{
+				turns:       1,
+				threads:     8,
+				imageWidth:  16,
+				imageHeight: 16,
+				tiled:       true,
+			},
+			expectedAlive: []cell{
+				{x: 3, y: 6},
+				{x: 5, y: 6},
+				{x: 4, y: 7},
+				{x: 5, y: 7},
+				{x: 4, y: 8},
+			},
+		}},
+
+		{"16x16x9-1-tiles", args{
+			p: golParams{
+				turns:       1,
+				threads:     9,
+				imageWidth:  16,
+				imageHeight: 16,
+				tiled:       true,
+			},
+			expectedAlive: []cell{
+				{x: 3, y: 6},
+				{x: 5, y: 6},
+				{x: 4, y: 7},
+				{x: 5, y: 7},
+				{x: 4, y: 8},
+			},
+		}},
+
+		{"16x16x12-1-tiles", args{
+			p: golParams{
+				turns:       1,
+				threads:     12,
+				imageWidth:  16,
+				imageHeight: 16,
+				tiled:       true,
+			},
+			expectedAlive: []cell{
+				{x: 3, y: 6},
+				{x: 5, y: 6},
+				{x: 4, y: 7},
+				{x: 5, y: 7},
+				{x: 4, y: 8},
+			},
+		}},
+
+		{"16x16x16-1-tiles", args{
+			p: golParams{
+				turns:       1,
+				threads:     16,
+				imageWidth:  16,
+				imageHeight: 16,
+				tiled:       true,
+			},
+			expectedAlive: []cell{
+				{x: 3, y: 6},
+				{x: 5, y: 6},
+				{x: 4, y: 7},
+				{x: 5, y: 7},
+				{x: 4, y: 8},
+			},
+		}},
+
+		{"16x16x1-100-tiles", args{
+			p: golParams{
+				turns:       100,
+				threads:     1,
+				imageWidth:  16,
+				imageHeight: 16,
+				tiled:       true,
+			},
+			expectedAlive: []cell{
+				{x: 12, y: 0},
+				{x: 13, y: 0},
+				{x: 14, y: 0},
+				{x: 13, y: 14},
+				{x: 14, y: 15},
+			},
+		}},
+
+		{"16x16x4-100-tiles", args{
+			p: golParams{
+				turns:       100,
+				threads:     4,
+				imageWidth:  16,
+				imageHeight: 16,
+				tiled:       true,
+			},
+			expectedAlive: []cell{
+				{x: 12, y: 0},
+				{x: 13, y: 0},
+				{x: 14, y: 0},
+				{x: 13, y: 14},
+				{x: 14, y: 15},
+			},
+		}},
+
+		{"16x16x6-100-tiles", args{
+			p: golParams{
+				turns:       100,
+				threads:     6,
+				imageWidth:  16,
+				imageHeight: 16,
+				tiled:       true,
+			},
+			expectedAlive: []cell{
+				{x: 12, y: 0},
+				{x: 13, y: 0},
+				{x: 14, y: 0},
+				{x: 13, y: 14},
+				{x: 14, y: 15},
+			},
+		}},
+
+		{"16x16x8-100-tiles", args{
+			p: golParams{
+				turns:       100,
+				threads:     8,
+				imageWidth:  16,
+				imageHeight: 16,
+				tiled:       true,
+			},
+			expectedAlive: []cell{
+				{x: 12, y: 0},
+				{x: 13, y: 0},
+				{x: 14, y: 0},
+				{x: 13, y: 14},
+				{x: 14, y: 15},
+			},
+		}},
+
+		{"16x16x9-100-tiles", args{
+			p: golParams{
+				turns:       100,
+				threads:     9,
+				imageWidth:  16,
+				imageHeight: 16,
+				tiled:       true,
+			},
+			expectedAlive: []cell{
+				{x: 12, y: 0},
+				{x: 13, y: 0},
+				{x: 14, y: 0},
+				{x: 13, y: 14},
+				{x: 14, y: 15},
+			},
+		}},
+
+		{"16x16x12-100-tiles", args{
+			p: golParams{
+				turns:       100,
+				threads:     12,
+				imageWidth:  16,
+				imageHeight: 16,
+				tiled:       true,
+			},
+			expectedAlive: []cell{
+				{x: 12, y: 0},
+				{x: 13, y: 0},
+				{x: 14, y: 0},
+				{x: 13, y: 14},
+				{x: 14, y: 15},
+			},
+		}},
+
+		{"16x16x16-100-tiles", args{
+			p: golParams{
+				turns:       100,
+				threads:     16,
+				imageWidth:  16,
+				imageHeight: 16,
+				tiled:       true,
+			},
+			expectedAlive: []cell{
+				{x: 12, y: 0},
+				{x: 13, y: 0},
+				{x: 14, y: 0},
+				{x: 13, y: 14},
+				{x: 14, y: 15},
+			},
+		}},
+
+		// Deep halo tests
+		{"16x16x2-1-depth3", args{
 			p: golParams{
-				turns:       0,
-				threads:     4,
+				turns:       1,
+				threads:     2,
 				imageWidth:  16,
 				imageHeight: 16,
+				haloDepth:   3,
 			},
 			expectedAlive: []cell{
-				{x: 4, y: 5},
+				{x: 3, y: 6},
 				{x: 5, y: 6},
-				{x: 3, y: 7},
 				{x: 4, y: 7},
 				{x: 5, y: 7},
+				{x: 4, y: 8},
 			},
 		}},
 
-		{"16x16x8-0", args{
+		{"16x16x4-1-depth4", args{
 			p: golParams{
-				turns:       0,
-				threads:     8,
+				turns:       1,
+				threads:     4,
 				imageWidth:  16,
 				imageHeight: 16,
+				haloDepth:   4,
 			},
 			expectedAlive: []cell{
-				{x: 4, y: 5},
+				{x: 3, y: 6},
 				{x: 5, y: 6},
-				{x: 3, y: 7},
 				{x: 4, y: 7},
 				{x: 5, y: 7},
+				{x: 4, y: 8},
 			},
 		}},
 
-		{"16x16x2-1", args{
+		{"16x16x8-1-depth4", args{
 			p: golParams{
 				turns:       1,
-				threads:     2,
+				threads:     8,
 				imageWidth:  16,
 				imageHeight: 16,
+				haloDepth:   4,
 			},
 			expectedAlive: []cell{
 				{x: 3, y: 6},
@@ -79,12 +567,14 @@ func Test(t *testing.T) {
 			},
 		}},
 
-		{"16x16x4-1", args{
+		{"16x16x4-1-depth4-tiles", args{
 			p: golParams{
 				turns:       1,
 				threads:     4,
 				imageWidth:  16,
 				imageHeight: 16,
+				tiled:       true,
+				haloDepth:   4,
 			},
 			expectedAlive: []cell{
 				{x: 3, y: 6},
@@ -95,12 +585,14 @@ func Test(t *testing.T) {
 			},
 		}},
 
-		{"16x16x8-1", args{
+		{"16x16x9-1-depth5-tiles", args{
 			p: golParams{
 				turns:       1,
-				threads:     8,
+				threads:     9,
 				imageWidth:  16,
 				imageHeight: 16,
+				tiled:       true,
+				haloDepth:   5,
 			},
 			expectedAlive: []cell{
 				{x: 3, y: 6},
@@ -111,12 +603,13 @@ func Test(t *testing.T) {
 			},
 		}},
 
-		{"16x16x2-100", args{
+		{"16x16x1-100-depth2", args{
 			p: golParams{
 				turns:       100,
-				threads:     2,
+				threads:     1,
 				imageWidth:  16,
 				imageHeight: 16,
+				haloDepth:   2,
 			},
 			expectedAlive: []cell{
 				{x: 12, y: 0},
@@ -127,12 +620,13 @@ func Test(t *testing.T) {
 			},
 		}},
 
-		{"16x16x4-100", args{
+		{"16x16x2-100-depth3", args{
 			p: golParams{
 				turns:       100,
-				threads:     4,
+				threads:     2,
 				imageWidth:  16,
 				imageHeight: 16,
+				haloDepth:   3,
 			},
 			expectedAlive: []cell{
 				{x: 12, y: 0},
@@ -143,12 +637,13 @@ func Test(t *testing.T) {
 			},
 		}},
 
-		{"16x16x8-100", args{
+		{"16x16x4-100-depth4", args{
 			p: golParams{
 				turns:       100,
-				threads:     8,
+				threads:     4,
 				imageWidth:  16,
 				imageHeight: 16,
+				haloDepth:   4,
 			},
 			expectedAlive: []cell{
 				{x: 12, y: 0},
@@ -159,61 +654,31 @@ func Test(t *testing.T) {
 			},
 		}},
 
-		// New 6, 10, 12 thread tests
-		{"16x16x6-1", args{
-			p: golParams{
-				turns:       1,
-				threads:     6,
-				imageWidth:  16,
-				imageHeight: 16,
-			},
-			expectedAlive: []cell{
-				{x: 3, y: 6},
-				{x: 5, y: 6},
-				{x: 4, y: 7},
-				{x: 5, y: 7},
-				{x: 4, y: 8},
-			},
-		}},
-
-		{"16x16x10-1", args{
-			p: golParams{
-				turns:       1,
-				threads:     10,
-				imageWidth:  16,
-				imageHeight: 16,
-			},
-			expectedAlive: []cell{
-				{x: 3, y: 6},
-				{x: 5, y: 6},
-				{x: 4, y: 7},
-				{x: 5, y: 7},
-				{x: 4, y: 8},
-			},
-		}},
-
-		{"16x16x12-1", args{
+		{"16x16x8-100-depth4", args{
 			p: golParams{
-				turns:       1,
-				threads:     12,
+				turns:       100,
+				threads:     8,
 				imageWidth:  16,
 				imageHeight: 16,
+				haloDepth:   4,
 			},
 			expectedAlive: []cell{
-				{x: 3, y: 6},
-				{x: 5, y: 6},
-				{x: 4, y: 7},
-				{x: 5, y: 7},
-				{x: 4, y: 8},
+				{x: 12, y: 0},
+				{x: 13, y: 0},
+				{x: 14, y: 0},
+				{x: 13, y: 14},
+				{x: 14, y: 15},
 			},
 		}},
 
-		{"16x16x6-100", args{
+		{"16x16x4-100-depth3-tiles", args{
 			p: golParams{
 				turns:       100,
-				threads:     6,
+				threads:     4,
 				imageWidth:  16,
 				imageHeight: 16,
+				tiled:       true,
+				haloDepth:   3,
 			},
 			expectedAlive: []cell{
 				{x: 12, y: 0},
@@ -224,12 +689,14 @@ func Test(t *testing.T) {
 			},
 		}},
 
-		{"16x16x10-100", args{
+		{"16x16x9-100-depth5-tiles", args{
 			p: golParams{
 				turns:       100,
-				threads:     10,
+				threads:     9,
 				imageWidth:  16,
 				imageHeight: 16,
+				tiled:       true,
+				haloDepth:   5,
 			},
 			expectedAlive: []cell{
 				{x: 12, y: 0},
@@ -240,12 +707,14 @@ func Test(t *testing.T) {
 			},
 		}},
 
-		{"16x16x12-100", args{
+		{"16x16x16-100-depth4-tiles", args{
 			p: golParams{
 				turns:       100,
-				threads:     12,
+				threads:     16,
 				imageWidth:  16,
 				imageHeight: 16,
+				tiled:       true,
+				haloDepth:   4,
 			},
 			expectedAlive: []cell{
 				{x: 12, y: 0},
@@ -266,14 +735,35 @@ func Test(t *testing.T) {
 		//	},
 		//}},
 	}
-	for _, test := range tests {
-		t.Run(test.name, func(t *testing.T) {
-			alive := gameOfLife(test.args.p, nil)
-			//fmt.Println("Ran test:", test.name)
-			if test.name != "trace" {
-				assert.ElementsMatch(t, alive, test.args.expectedAlive)
-			}
-		})
+
+	// Every engine has to pass the same tests
+	engines := []gol.Engine{gol.Halo, gol.Shared, gol.Reference, gol.Sparse}
+	var cluster *gol.Cluster
+	if *remoteClients > 0 {
+		ln, err := net.Listen("tcp4", ":4000")
+		assert.NoError(t, err)
+		t.Log("Waiting for", *remoteClients, "clients to connect.")
+		cluster, err = gol.Accept(ln, *remoteClients, "")
+		_ = ln.Close()
+		assert.NoError(t, err)
+		defer cluster.Close()
+		engines = append(engines, gol.Remote)
+	}
+
+	for _, engine := range engines {
+		for _, test := range tests {
+			t.Run(test.name+"/"+engine.String(), func(t *testing.T) {
+				p := test.args.p
+				p.engine = engine
+				p.cluster = cluster
+				alive, err := gameOfLife(context.Background(), p, nil)
+				assert.NoError(t, err)
+				//fmt.Println("Ran test:", test.name)
+				if test.name != "trace" {
+					assert.ElementsMatch(t, alive, test.args.expectedAlive)
+				}
+			})
+		}
 	}
 }
 
@@ -403,14 +893,666 @@ func Benchmark(b *testing.B) {
 				imageWidth:  512,
 				imageHeight: 512,
 			}},
+
+		{
+			"512x512x16", golParams{
+				turns:       benchLength,
+				threads:     16,
+				imageWidth:  512,
+				imageHeight: 512,
+			}},
+
+		{
+			"512x512x64", golParams{
+				turns:       benchLength,
+				threads:     64,
+				imageWidth:  512,
+				imageHeight: 512,
+			}},
+
+		{
+			"512x512x128", golParams{
+				turns:       benchLength,
+				threads:     128,
+				imageWidth:  512,
+				imageHeight: 512,
+			}},
+
+		{
+			"512x512x8-tiles", golParams{
+				turns:       benchLength,
+				threads:     8,
+				imageWidth:  512,
+				imageHeight: 512,
+				tiled:       true,
+			}},
+
+		{
+			"512x512x16-tiles", golParams{
+				turns:       benchLength,
+				threads:     16,
+				imageWidth:  512,
+				imageHeight: 512,
+				tiled:       true,
+			}},
+
+		{
+			"512x512x64-tiles", golParams{
+				turns:       benchLength,
+				threads:     64,
+				imageWidth:  512,
+				imageHeight: 512,
+				tiled:       true,
+			}},
+
+		{
+			"512x512x128-tiles", golParams{
+				turns:       benchLength,
+				threads:     128,
+				imageWidth:  512,
+				imageHeight: 512,
+				tiled:       true,
+			}},
+
+		{
+			"512x512x8-depth4", golParams{
+				turns:       benchLength,
+				threads:     8,
+				imageWidth:  512,
+				imageHeight: 512,
+				haloDepth:   4,
+			}},
+
+		{
+			"512x512x16-depth4", golParams{
+				turns:       benchLength,
+				threads:     16,
+				imageWidth:  512,
+				imageHeight: 512,
+				haloDepth:   4,
+			}},
+
+		{
+			"512x512x64-depth4", golParams{
+				turns:       benchLength,
+				threads:     64,
+				imageWidth:  512,
+				imageHeight: 512,
+				haloDepth:   4,
+			}},
+
+		{
+			"512x512x64-tiles-depth4", golParams{
+				turns:       benchLength,
+				threads:     64,
+				imageWidth:  512,
+				imageHeight: 512,
+				tiled:       true,
+				haloDepth:   4,
+			}},
+
+		{
+			"512x512x128-tiles-depth4", golParams{
+				turns:       benchLength,
+				threads:     128,
+				imageWidth:  512,
+				imageHeight: 512,
+				tiled:       true,
+				haloDepth:   4,
+			}},
 	}
+	// The shared memory engine reports its speedup over the halo engine, which runs first
+	haloTimes := make(map[string]time.Duration)
 	for _, bm := range benchmarks {
 		os.Stdout = nil // Disable all program output apart from benchmark results
-		b.Run(bm.name, func(b *testing.B) {
-			for i := 0; i < b.N; i++ {
-				gameOfLife(bm.p, nil)
-				//fmt.Println("Ran bench:", bm.name)
+		for _, engine := range []gol.Engine{gol.Halo, gol.Shared} {
+			p := bm.p
+			p.engine = engine
+			b.Run(bm.name+"/"+engine.String(), func(b *testing.B) {
+				start := time.Now()
+				for i := 0; i < b.N; i++ {
+					_, err := gameOfLife(context.Background(), p, nil)
+					if err != nil {
+						b.Fatal(err)
+					}
+					//fmt.Println("Ran bench:", bm.name)
+				}
+				perRun := time.Since(start) / time.Duration(b.N)
+				if engine == gol.Halo {
+					haloTimes[bm.name] = perRun
+				} else if haloTimes[bm.name] > 0 {
+					b.ReportMetric(float64(haloTimes[bm.name])/float64(perRun), "speedup")
+				}
+			})
+		}
+	}
+}
+
+func TestBatch(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gol-batch")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	jobFile := filepath.Join(dir, "jobs.txt")
+	assert.NoError(t, ioutil.WriteFile(jobFile, []byte(`# input rule size turns threads output
+images/16x16.pgm B3/S23 16x16 100 4 `+dir+`/conway
+images/16x16.pgm B36/S23 16x16 100 2 `+dir+`/highlife
+
+images/16x16.pgm B/S 16x16 1 1 `+dir+`/empty
+images/64x64.pgm B3/S23 16x16 1 1 `+dir+`/wrong
+`), 0644))
+
+	jobs, err := batch.ReadJobFile(jobFile)
+	assert.NoError(t, err)
+	assert.Len(t, jobs, 4)
+
+	results, err := runBatch(jobs, 2, golParams{}, func(p golParams) ([]cell, error) {
+		return gameOfLife(context.Background(), p, nil)
+	})
+	assert.NoError(t, err)
+
+	// The glider in 16x16.pgm never has 6 neighbours, so it moves the same under HighLife
+	assert.Equal(t, 5, results[0].Population)
+	assert.Equal(t, 5, results[1].Population)
+	assert.Equal(t, 0, results[2].Population)
+	assert.Error(t, results[3].Err)
+	for _, r := range results[:3] {
+		assert.NoError(t, r.Err)
+		width, height, err := pgmSize(r.Image)
+		assert.NoError(t, err)
+		assert.Equal(t, []int{16, 16}, []int{width, height})
+	}
+
+	manifest := filepath.Join(dir, "manifest.csv")
+	assert.NoError(t, batch.WriteManifest(manifest, results))
+	file, err := os.Open(manifest)
+	assert.NoError(t, err)
+	defer file.Close()
+	rows, err := csv.NewReader(file).ReadAll()
+	assert.NoError(t, err)
+	assert.Len(t, rows, 5)
+	assert.Equal(t, []string{"2", "images/16x16.pgm", "B3/S23", "16x16", "100", "4", "5"}, rows[1][:7])
+	assert.Equal(t, results[0].Image, rows[1][8])
+
+	// Jobs with missing or invalid columns are reported with their line
+	assert.NoError(t, ioutil.WriteFile(jobFile, []byte("images/16x16.pgm B3/S23 16x16 100 4\n"), 0644))
+	_, err = batch.ReadJobFile(jobFile)
+	assert.Error(t, err)
+	assert.NoError(t, ioutil.WriteFile(jobFile, []byte("images/16x16.pgm B3/S23 16 100 4 out\n"), 0644))
+	_, err = batch.ReadJobFile(jobFile)
+	assert.Error(t, err)
+}
+
+// Every goroutine started by gameOfLife stops, whether it finishes, fails, is cancelled or quits
+func TestGoroutines(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gol-goroutines")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	before := runtime.NumGoroutine()
+
+	p := golParams{turns: 10, threads: 4, imageWidth: 64, imageHeight: 64, outputDir: dir}
+	alive, err := gameOfLife(context.Background(), p, nil)
+	assert.NoError(t, err)
+	assert.NotEmpty(t, alive)
+
+	p.input = "images/16x16.pgm"
+	_, err = gameOfLife(context.Background(), p, nil)
+	assert.Error(t, err)
+	p.input = filepath.Join(dir, "missing.pgm")
+	_, err = gameOfLife(context.Background(), p, nil)
+	assert.Error(t, err)
+
+	p = golParams{turns: 1000000, threads: 8, imageWidth: 512, imageHeight: 512, tiled: true, outputDir: dir}
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	_, err = gameOfLife(ctx, p, nil)
+	assert.Equal(t, context.DeadlineExceeded, err)
+
+	keys := make(chan rune, 1)
+	keys <- 'q'
+	_, err = gameOfLife(context.Background(), p, keys)
+	assert.NoError(t, err)
+	saved, err := filepath.Glob(filepath.Join(dir, "512x512_state_*.pgm"))
+	assert.NoError(t, err)
+	assert.Len(t, saved, 1)
+
+	// Goroutines may still be returning after their last send
+	for i := 0; i < 100 && runtime.NumGoroutine() > before; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.Equal(t, before, runtime.NumGoroutine())
+}
+
+// The glider of 16x16.pgm flies off the image on a plane, and is written cropped
+func TestPlane(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gol-plane")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	p := golParams{turns: 100, threads: 2, imageWidth: 16, imageHeight: 16, topology: gol.Plane, engine: gol.Sparse}
+	alive, err := gameOfLife(context.Background(), p, nil)
+	assert.NoError(t, err)
+	assert.Len(t, alive, 5)
+	for _, c := range alive {
+		assert.True(t, c.x >= 16 && c.y >= 16, c)
+	}
+
+	width, height, cropped := cropCells(alive)
+	assert.Equal(t, []int{3, 3}, []int{width, height})
+	path := filepath.Join(dir, "glider.pgm")
+	assert.NoError(t, writePgm(path, width, height, cropped))
+	width, height, err = pgmSize(path)
+	assert.NoError(t, err)
+	assert.Equal(t, []int{3, 3}, []int{width, height})
+}
+
+// The glider of 16x16.pgm comes back every 64 turns, so 100000 turns end like 32 once it is found
+func TestCycles(t *testing.T) {
+	p := golParams{turns: 32, threads: 4, imageWidth: 16, imageHeight: 16}
+	expected, err := gameOfLife(context.Background(), p, nil)
+	assert.NoError(t, err)
+
+	p.turns = 100000
+	p.skipCycles = true
+	alive, err := gameOfLife(context.Background(), p, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, expected, alive)
+}
+
+// The census of 16x16.pgm is the glider, written as JSON
+func TestCensus(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gol-census")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	p := golParams{turns: 10, threads: 2, imageWidth: 16, imageHeight: 16, census: true, outputDir: dir}
+	_, err = gameOfLife(context.Background(), p, nil)
+	assert.NoError(t, err)
+
+	data, err := ioutil.ReadFile(filepath.Join(dir, "16x16_census_10.json"))
+	assert.NoError(t, err)
+	var census []struct {
+		Name   string
+		Kind   string
+		Period int
+		Count  int
+	}
+	assert.NoError(t, json.Unmarshal(data, &census))
+	assert.Len(t, census, 1)
+	assert.Equal(t, "glider", census[0].Name)
+	assert.Equal(t, "spaceship", census[0].Kind)
+	assert.Equal(t, []int{4, 1}, []int{census[0].Period, census[0].Count})
+}
+
+// A soup is the same for the same seed, which is recorded in the images
+func TestSoup(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gol-soup")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	soup := gol.Soup{Density: 0.4, Seed: 7, Symmetry: gol.C4, Size: 32}
+	p := golParams{turns: 50, threads: 4, imageWidth: 64, imageHeight: 64, soup: &soup, outputDir: dir}
+	first, err := gameOfLife(context.Background(), p, nil)
+	assert.NoError(t, err)
+	second, err := gameOfLife(context.Background(), p, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, first, second)
+
+	// Quitting saves the world, with the soup in a comment which does not stop it being read
+	p.turns = 1000000
+	keys := make(chan rune, 1)
+	keys <- 'q'
+	_, err = gameOfLife(context.Background(), p, keys)
+	assert.NoError(t, err)
+	saved, err := filepath.Glob(filepath.Join(dir, "64x64_state_*.pgm"))
+	assert.NoError(t, err)
+	assert.Len(t, saved, 1)
+	data, err := ioutil.ReadFile(saved[0])
+	assert.NoError(t, err)
+	assert.Contains(t, string(data), "# "+soup.String()+"\n")
+	width, height, err := pgmSize(saved[0])
+	assert.NoError(t, err)
+	assert.Equal(t, []int{64, 64}, []int{width, height})
+}
+
+// A search writes its hall of fame as text and JSON, named by its first seed
+func TestSearch(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gol-search")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	soup := gol.Soup{Density: 0.5, Seed: 3, Size: 8}
+	p := golParams{threads: 2, soup: &soup, outputDir: dir}
+	assert.NoError(t, runSearch(p, 4))
+
+	text, err := ioutil.ReadFile(filepath.Join(dir, "search_3.txt"))
+	assert.NoError(t, err)
+	assert.Contains(t, string(text), "Searched 4 soups")
+	data, err := ioutil.ReadFile(filepath.Join(dir, "search_3.json"))
+	assert.NoError(t, err)
+	var h gol.HallOfFame
+	assert.NoError(t, json.Unmarshal(data, &h))
+	assert.Equal(t, 4, h.Soups)
+	assert.Len(t, h.Longest, 4)
+}
+
+// The statistics of a glider are written as the turns run, with the world it starts from first
+func TestStats(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gol-stats")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	p := golParams{turns: 10, threads: 2, imageWidth: 16, imageHeight: 16, stats: "csv", statsEvery: 2, outputDir: dir}
+	_, err = gameOfLife(context.Background(), p, nil)
+	assert.NoError(t, err)
+	file, err := os.Open(filepath.Join(dir, "16x16_stats.csv"))
+	assert.NoError(t, err)
+	rows, err := csv.NewReader(file).ReadAll()
+	file.Close()
+	assert.NoError(t, err)
+	assert.Len(t, rows, 7)
+	assert.Equal(t, []string{"turn", "population", "births", "deaths", "min_x", "min_y", "max_x", "max_y", "density"}, rows[0])
+	for i, row := range rows[1:] {
+		assert.Equal(t, strconv.Itoa(2*i), row[0])
+		assert.Equal(t, "5", row[1])
+		assert.Equal(t, row[2], row[3])
+		assert.Equal(t, "0.01953125", row[8])
+	}
+	assert.Equal(t, []string{"0", "0"}, rows[1][2:4])
+
+	p.stats, p.statsEvery = "jsonl", 0
+	_, err = gameOfLife(context.Background(), p, nil)
+	assert.NoError(t, err)
+	data, err := ioutil.ReadFile(filepath.Join(dir, "16x16_stats.jsonl"))
+	assert.NoError(t, err)
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	assert.Len(t, lines, 11)
+	var last statsRow
+	assert.NoError(t, json.Unmarshal([]byte(lines[10]), &last))
+	assert.Equal(t, 10, last.Turn)
+	assert.Equal(t, 5, last.Population)
+	assert.NotNil(t, last.Bounds)
+	assert.Equal(t, 2, last.Bounds.MaxX-last.Bounds.MinX)
+}
+
+// A heatmap is written at the end as a pgm and a png of the same levels
+func TestHeatmap(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gol-heatmap")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	p := golParams{turns: 10, threads: 2, imageWidth: 16, imageHeight: 16, heatmap: "changed", outputDir: dir}
+	_, err = gameOfLife(context.Background(), p, nil)
+	assert.NoError(t, err)
+
+	width, height, levels, err := readPgm(filepath.Join(dir, "16x16_heatmap_10.pgm"))
+	assert.NoError(t, err)
+	assert.Equal(t, []int{16, 16}, []int{width, height})
+	assert.Contains(t, levels, byte(255))
+
+	file, err := os.Open(filepath.Join(dir, "16x16_heatmap_10.png"))
+	assert.NoError(t, err)
+	img, err := png.Decode(file)
+	file.Close()
+	assert.NoError(t, err)
+	paletted, ok := img.(*image.Paletted)
+	assert.True(t, ok)
+	assert.Equal(t, levels, paletted.Pix)
+	assert.Equal(t, color.RGBA{255, 255, 255, 255}, paletted.Palette[255])
+
+	assert.Error(t, checkHeatmap("dead"))
+}
+
+// Every few turns of a glider are recorded as a gif or png frames, cropped and scaled
+func TestRecord(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gol-record")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	p := golParams{turns: 8, threads: 2, imageWidth: 16, imageHeight: 16, record: "gif", recordEvery: 2, scale: 3, outputDir: dir}
+	_, err = gameOfLife(context.Background(), p, nil)
+	assert.NoError(t, err)
+	file, err := os.Open(filepath.Join(dir, "16x16_frames.gif"))
+	assert.NoError(t, err)
+	g, err := gif.DecodeAll(file)
+	file.Close()
+	assert.NoError(t, err)
+	assert.Len(t, g.Image, 5)
+	for _, frame := range g.Image {
+		assert.Equal(t, image.Rect(0, 0, 48, 48), frame.Bounds())
+		alive := 0
+		for _, index := range frame.Pix {
+			if index == 1 {
+				alive++
 			}
-		})
+		}
+		assert.Equal(t, 5*9, alive)
 	}
+
+	p.record, p.recordEvery, p.scale = "png", 0, 0
+	p.crop, err = parseCrop("0,0,8,4")
+	assert.NoError(t, err)
+	_, err = gameOfLife(context.Background(), p, nil)
+	assert.NoError(t, err)
+	frames, err := filepath.Glob(filepath.Join(dir, "16x16_frames", "*.png"))
+	assert.NoError(t, err)
+	assert.Len(t, frames, 9)
+	file, err = os.Open(filepath.Join(dir, "16x16_frames", "000008.png"))
+	assert.NoError(t, err)
+	img, err := png.Decode(file)
+	file.Close()
+	assert.NoError(t, err)
+	assert.Equal(t, image.Rect(0, 0, 8, 4), img.Bounds())
+
+	_, err = parseCrop("0,0,0,4")
+	assert.Error(t, err)
+	p.topology, p.engine, p.crop = gol.Plane, gol.Sparse, image.Rectangle{}
+	_, err = gameOfLife(context.Background(), p, nil)
+	assert.Error(t, err)
+}
+
+// Every format reads back the world it wrote, and worlds are read and written in the format of -format
+func TestFormats(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gol-formats")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	// A width which is not a multiple of 8, so raw pbm rows are padded, with the last row and column alive
+	width, height := 75, 7
+	pixels := make([]byte, width*height)
+	for i := range pixels {
+		if i%3 == 0 || i%7 == 0 || i == len(pixels)-1 {
+			pixels[i] = 0xFF
+		}
+	}
+	for name, f := range imageFormats {
+		path := filepath.Join(dir, "world-"+name+f.extensions[0])
+		assert.NoError(t, writeImageFile(path, f, width, height, pixels, imageHeader{comment: "a comment", rule: gol.Conway}), name)
+		w, h, read, readFormat, err := readImageFile(path, "", width, height)
+		assert.NoError(t, err, name)
+		assert.Equal(t, []int{width, height}, []int{w, h}, name)
+		assert.Equal(t, pixels, read, name)
+		assert.Equal(t, f.extensions, readFormat.extensions, name)
+	}
+
+	// An empty world is read back, as an empty pattern for the formats which only hold alive cells
+	empty := make([]byte, width*height)
+	for name, f := range imageFormats {
+		path := filepath.Join(dir, "empty-"+name+f.extensions[0])
+		assert.NoError(t, writeImageFile(path, f, width, height, empty, imageHeader{rule: gol.Conway}), name)
+		w, h, read, _, err := readImageFile(path, "", width, height)
+		assert.NoError(t, err, name)
+		if f.pattern {
+			read, err = placePattern(width, height, w, h, read)
+			assert.NoError(t, err, name)
+		}
+		assert.Equal(t, empty, read, name)
+	}
+
+	// Patterns from elsewhere, with comments and rows left short
+	files := map[string]string{
+		"glider.cells": "!Name: Glider\n!\n.O\n..O\nOOO\n",
+		"glider.lif":   "#Life 1.06\n#D Glider\n1 0\n2 1\n0 2\n1 2\n2 2\n",
+		"glider.pbm":   "P1\n# Glider\n3 3\n010\n0 0 1\n111\n",
+	}
+	glider := []byte{0, 0xFF, 0, 0, 0, 0xFF, 0xFF, 0xFF, 0xFF}
+	for name, data := range files {
+		path := filepath.Join(dir, name)
+		assert.NoError(t, ioutil.WriteFile(path, []byte(data), 0644))
+		w, h, read, _, err := readImageFile(path, "", 16, 16)
+		assert.NoError(t, err, name)
+		assert.Equal(t, []int{3, 3}, []int{w, h}, name)
+		assert.Equal(t, glider, read, name)
+	}
+	// Cells left of and above 0,0 move the pattern
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(dir, "moved.life"), []byte("#Life 1.06\n-1 -2\n1 0\n"), 0644))
+	w, h, read, _, err := readImageFile(filepath.Join(dir, "moved.life"), "", 16, 16)
+	assert.NoError(t, err)
+	assert.Equal(t, []int{3, 3}, []int{w, h})
+	assert.Equal(t, []byte{0xFF, 0, 0, 0, 0, 0, 0, 0, 0xFF}, read)
+	// Patterns and images too big for the world or their data are refused before their pixels are made, however far
+	// apart their cells are
+	huge := map[string]string{
+		"far.life":     "0 0\n4000000000000 4000000000000\n",
+		"extreme.life": "-9223372036854775808 0\n9223372036854775807 0\n",
+		"wide.cells":   strings.Repeat(".", 17) + "O\n",
+		"huge.pbm":     "P4\n9223372036854775807 9223372036854775807\n\x00",
+		"short.pbm":    "P1\n16 16\n0101\n",
+		// Sizes whose product overflows to 0
+		"overflow.pbm": "P1\n4294967296 4294967296\n",
+		"overflow.pgm": "P5\n4294967296 4294967296\n255\n\x00",
+	}
+	for name, data := range huge {
+		path := filepath.Join(dir, name)
+		assert.NoError(t, ioutil.WriteFile(path, []byte(data), 0644))
+		_, _, _, _, err = readImageFile(path, "", 16, 16)
+		assert.Error(t, err, name)
+	}
+	assert.NoError(t, writeImageFile(filepath.Join(dir, "big.png"), imageFormats["png"], 32, 32, make([]byte, 32*32), imageHeader{}))
+	_, _, _, _, err = readImageFile(filepath.Join(dir, "big.png"), "", 16, 16)
+	assert.Error(t, err)
+
+	// A pattern starts at the top left of the world
+	sim, err := gol.New(gol.WithSize(16, 16), gol.WithCells([]gol.Cell{{X: 1, Y: 0}, {X: 2, Y: 1}, {X: 0, Y: 2}, {X: 1, Y: 2}, {X: 2, Y: 2}}))
+	assert.NoError(t, err)
+	assert.NoError(t, sim.Step(5))
+	var expected []cell
+	for _, c := range sim.AliveCells() {
+		expected = append(expected, cell{x: c.X, y: c.Y})
+	}
+	p := golParams{turns: 5, threads: 2, imageWidth: 16, imageHeight: 16, input: filepath.Join(dir, "glider.cells"), outputDir: dir}
+	alive, err := gameOfLife(context.Background(), p, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, expected, alive)
+	p.imageWidth, p.imageHeight = 2, 2
+	_, err = gameOfLife(context.Background(), p, nil)
+	assert.Error(t, err)
+
+	// Saving writes the format of -format
+	p = golParams{turns: 1000000, threads: 2, imageWidth: 16, imageHeight: 16, format: "pbm", outputDir: dir}
+	keys := make(chan rune, 1)
+	keys <- 'q'
+	_, err = gameOfLife(context.Background(), p, keys)
+	assert.NoError(t, err)
+	saved, err := filepath.Glob(filepath.Join(dir, "16x16_state_*.pbm"))
+	assert.NoError(t, err)
+	assert.Len(t, saved, 1)
+	data, err := ioutil.ReadFile(saved[0])
+	assert.NoError(t, err)
+	assert.Equal(t, "P4\n16 16\n", string(data[:9]))
+	assert.Len(t, data, 9+2*16)
+
+	_, err = formatByName("bmp")
+	assert.Error(t, err)
+}
+
+// Macrocell files load straight into a plane, however far apart their cells are, and are saved from its cells
+func TestMacrocell(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gol-macrocell")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	// A glider at the top of the top right leaf of a root of 16x16 cells centred on 0,0, so above 0,0
+	path := filepath.Join(dir, "glider.mc")
+	assert.NoError(t, ioutil.WriteFile(path, []byte("[M2] (golly 4.2)\n#R B3/S23\n.*$..*$***$\n4 0 1 0 0\n"), 0644))
+	w, h, read, f, err := readImageFile(path, "", 16, 16)
+	assert.NoError(t, err)
+	assert.Equal(t, "mc", f.name)
+	assert.Equal(t, []int{3, 3}, []int{w, h})
+	assert.Equal(t, []byte{0, 0xFF, 0, 0, 0, 0xFF, 0xFF, 0xFF, 0xFF}, read)
+
+	// A block and a glider a million cells apart, which could never be cropped into one world
+	cells := []gol.Cell{{X: 0, Y: 0}, {X: 1, Y: 0}, {X: 0, Y: 1}, {X: 1, Y: 1},
+		{X: 1000001, Y: 1000000}, {X: 1000002, Y: 1000001}, {X: 1000000, Y: 1000002}, {X: 1000001, Y: 1000002}, {X: 1000002, Y: 1000002}}
+	file, err := os.Create(filepath.Join(dir, "apart.mc"))
+	assert.NoError(t, err)
+	assert.NoError(t, gol.WriteMacrocell(file, cells, gol.Conway))
+	assert.NoError(t, file.Close())
+	p := golParams{turns: 4, threads: 2, imageWidth: 16, imageHeight: 16, topology: gol.Plane, engine: gol.Sparse,
+		input: filepath.Join(dir, "apart.mc"), format: "mc", outputDir: dir}
+	alive, err := gameOfLife(context.Background(), p, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, []cell{{0, 0}, {1, 0}, {0, 1}, {1, 1},
+		{1000002, 1000001}, {1000003, 1000002}, {1000001, 1000003}, {1000002, 1000003}, {1000003, 1000003}}, alive)
+
+	// Saving writes the cells where they are, named after the size of the smallest world holding them
+	p.turns = 1000000
+	keys := make(chan rune, 1)
+	keys <- 'q'
+	alive, err = gameOfLife(context.Background(), p, keys)
+	assert.NoError(t, err)
+	saved, err := filepath.Glob(filepath.Join(dir, "*_state_*.mc"))
+	assert.NoError(t, err)
+	assert.Len(t, saved, 1)
+	data, err := os.Open(saved[0])
+	assert.NoError(t, err)
+	defer data.Close()
+	cells, rule, err := gol.ReadMacrocell(data)
+	assert.NoError(t, err)
+	assert.Equal(t, gol.Conway, rule)
+	var expected []gol.Cell
+	for _, c := range alive {
+		expected = append(expected, gol.Cell{X: c.x, Y: c.y})
+	}
+	assert.ElementsMatch(t, expected, cells)
+}
+
+// The io goroutine sends images a row at a time and takes worlds to write whole
+func TestIoTransfers(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gol-io")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	command, idle, filename, inputErr := make(chan ioCommand), make(chan error), make(chan string), make(chan error)
+	input, output := make(chan []byte), make(chan ioImage)
+	d := distributorChans{io: distributorToIo{command: command, idle: idle, filename: filename, inputErr: inputErr, input: input, output: output}}
+	i := ioChans{distributor: ioToDistributor{command: command, idle: idle, filename: filename, inputErr: inputErr, input: input, output: output}}
+	p := golParams{imageWidth: 64, imageHeight: 64, outputDir: dir}
+	go pgmIo(ctx, p, i)
+
+	cells, err := readWorld(ctx, p, d)
+	assert.NoError(t, err)
+	width, height, pixels, err := readPgm("images/64x64.pgm")
+	assert.NoError(t, err)
+	world := make([][]byte, height)
+	for y := range world {
+		world[y] = pixels[y*width : (y+1)*width]
+	}
+	var expected []gol.Cell
+	for y, row := range world {
+		for x, c := range row {
+			if c != 0 {
+				expected = append(expected, gol.Cell{X: x, Y: y})
+			}
+		}
+	}
+	assert.Equal(t, expected, cells)
+
+	assert.NoError(t, outputWorld(ctx, p, 7, d, world))
+	assert.NoError(t, checkIdle(ctx, d))
+	_, _, written, err := readPgm(filepath.Join(dir, "64x64_state_7.pgm"))
+	assert.NoError(t, err)
+	assert.Equal(t, pixels, written)
 }
@@ -1,111 +1,175 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"io/ioutil"
 	"os"
-	"strconv"
-	"strings"
+	"path/filepath"
+	"uk.ac.bris.cs/gameoflife/gol"
 )
 
-func check(e error) {
-	if e != nil {
-		panic(e)
+// writeImage receives the world and writes it in the format p.format, through a buffer.
+// The world is received before anything is written, so the distributor carries on while the file is written,
+// and is not left waiting when it cannot be.
+func writeImage(p golParams, i ioChans) error {
+	image := <-i.distributor.output
+	filename := image.filename
+	width, height := len(image.world[0]), len(image.world)
+	pixels := make([]byte, 0, width*height)
+	for _, row := range image.world {
+		pixels = append(pixels, row...)
 	}
-}
-
-// writePgmImage receives an array of bytes and writes it to a pgm file.
-// Note that this function is incomplete. Use the commented-out for loop to receive data from the distributor.
-func writePgmImage(p golParams, i ioChans) {
-	_ = os.Mkdir("out", os.ModePerm)
-
-	filename := <-i.distributor.filename
-	file, ioError := os.Create("out/" + filename + ".pgm")
-	check(ioError)
-	defer file.Close()
-
-	_, _ = file.WriteString("P5\n")
-	//_, _ = file.WriteString("# PGM file writer by pnmmodules (https://github.com/owainkenwayucl/pnmmodules).\n")
-	_, _ = file.WriteString(strconv.Itoa(p.imageWidth))
-	_, _ = file.WriteString(" ")
-	_, _ = file.WriteString(strconv.Itoa(p.imageHeight))
-	_, _ = file.WriteString("\n")
-	_, _ = file.WriteString(strconv.Itoa(255))
-	_, _ = file.WriteString("\n")
 
-	world := make([][]byte, p.imageHeight)
-	for i := range world {
-		world[i] = make([]byte, p.imageWidth)
+	f, ioError := formatByName(p.format)
+	if ioError != nil {
+		return ioError
 	}
-
-	// Receives the world from the distributor
-	for x := 0; x < p.imageHeight; x++ {
-		for y := 0; y < p.imageWidth; y++ {
-			world[x][y] = <-i.distributor.world
-		}
+	dir := "out"
+	if p.outputDir != "" {
+		dir = p.outputDir
 	}
-
-	for y := 0; y < p.imageHeight; y++ {
-		for x := 0; x < p.imageWidth; x++ {
-			_, ioError = file.Write([]byte{world[y][x]})
-			check(ioError)
-		}
+	ioError = os.MkdirAll(dir, os.ModePerm)
+	if ioError != nil {
+		return ioError
+	}
+	header := imageHeader{rule: gol.Conway}
+	if p.rule != nil {
+		header.rule = *p.rule
+	}
+	// Records how to make the soup the world started from again
+	if p.soup != nil {
+		header.comment = p.soup.String()
+	}
+	ioError = writeImageFile(filepath.Join(dir, filename+f.extensions[0]), f, width, height, pixels, header)
+	if ioError != nil {
+		return ioError
 	}
-
-	ioError = file.Sync()
-	check(ioError)
 
 	fmt.Println("File", filename, "output done!")
+	return nil
 }
 
-// readPgmImage opens a pgm file and sends its data as an array of bytes.
-func readPgmImage(p golParams, i ioChans) {
+// readImage opens an image in the format of its extension, or p.format, and sends its data as an array of bytes.
+// A pattern smaller than the world is placed at its top left.
+// It first sends whether the file could be read, and only sends the data, a row at a time, if it could.
+func readImage(p golParams, i ioChans) {
 	filename := <-i.distributor.filename
-	data, ioError := ioutil.ReadFile("images/" + filename + ".pgm")
-	check(ioError)
-
-	fields := strings.Fields(string(data))
-
-	if fields[0] != "P5" {
-		panic("Not a pgm file")
-	}
-
-	width, _ := strconv.Atoi(fields[1])
-	if width != p.imageWidth {
-		panic("Incorrect width")
+	path := "images/" + filename + ".pgm"
+	if p.input != "" {
+		path = p.input
 	}
-
-	height, _ := strconv.Atoi(fields[2])
-	if height != p.imageHeight {
-		panic("Incorrect height")
+	width, height, image, f, ioError := readImageFile(path, p.format, p.imageWidth, p.imageHeight)
+	if ioError == nil && f.pattern {
+		image, ioError = placePattern(p.imageWidth, p.imageHeight, width, height, image)
+		if ioError != nil {
+			ioError = fmt.Errorf("%s: %v", path, ioError)
+		}
+	} else if ioError == nil && (width != p.imageWidth || height != p.imageHeight) {
+		ioError = fmt.Errorf("%s is %dx%d, not %dx%d", path, width, height, p.imageWidth, p.imageHeight)
 	}
-
-	maxval, _ := strconv.Atoi(fields[3])
-	if maxval != 255 {
-		panic("Incorrect maxval/bit depth")
+	i.distributor.inputErr <- ioError
+	if ioError != nil {
+		return
 	}
 
-	image := []byte(fields[4])
-
-	for _, b := range image {
-		i.distributor.inputVal <- b
+	for y := 0; y < p.imageHeight; y++ {
+		i.distributor.input <- image[y*p.imageWidth : (y+1)*p.imageWidth]
 	}
 
 	fmt.Println("File", filename, "input done!")
 }
 
-func pgmIo(p golParams, i ioChans) {
+// pgmIo serves commands from the distributor until ctx is cancelled.
+// Commands which have started are always finished, so the distributor only has to watch ctx while sending a command.
+func pgmIo(ctx context.Context, p golParams, i ioChans) {
+	var writeError error
 	for {
 		select {
+		case <-ctx.Done():
+			return
 		case command := <-i.distributor.command:
 			switch command {
 			case ioInput:
-				readPgmImage(p, i)
+				readImage(p, i)
 			case ioOutput:
-				writePgmImage(p, i)
+				err := writeImage(p, i)
+				if err != nil {
+					fmt.Println("err", err)
+					if writeError == nil {
+						writeError = err
+					}
+				}
 			case ioCheckIdle:
-				i.distributor.idle <- true
+				i.distributor.idle <- writeError
+				writeError = nil
 			}
 		}
 	}
 }
+
+// Reads a pgm file, returning its width, height and pixels
+func readPgm(path string) (int, int, []byte, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return 0, 0, nil, err
+	}
+	width, height, pixels, err := readPgmData(data)
+	if err != nil {
+		return 0, 0, nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return width, height, pixels, nil
+}
+
+// Returns the width and height of a pgm file, or why it cannot be read
+func pgmSize(path string) (int, int, error) {
+	width, height, _, err := readPgm(path)
+	return width, height, err
+}
+
+// Moves alive cells anywhere on a plane so the top left one is at 0,0,
+// and returns the size of the smallest image holding them
+func cropCells(alive []cell) (int, int, []cell) {
+	if len(alive) == 0 {
+		return 1, 1, nil
+	}
+	min, max := alive[0], alive[0]
+	for _, c := range alive {
+		if c.x < min.x {
+			min.x = c.x
+		}
+		if c.y < min.y {
+			min.y = c.y
+		}
+		if c.x > max.x {
+			max.x = c.x
+		}
+		if c.y > max.y {
+			max.y = c.y
+		}
+	}
+	cropped := make([]cell, len(alive))
+	for i, c := range alive {
+		cropped[i] = cell{x: c.x - min.x, y: c.y - min.y}
+	}
+	return max.x - min.x + 1, max.y - min.y + 1, cropped
+}
+
+// Returns the pixels of an image of the given size, with the alive cells set
+func cellPixels(width, height int, alive []cell) []byte {
+	pixels := make([]byte, width*height)
+	for _, c := range alive {
+		pixels[c.y*width+c.x] = 0xFF
+	}
+	return pixels
+}
+
+// Writes a pgm file of the given size, with the alive cells set
+func writePgm(path string, width, height int, alive []cell) error {
+	return writePgmPixels(path, width, height, cellPixels(width, height, alive))
+}
+
+// Writes a pgm file of the given size with its pixels, row by row
+func writePgmPixels(path string, width, height int, pixels []byte) error {
+	return writeImageFile(path, imageFormats["pgm"], width, height, pixels, imageHeader{})
+}
@@ -0,0 +1,137 @@
+package protocol
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// Compress packs cells into bits, set for alive cells, then run-length encodes the bits with PackBits.
+// A sparse world becomes a few bytes per run of dead cells instead of one byte per cell.
+// The result starts with the number of cells, as a varint.
+func Compress(cells []byte) []byte {
+	header := make([]byte, binary.MaxVarintLen64)
+	n := binary.PutUvarint(header, uint64(len(cells)))
+
+	bits := make([]byte, (len(cells)+7)/8)
+	for i, c := range cells {
+		if c != 0 {
+			bits[i/8] |= 1 << uint(i%8)
+		}
+	}
+	return packBits(header[:n], bits)
+}
+
+// Decompress reverses Compress, alive cells become 0xFF. The data has to hold count cells, and is refused
+// as soon as it holds more, so a peer cannot make it unpack more than the world it is expected to send.
+func Decompress(data []byte, count int) ([]byte, error) {
+	if count < 0 {
+		return nil, fmt.Errorf("cannot decompress %d cells", count)
+	}
+	sent, n := binary.Uvarint(data)
+	if n <= 0 {
+		return nil, errors.New("compressed data has no cell count")
+	}
+	if sent != uint64(count) {
+		return nil, fmt.Errorf("compressed data has %d cells instead of %d", sent, count)
+	}
+
+	bits, err := unpackBits(data[n:], (count+7)/8)
+	if err != nil {
+		return nil, err
+	}
+	if len(bits) != (count+7)/8 {
+		return nil, errors.New("compressed data has the wrong number of cells")
+	}
+
+	cells := make([]byte, count)
+	for i := range cells {
+		if bits[i/8]&(1<<uint(i%8)) != 0 {
+			cells[i] = 0xFF
+		}
+	}
+	return cells, nil
+}
+
+// Appends src to dst, run-length encoded.
+// Each block starts with a header byte n: 0 to 127 is followed by n+1 literal bytes,
+// -1 to -127 is followed by one byte repeated 1-n times.
+func packBits(dst, src []byte) []byte {
+	for i := 0; i < len(src); {
+		// Length of the run starting at i
+		run := 1
+		for i+run < len(src) && run < 128 && src[i+run] == src[i] {
+			run++
+		}
+		if run > 1 {
+			dst = append(dst, byte(int8(1-run)), src[i])
+			i += run
+			continue
+		}
+
+		// Literal bytes, up to the start of the next run
+		start := i
+		for i < len(src) && i-start < 128 && (i+1 == len(src) || src[i] != src[i+1]) {
+			i++
+		}
+		dst = append(dst, byte(i-start-1))
+		dst = append(dst, src[start:i]...)
+	}
+	return dst
+}
+
+// Reverses packBits, refusing src if it unpacks to more than limit bytes
+func unpackBits(src []byte, limit int) ([]byte, error) {
+	dst := make([]byte, 0, limit)
+	for i := 0; i < len(src); {
+		n := int(int8(src[i]))
+		i++
+		switch {
+		case n >= 0:
+			if i+n+1 > len(src) {
+				return nil, errors.New("literal block is cut short")
+			}
+			if len(dst)+n+1 > limit {
+				return nil, errors.New("compressed data unpacks to more cells than it holds")
+			}
+			dst = append(dst, src[i:i+n+1]...)
+			i += n + 1
+		case n != -128:
+			if i >= len(src) {
+				return nil, errors.New("run block is cut short")
+			}
+			if len(dst)+1-n > limit {
+				return nil, errors.New("compressed data unpacks to more cells than it holds")
+			}
+			for j := 0; j < 1-n; j++ {
+				dst = append(dst, src[i])
+			}
+			i++
+		}
+	}
+	return dst, nil
+}
+
+// Flatten joins the rows of a world into one slice
+func Flatten(world [][]byte) []byte {
+	var cells []byte
+	for _, row := range world {
+		cells = append(cells, row...)
+	}
+	return cells
+}
+
+// Unflatten splits cells back into rows of the given width, which has to divide them into whole rows
+func Unflatten(cells []byte, width int) ([][]byte, error) {
+	if width <= 0 {
+		return nil, fmt.Errorf("rows cannot be %d cells wide", width)
+	}
+	if len(cells)%width != 0 {
+		return nil, fmt.Errorf("%d cells do not split into rows of %d", len(cells), width)
+	}
+	world := make([][]byte, 0, len(cells)/width)
+	for i := 0; i < len(cells); i += width {
+		world = append(world, cells[i:i+width])
+	}
+	return world, nil
+}
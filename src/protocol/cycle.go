@@ -0,0 +1,54 @@
+package protocol
+
+// Cell is the position of a cell, in column X and row Y
+type Cell struct {
+	X, Y int
+}
+
+// CellHash returns the hash of the cell in column x and row y. The hash of a world is the XOR of the hashes of its
+// alive cells, so workers can hash their own tiles and combine them in any order, and it can be updated from the cells
+// which flipped.
+func CellHash(x, y int) uint64 {
+	// SplitMix64 of the position
+	z := uint64(uint32(x))<<32 | uint64(uint32(y))
+	z += 0x9E3779B97F4A7C15
+	z = (z ^ (z >> 30)) * 0xBF58476D1CE4E5B9
+	z = (z ^ (z >> 27)) * 0x94D049BB133111EB
+	return z ^ (z >> 31)
+}
+
+// Cycles finds the first turn whose world repeats an earlier one, from the hash and population of the world of every
+// turn. Every turn is recorded until then, so a world which runs for long before it stabilises keeps one per turn.
+// The zero value is ready to use.
+type Cycles struct {
+	Start  int // First turn of the cycle, once found
+	Period int // Turns before the world repeats, 0 until found
+	seen   map[fingerprint]int
+}
+
+// Tells worlds apart. Two worlds are only taken to be the same when both their hash and population match,
+// so turns are not skipped on a collision of the hashes of worlds with different numbers of alive cells.
+type fingerprint struct {
+	hash       uint64
+	population int
+}
+
+// Record records the world of a turn by its hash and population.
+// Returns true if it is the first turn to repeat an earlier world.
+func (c *Cycles) Record(turn int, hash uint64, population int) bool {
+	if c.Period != 0 {
+		return false
+	}
+	if c.seen == nil {
+		c.seen = make(map[fingerprint]int)
+	}
+	f := fingerprint{hash, population}
+	first, seen := c.seen[f]
+	if !seen {
+		c.seen[f] = turn
+		return false
+	}
+	c.Start, c.Period = first, turn-first
+	c.seen = nil
+	return true
+}
@@ -0,0 +1,189 @@
+// Package protocol is spoken between the distributor and its clients, which run the workers.
+// It holds the messages and handshake, with the compression, TLS and rules they carry.
+package protocol
+
+import (
+	"encoding/gob"
+	"fmt"
+)
+
+// Name names the protocol, so connections from other programs are refused
+const Name = "gameoflife"
+
+// Version is the version of the protocol. Builds speaking different versions refuse to work together,
+// so it has to be increased whenever a message changes.
+const Version = 5
+
+// Optional features, used on a connection only when both ends support them
+const (
+	CompressionCapability = "compression" // Worlds and halos are compressed
+)
+
+// Hello is the first message on every connection, sent by the end which connected
+type Hello struct {
+	Protocol     string
+	Version      int
+	Capabilities []string
+	Client       int    // Index of the connecting client, on connections between clients
+	Job          int    // Job the halos are for, on connections between clients
+	Token        string // Secret proving the connection may join. It is only hidden from the network with TLS.
+}
+
+// Welcome is the reply to a hello. Error says why the connection is refused,
+// otherwise Capabilities are the ones both ends will use.
+type Welcome struct {
+	Version      int
+	Capabilities []string
+	Error        string
+}
+
+// MessageKind is the kind of a message sent between the distributor and clients after the handshake
+type MessageKind int
+
+const (
+	InitMessage     MessageKind = iota + 1 // Distributor to client: start a job, Init is set
+	AssignMessage                          // Distributor to client: tile of one worker, Assign is set
+	ReadyMessage                           // Client to distributor: listening for halo connections. Distributor to client: all clients are
+	CommandMessage                         // Distributor to worker: Data is a command, or the turn to stop after
+	StatusMessage                          // Worker to distributor: Data is a turn, pause, or the number of alive cells
+	WorldMessage                           // Worker to distributor: World or Packed is set
+	DoneMessage                            // Worker to distributor: all turns are done
+	ShutdownMessage                        // Distributor to client: the job is over. Client to distributor: its resources are free
+	RejectMessage                          // Client to distributor: the job was refused or has failed, Error says why
+	ReportMessage                          // Worker to distributor: its tile after a turn, Report is set
+)
+
+// Message is the envelope of every message after the handshake.
+// A connection carries the messages of every job the distributor runs on the client, told apart by Job.
+type Message struct {
+	Kind   MessageKind
+	Job    int
+	Worker int // Worker the message is for or from
+	Data   int
+	Init   *InitPackage
+	Assign *WorkerPackage
+	World  [][]byte
+	Packed []byte // Compressed World, sent instead of World on compressed connections
+	Report *TurnReport
+	Error  string
+}
+
+// InitPackage starts a job on a client
+type InitPackage struct {
+	Clients int
+	Workers int
+	Index   int      // Index of the client receiving the package
+	Ips     []string // Ip of every client
+	Owners  []int    // Client running each worker
+	Turns   int
+	Depth   int            // Rows of halo exchanged at once
+	Peers   map[int]string // Secret shared with each client this one exchanges halos with
+	Rule    Rule
+	Reports Reports // What workers report after every turn
+}
+
+// Reports says what workers send the distributor after every turn
+type Reports int
+
+const (
+	NoReports    Reports = iota
+	CountReports         // The population, hash, births, deaths and bounds of the tile
+	FlipReports          // The counts, and the cells which flipped
+)
+
+// TurnReport is what changed in the tile of a worker in a turn. The distributor combines the reports of every worker
+// into those of the world: the populations, births and deaths add up, the bounds join and the hashes are XORed.
+type TurnReport struct {
+	Turn       int
+	Population int
+	Hash       uint64 // XOR of CellHash of every alive cell
+	Births     int
+	Deaths     int
+	Min, Max   Cell   // Bounds of the alive cells, when there are any
+	Flipped    []Cell // Cells which flipped, with FlipReports
+}
+
+// WorkerPackage is the tile of one worker, and where its neighbours are
+type WorkerPackage struct {
+	StartX     int
+	EndX       int
+	StartY     int
+	EndY       int
+	World      [][]byte // Tile surrounded by Depth rows of halo
+	Packed     []byte   // Compressed World, sent instead of World on compressed connections
+	Index      int
+	Neighbours [8]int // Worker in each halo direction
+}
+
+// Capabilities returns the capabilities of this build, leaving out the ones turned off by flags
+func Capabilities(compression bool) []string {
+	var c []string
+	if compression {
+		c = append(c, CompressionCapability)
+	}
+	return c
+}
+
+// HasCapability returns true if capability is in the list
+func HasCapability(capabilities []string, capability string) bool {
+	for _, c := range capabilities {
+		if c == capability {
+			return true
+		}
+	}
+	return false
+}
+
+// SendHello sends a hello on a new connection, filling in the protocol and version, and waits for the welcome.
+// Returns the capabilities both ends will use, or an error if the other end refused the connection.
+func SendHello(encoder *gob.Encoder, decoder *gob.Decoder, h Hello) ([]string, error) {
+	h.Protocol = Name
+	h.Version = Version
+	err := encoder.Encode(h)
+	if err != nil {
+		return nil, fmt.Errorf("handshake failed: %v", err)
+	}
+
+	var w Welcome
+	err = decoder.Decode(&w)
+	if err != nil {
+		return nil, fmt.Errorf("handshake failed, the other end may be an older build: %v", err)
+	}
+	if w.Error != "" {
+		return nil, fmt.Errorf("connection refused: %s", w.Error)
+	}
+	if w.Version != Version {
+		return nil, fmt.Errorf("protocol version %d is not supported, the distributor and clients must all use version %d", w.Version, Version)
+	}
+	return w.Capabilities, nil
+}
+
+// AcceptHello waits for the hello on an accepted connection and answers it. authorise returns why a hello is refused, or nil.
+// Returns the hello and the capabilities both ends will use, or an error if the connection is refused.
+func AcceptHello(encoder *gob.Encoder, decoder *gob.Decoder, capabilities []string, authorise func(Hello) error) (Hello, []string, error) {
+	var h Hello
+	err := decoder.Decode(&h)
+	if err != nil {
+		return h, nil, fmt.Errorf("handshake failed, the other end may be an older build: %v", err)
+	}
+
+	if h.Protocol != Name {
+		err = fmt.Errorf("unknown protocol %q", h.Protocol)
+	} else if h.Version != Version {
+		err = fmt.Errorf("protocol version %d is not supported, the distributor and clients must all use version %d", h.Version, Version)
+	} else {
+		err = authorise(h)
+	}
+	if err != nil {
+		_ = encoder.Encode(Welcome{Version: Version, Error: err.Error()})
+		return h, nil, err
+	}
+
+	var shared []string
+	for _, c := range capabilities {
+		if HasCapability(h.Capabilities, c) {
+			shared = append(shared, c)
+		}
+	}
+	return h, shared, encoder.Encode(Welcome{Version: Version, Capabilities: shared})
+}
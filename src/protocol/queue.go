@@ -0,0 +1,36 @@
+package protocol
+
+// Queue passes the messages sent on the returned channel to out in order, holding the ones out is not ready for.
+// Sending on the returned channel never waits for out, so a job which has stalled
+// does not hold up the other jobs sharing its connection.
+// Closing the returned channel closes out once the held messages are passed on, closing stop drops them.
+func Queue(out chan<- Message, stop <-chan struct{}) chan<- Message {
+	queue := make(chan Message)
+	go func() {
+		in := (<-chan Message)(queue)
+		var held []Message
+		for in != nil || len(held) > 0 {
+			// Only offer a message to out when one is held
+			var next chan<- Message
+			var first Message
+			if len(held) > 0 {
+				next, first = out, held[0]
+			}
+
+			select {
+			case m, open := <-in:
+				if !open {
+					in = nil
+					continue
+				}
+				held = append(held, m)
+			case next <- first:
+				held = held[1:]
+			case <-stop:
+				return
+			}
+		}
+		close(out)
+	}()
+	return queue
+}
@@ -0,0 +1,70 @@
+package protocol
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Rule is a life-like rule, saying for which numbers of alive neighbours a dead cell is born and an alive cell survives
+type Rule struct {
+	Born    [9]bool
+	Survive [9]bool
+}
+
+// Conway is the rule of Conway's Game of Life, B3/S23
+var Conway = Rule{
+	Born:    [9]bool{3: true},
+	Survive: [9]bool{2: true, 3: true},
+}
+
+// ParseRule parses a rule in B/S notation, such as B3/S23 for Conway's Game of Life or B36/S23 for HighLife.
+// The S/B notation without letters, such as 23/3, is also accepted.
+func ParseRule(s string) (Rule, error) {
+	var r Rule
+	parts := strings.Split(strings.ToUpper(strings.TrimSpace(s)), "/")
+	if len(parts) != 2 {
+		return r, fmt.Errorf("rule %q is not in B/S notation", s)
+	}
+
+	born, survive := parts[0], parts[1]
+	if strings.HasPrefix(survive, "B") || strings.HasPrefix(born, "S") {
+		born, survive = survive, born
+	} else if !strings.HasPrefix(born, "B") && !strings.HasPrefix(survive, "S") {
+		// S/B notation
+		born, survive = "B"+survive, "S"+born
+	}
+	if !strings.HasPrefix(born, "B") || !strings.HasPrefix(survive, "S") {
+		return r, fmt.Errorf("rule %q is not in B/S notation", s)
+	}
+
+	for _, c := range born[1:] {
+		if c < '0' || c > '8' {
+			return r, fmt.Errorf("rule %q has an invalid neighbour count %q", s, c)
+		}
+		r.Born[c-'0'] = true
+	}
+	for _, c := range survive[1:] {
+		if c < '0' || c > '8' {
+			return r, fmt.Errorf("rule %q has an invalid neighbour count %q", s, c)
+		}
+		r.Survive[c-'0'] = true
+	}
+	return r, nil
+}
+
+// String returns the rule in B/S notation
+func (r Rule) String() string {
+	b := []byte("B")
+	for n, born := range r.Born {
+		if born {
+			b = append(b, byte('0'+n))
+		}
+	}
+	b = append(b, "/S"...)
+	for n, survive := range r.Survive {
+		if survive {
+			b = append(b, byte('0'+n))
+		}
+	}
+	return string(b)
+}
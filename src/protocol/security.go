@@ -0,0 +1,68 @@
+package protocol
+
+import (
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io/ioutil"
+	"net"
+	"time"
+)
+
+// LoadTLS loads the certificate of this machine, and the CA which signs the certificates of every machine.
+// Both ends of every connection have to present a certificate signed by the CA.
+// Returns nil when no files are given, as connections then use plain TCP.
+func LoadTLS(certFile, keyFile, caFile string) (*tls.Config, error) {
+	if certFile == "" && keyFile == "" && caFile == "" {
+		return nil, nil
+	}
+	if certFile == "" || keyFile == "" || caFile == "" {
+		return nil, errors.New("TLS needs a certificate, a key and a CA")
+	}
+
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+	ca, err := ioutil.ReadFile(caFile)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(ca) {
+		return nil, errors.New("no certificates found in " + caFile)
+	}
+
+	return &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		RootCAs:      pool,
+		ClientCAs:    pool,
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		MinVersion:   tls.VersionTLS12,
+	}, nil
+}
+
+// Listen listens on addr, with TLS if config is set
+func Listen(addr string, config *tls.Config) (net.Listener, error) {
+	if config == nil {
+		return net.Listen("tcp4", addr)
+	}
+	return tls.Listen("tcp4", addr, config)
+}
+
+// Used for every outgoing connection
+var dialer = net.Dialer{Timeout: 10 * time.Second}
+
+// Dial connects to addr, with TLS if config is set. The certificate of the other end has to name its host.
+func Dial(addr string, config *tls.Config) (net.Conn, error) {
+	if config == nil {
+		return dialer.Dial("tcp4", addr)
+	}
+	return tls.DialWithDialer(&dialer, "tcp4", addr, config)
+}
+
+// ValidToken returns true if token is the expected one, taking the same time however they differ
+func ValidToken(token, expected string) bool {
+	return subtle.ConstantTimeCompare([]byte(token), []byte(expected)) == 1
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"image/gif"
+	"image/png"
+	"os"
+	"path/filepath"
+	"strconv"
+	"uk.ac.bris.cs/gameoflife/gol"
+)
+
+// Delay between the frames of a gif, in hundredths of a second
+const frameDelay = 10
+
+// Frames buffered for the recorder before the workers wait for it
+const frameBuffer = 4
+
+// Colours of dead and alive cells in the frames
+var framePalette = color.Palette{color.Black, color.White}
+
+// Records every few turns of a run as an animated gif, kept until the run ends, or as numbered png files
+type recorder struct {
+	crop  image.Rectangle // Cells recorded
+	scale int             // Pixels per cell
+	dir   string          // Directory of the png files, empty for a gif
+	gif   *gif.GIF        // Frames so far, nil for png files
+	err   error           // First error writing a frame
+}
+
+// Returns an error unless format is one frames can be recorded in, or empty for none
+func checkRecordFormat(format string) error {
+	if format != "" && format != "gif" && format != "png" {
+		return fmt.Errorf("unknown recording format %q, expected gif or png", format)
+	}
+	return nil
+}
+
+// Returns the cells given by x,y,width,height
+func parseCrop(text string) (image.Rectangle, error) {
+	var x, y, width, height int
+	_, err := fmt.Sscanf(text, "%d,%d,%d,%d", &x, &y, &width, &height)
+	if err != nil || width < 1 || height < 1 {
+		return image.Rectangle{}, fmt.Errorf("crop %q is not x,y,width,height", text)
+	}
+	return image.Rect(x, y, x+width, y+height), nil
+}
+
+// Starts recording the frames of sim in the format p.record, next to the images, beginning with the current turn.
+// Returns a function which waits for the frames of the turns already run, writes any gif and returns the first error.
+func startRecording(p golParams, sim *gol.Simulation) (stop func() error, path string, err error) {
+	r := &recorder{crop: p.crop, scale: p.scale}
+	if r.crop.Empty() {
+		if p.topology == gol.Plane {
+			return nil, "", fmt.Errorf("a plane has no edges, so it can only be recorded with a crop")
+		}
+		r.crop = image.Rect(0, 0, p.imageWidth, p.imageHeight)
+	}
+	if r.scale < 1 {
+		r.scale = 1
+	}
+
+	dir := "out"
+	if p.outputDir != "" {
+		dir = p.outputDir
+	}
+	name := filepath.Join(dir, strconv.Itoa(p.imageWidth)+"x"+strconv.Itoa(p.imageHeight)+"_frames")
+	if p.record == "gif" {
+		r.gif = &gif.GIF{}
+		path = name + ".gif"
+		err = os.MkdirAll(dir, os.ModePerm)
+	} else {
+		r.dir = name
+		path = name
+		err = os.MkdirAll(r.dir, os.ModePerm)
+	}
+	if err != nil {
+		return nil, "", err
+	}
+
+	snapshot := sim.Snapshot()
+	r.add(snapshot.Turn, snapshot.World, snapshot.Origin)
+	unsubscribe := sim.Subscribe(gol.ObserverFunc(func(e gol.Event) {
+		if frame, ok := e.(gol.Frame); ok {
+			r.add(frame.Turn, frame.World, frame.Origin)
+		}
+	}), gol.Block, frameBuffer)
+
+	return func() error {
+		unsubscribe()
+		if r.err != nil || r.gif == nil {
+			return r.err
+		}
+		file, err := os.Create(path)
+		if err != nil {
+			return err
+		}
+		err = gif.EncodeAll(file, r.gif)
+		if closeErr := file.Close(); err == nil {
+			err = closeErr
+		}
+		return err
+	}, path, nil
+}
+
+// Adds the frame of a turn, with the top left cell of world at origin, unless an earlier frame failed
+func (r *recorder) add(turn int, world [][]byte, origin gol.Cell) {
+	if r.err != nil {
+		return
+	}
+	img := r.render(world, origin)
+	if r.gif != nil {
+		r.gif.Image = append(r.gif.Image, img)
+		r.gif.Delay = append(r.gif.Delay, frameDelay)
+		return
+	}
+
+	file, err := os.Create(filepath.Join(r.dir, fmt.Sprintf("%06d.png", turn)))
+	if err != nil {
+		r.err = err
+		return
+	}
+	r.err = png.Encode(file, img)
+	if err := file.Close(); r.err == nil {
+		r.err = err
+	}
+}
+
+// Draws the cropped cells of a world with its top left cell at origin, each as a square of scale pixels.
+// Cells beyond the world are dead.
+func (r *recorder) render(world [][]byte, origin gol.Cell) *image.Paletted {
+	img := image.NewPaletted(image.Rect(0, 0, r.crop.Dx()*r.scale, r.crop.Dy()*r.scale), framePalette)
+	for y := r.crop.Min.Y; y < r.crop.Max.Y; y++ {
+		row := y - origin.Y
+		if row < 0 || row >= len(world) {
+			continue
+		}
+		for x := r.crop.Min.X; x < r.crop.Max.X; x++ {
+			column := x - origin.X
+			if column < 0 || column >= len(world[row]) || world[row][column] != 0xFF {
+				continue
+			}
+			left, top := (x-r.crop.Min.X)*r.scale, (y-r.crop.Min.Y)*r.scale
+			for py := top; py < top+r.scale; py++ {
+				for px := left; px < left+r.scale; px++ {
+					img.Pix[py*img.Stride+px] = 1
+				}
+			}
+		}
+	}
+	return img
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"uk.ac.bris.cs/gameoflife/gol"
+)
+
+// Turns after which a soup of a search which is still changing is given up on
+const searchTurns = 20000
+
+// Soups kept in each list of the hall of fame
+const searchKeep = 10
+
+// Searches soups starting from p.soup, then prints the hall of fame and writes it as text and JSON
+func runSearch(p golParams, soups int) error {
+	search := gol.Search{Soups: soups, Soup: *p.soup, Rule: gol.Conway, Threads: p.threads, MaxTurns: searchTurns, Keep: searchKeep}
+	if p.rule != nil {
+		search.Rule = *p.rule
+	}
+	fmt.Println("Searching", soups, "soups, starting from a", p.soup)
+	h, err := search.Run(context.Background())
+	if err != nil {
+		return err
+	}
+	fmt.Print(h)
+
+	paths, err := writeSearch(p, h)
+	if err != nil {
+		return err
+	}
+	fmt.Println("Hall of fame written to", paths[0], "and", paths[1])
+	return nil
+}
+
+// Writes the hall of fame of a search as text and JSON, named by the seed of its first soup.
+// Returns the paths of the files.
+func writeSearch(p golParams, h *gol.HallOfFame) ([]string, error) {
+	dir := "out"
+	if p.outputDir != "" {
+		dir = p.outputDir
+	}
+	err := os.MkdirAll(dir, os.ModePerm)
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := json.MarshalIndent(h, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	name := filepath.Join(dir, "search_"+strconv.FormatInt(p.soup.Seed, 10))
+	paths := []string{name + ".txt", name + ".json"}
+	err = ioutil.WriteFile(paths[0], []byte(h.String()), 0644)
+	if err != nil {
+		return nil, err
+	}
+	return paths, ioutil.WriteFile(paths[1], append(data, '\n'), 0644)
+}
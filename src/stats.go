@@ -0,0 +1,123 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"uk.ac.bris.cs/gameoflife/gol"
+)
+
+// Statistics buffered for the writer before the workers wait for it
+const statsBuffer = 64
+
+// A row of the statistics written as JSON lines. Bounds is left out when no cells are alive.
+type statsRow struct {
+	Turn       int         `json:"turn"`
+	Population int         `json:"population"`
+	Births     int         `json:"births"`
+	Deaths     int         `json:"deaths"`
+	Bounds     *statsBound `json:"bounds,omitempty"`
+	Density    float64     `json:"density"`
+}
+
+type statsBound struct {
+	MinX int `json:"min_x"`
+	MinY int `json:"min_y"`
+	MaxX int `json:"max_x"`
+	MaxY int `json:"max_y"`
+}
+
+// Writes the statistics of a run to a file, one row per turn as the turns run
+type statsWriter struct {
+	file    *os.File
+	csv     *csv.Writer   // Writer of the rows as CSV, nil for JSON lines
+	encoder *json.Encoder // Writer of the rows as JSON lines, nil for CSV
+	err     error         // First error writing a row
+}
+
+// Starts writing the statistics of sim as it runs, in the format p.stats, next to the images.
+// Writes the statistics of the current turn first, so the file starts from the world before the run.
+// Returns a function which waits for the rows of the turns already run, closes the file and returns the first error.
+func recordStats(p golParams, sim *gol.Simulation) (stop func() error, path string, err error) {
+	dir := "out"
+	if p.outputDir != "" {
+		dir = p.outputDir
+	}
+	err = os.MkdirAll(dir, os.ModePerm)
+	if err != nil {
+		return nil, "", err
+	}
+	path = filepath.Join(dir, strconv.Itoa(p.imageWidth)+"x"+strconv.Itoa(p.imageHeight)+"_stats."+p.stats)
+	file, err := os.Create(path)
+	if err != nil {
+		return nil, "", err
+	}
+
+	w := &statsWriter{file: file}
+	if p.stats == "csv" {
+		w.csv = csv.NewWriter(file)
+		w.err = w.csv.Write([]string{"turn", "population", "births", "deaths", "min_x", "min_y", "max_x", "max_y", "density"})
+	} else {
+		w.encoder = json.NewEncoder(file)
+	}
+	w.write(sim.Statistics())
+	unsubscribe := sim.Subscribe(gol.ObserverFunc(func(e gol.Event) {
+		if stats, ok := e.(gol.Statistics); ok {
+			w.write(stats)
+		}
+	}), gol.Block, statsBuffer)
+
+	return func() error {
+		unsubscribe()
+		if w.csv != nil {
+			w.csv.Flush()
+		}
+		err := w.file.Close()
+		if w.err != nil {
+			return w.err
+		}
+		return err
+	}, path, nil
+}
+
+// Writes a row, unless an earlier row failed. CSV rows are flushed straight away, so the file can be followed as
+// the simulation runs.
+func (w *statsWriter) write(stats gol.Statistics) {
+	if w.err != nil {
+		return
+	}
+	if w.encoder != nil {
+		row := statsRow{Turn: stats.Turn, Population: stats.Population, Births: stats.Births, Deaths: stats.Deaths,
+			Density: stats.Density}
+		if !stats.Bounds.Empty() {
+			b := stats.Bounds
+			row.Bounds = &statsBound{MinX: b.Min.X, MinY: b.Min.Y, MaxX: b.Max.X, MaxY: b.Max.Y}
+		}
+		w.err = w.encoder.Encode(row)
+		return
+	}
+
+	// The bounds are left empty when no cells are alive
+	bounds := make([]string, 4)
+	if b := stats.Bounds; !b.Empty() {
+		bounds = []string{strconv.Itoa(b.Min.X), strconv.Itoa(b.Min.Y), strconv.Itoa(b.Max.X), strconv.Itoa(b.Max.Y)}
+	}
+	record := append([]string{strconv.Itoa(stats.Turn), strconv.Itoa(stats.Population), strconv.Itoa(stats.Births),
+		strconv.Itoa(stats.Deaths)}, bounds...)
+	w.err = w.csv.Write(append(record, strconv.FormatFloat(stats.Density, 'g', -1, 64)))
+	if w.err == nil {
+		w.csv.Flush()
+		w.err = w.csv.Error()
+	}
+}
+
+// Returns an error unless format is one statistics can be written in, or empty for none
+func checkStatsFormat(format string) error {
+	if format != "" && format != "csv" && format != "jsonl" {
+		return fmt.Errorf("unknown statistics format %q, expected csv or jsonl", format)
+	}
+	return nil
+}
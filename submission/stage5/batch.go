@@ -0,0 +1,32 @@
+package main
+
+import (
+	"fmt"
+	"uk.ac.bris.cs/gameoflife/batch"
+)
+
+// Runs the jobs of a batch with up to parallel of them at once, each with the settings of defaults not in the job file.
+// run simulates a job and returns the alive cells, which are written to a pgm file.
+// Returns the results in the order of the jobs.
+func runBatch(jobs []batch.Job, parallel int, defaults golParams, run func(golParams) ([]cell, error)) []batch.Result {
+	return batch.Run(jobs, parallel, ".pgm", func(job batch.Job) (int, func(string) error, error) {
+		p := defaults
+		p.input, p.rule = job.Input, &job.Rule
+		p.imageWidth, p.imageHeight, p.turns, p.threads = job.Width, job.Height, job.Turns, job.Threads
+		// The io goroutine panics on images it cannot read, so they are checked first
+		width, height, err := pgmSize(p.input)
+		if err == nil && (width != p.imageWidth || height != p.imageHeight) {
+			err = fmt.Errorf("%s is %dx%d, not %dx%d", p.input, width, height, p.imageWidth, p.imageHeight)
+		}
+		if err != nil {
+			return 0, nil, err
+		}
+		alive, err := run(p)
+		if err != nil {
+			return 0, nil, err
+		}
+		return len(alive), func(image string) error {
+			return writePgm(image, p.imageWidth, p.imageHeight, alive)
+		}, nil
+	})
+}
@@ -1,4 +1,4 @@
-module uk.ac.bris.cs/gameoflife
+module uk.ac.bris.cs/gameoflife/stage5
 
 go 1.12
 
@@ -7,4 +7,8 @@ require (
 	github.com/mattn/go-runewidth v0.0.4 // indirect
 	github.com/nsf/termbox-go v0.0.0-20190325093121-288510b9734e
 	github.com/stretchr/testify v1.3.0
+	uk.ac.bris.cs/gameoflife v0.0.0
 )
+
+// The protocol is shared with the library in src, which also speaks it
+replace uk.ac.bris.cs/gameoflife => ../../src
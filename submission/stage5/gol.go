@@ -1,11 +1,16 @@
 package main
 
 import (
+	"crypto/rand"
 	"encoding/gob"
+	"encoding/hex"
 	"fmt"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
+	"uk.ac.bris.cs/gameoflife/protocol"
 )
 
 type workerData struct {
@@ -13,6 +18,12 @@ type workerData struct {
 	distributorOutput chan int
 	encoder           *gob.Encoder
 	index             int
+	job               int
+}
+
+// Part of the world owned by one worker: rows startX to endX and columns startY to endY
+type tile struct {
+	startX, endX, startY, endY int
 }
 
 const (
@@ -23,6 +34,9 @@ const (
 	save   = iota
 )
 
+// Row and column offset of each halo direction, clockwise from the row above
+var offsets = [8][2]int{{-1, 0}, {-1, 1}, {0, 1}, {1, 1}, {1, 0}, {1, -1}, {0, -1}, {-1, -1}}
+
 func positiveModulo(x, m int) int {
 	for x < 0 {
 		x += m
@@ -50,37 +64,153 @@ func outputWorld(p golParams, state int, d distributorChans, world [][]byte) {
 	}
 }
 
-// initialise worker channels
-func initialiseChannels(workerChannels []workerData, threadsSmall, threadsSmallHeight, threadsLarge, threadsLargeHeight int, p golParams) {
-	for i := 0; i < threadsSmall; i++ {
-		workerChannels[i].outputWorld = make(chan [][]byte, 1)
+// Splits length into parts, with the larger parts at the end
+// 16 into 10 parts: 4 parts of 1 followed by 6 parts of 2
+func splitBounds(length, parts int) []int {
+	bounds := make([]int, parts+1)
+	small := parts - length%parts
+	for i := 0; i < parts; i++ {
+		bounds[i+1] = bounds[i] + length/parts
+		if i >= small {
+			bounds[i+1]++
+		}
+	}
+	return bounds
+}
 
-		workerChannels[i].distributorOutput = make(chan int, 1)
+// Chooses how many rows and columns of tiles the world is split into.
+// Strips are a single column of tiles, otherwise the grid exchanging the fewest halo cells is used.
+func tileGrid(p golParams) (rows, cols int) {
+	rows, cols = p.threads, 1
+	if !p.tiled {
+		return
 	}
+	best := -1
+	for r := 1; r <= p.threads; r++ {
+		c := p.threads / r
+		if p.threads%r != 0 || r > p.imageHeight || c > p.imageWidth {
+			continue
+		}
+		// Cells along the edge of the largest tile
+		perimeter := (p.imageHeight+r-1)/r + (p.imageWidth+c-1)/c
+		if best == -1 || perimeter < best {
+			best = perimeter
+			rows, cols = r, c
+		}
+	}
+	return
+}
 
-	for i := 0; i < threadsLarge; i++ {
-		workerChannels[i+threadsSmall].outputWorld = make(chan [][]byte, 1)
+// Splits the world into tiles, one per worker, in row-major order
+func makeTiles(p golParams, rows, cols int) []tile {
+	xBounds := splitBounds(p.imageHeight, rows)
+	yBounds := splitBounds(p.imageWidth, cols)
+	tiles := make([]tile, 0, rows*cols)
+	for r := 0; r < rows; r++ {
+		for c := 0; c < cols; c++ {
+			tiles = append(tiles, tile{xBounds[r], xBounds[r+1], yBounds[c], yBounds[c+1]})
+		}
+	}
+	return tiles
+}
 
-		workerChannels[i+threadsSmall].distributorOutput = make(chan int, 1)
+// Returns how many rows of halo workers exchange at once.
+// This is at least 1, and at most the smallest side of a tile as halos only come from the neighbouring tiles.
+func haloDepth(p golParams, tiles []tile) int {
+	depth := p.haloDepth
+	for _, t := range tiles {
+		if t.endX-t.startX < depth {
+			depth = t.endX - t.startX
+		}
+		if t.endY-t.startY < depth {
+			depth = t.endY - t.startY
+		}
+	}
+	if depth < 1 {
+		depth = 1
 	}
+	return depth
 }
 
-type controllerData struct {
-	Index, Data int
+// initialise worker channels
+func initialiseChannels(workerChannels []workerData) {
+	for i := range workerChannels {
+		workerChannels[i].outputWorld = make(chan [][]byte, 1)
+
+		workerChannels[i].distributorOutput = make(chan int, 1)
+	}
 }
 
 func encodeData(worker workerData, data int) {
-	p := controllerData{worker.index, data}
-	err := worker.encoder.Encode(&p)
+	err := worker.encoder.Encode(protocol.Message{Kind: protocol.CommandMessage, Job: worker.job, Worker: worker.index, Data: data})
 	if err != nil {
 		fmt.Println(err)
 	}
 }
 
 type clientData struct {
-	encoder *gob.Encoder
-	decoder *gob.Decoder
-	ip      string
+	encoder  *gob.Encoder
+	decoder  *gob.Decoder
+	ip       string
+	compress bool    // Worlds sent over this connection are compressed
+	jobs     *router // Jobs running on the client
+}
+
+// Passes the messages from a client to the job they belong to, so several jobs can share a client
+type router struct {
+	mutex sync.Mutex
+	jobs  map[int]route
+}
+
+// Where the messages of one job go. Each job has its own queue, so a job which stalls does not hold up the others.
+type route struct {
+	queue chan<- protocol.Message
+	stop  chan struct{} // Closed when the job is removed, dropping the messages it has not read
+}
+
+// Used to give every job a different id
+var lastJob int32
+
+// Reads the messages from a client and passes them to their jobs, until the client disconnects
+func routeMessages(decoder *gob.Decoder, r *router) {
+	for {
+		var m protocol.Message
+		err := decoder.Decode(&m)
+		if err != nil {
+			fmt.Println("Err", err)
+			return
+		}
+
+		// The queue is only stopped once the job is removed, so it takes the message straight away
+		r.mutex.Lock()
+		route, running := r.jobs[m.Job]
+		if running {
+			route.queue <- m
+		}
+		r.mutex.Unlock()
+		if !running {
+			fmt.Println("Message for job", m.Job, "which is not running")
+		}
+	}
+}
+
+// Returns the channel receiving the messages of a job from a client
+func addJob(r *router, job, capacity int) chan protocol.Message {
+	c := make(chan protocol.Message, capacity)
+	stop := make(chan struct{})
+	r.mutex.Lock()
+	r.jobs[job] = route{protocol.Queue(c, stop), stop}
+	r.mutex.Unlock()
+	return c
+}
+
+func removeJob(r *router, job int) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if route, running := r.jobs[job]; running {
+		close(route.stop)
+		delete(r.jobs, job)
+	}
 }
 
 func pauseWorkers(workerData []workerData, stopAtTurn *int) {
@@ -107,21 +237,12 @@ func pauseWorkers(workerData []workerData, stopAtTurn *int) {
 	}
 }
 
-func receiveWorld(world [][]byte, workerData []workerData, threadsSmall, threadsSmallHeight, threadsLargeHeight int) {
-	startX := 0
-	endX := threadsSmallHeight
+func receiveWorld(world [][]byte, workerData []workerData, tiles []tile) {
 	for i, worker := range workerData {
+		t := tiles[i]
 		tw := <-worker.outputWorld
-		for i := range tw {
-			copy(world[startX+i], tw[i])
-		}
-
-		// New startX, endX
-		startX = endX
-		if i < threadsSmall-1 {
-			endX += threadsSmallHeight
-		} else {
-			endX += threadsLargeHeight
+		for x := range tw {
+			copy(world[t.startX+x][t.startY:t.endY], tw[x])
 		}
 	}
 }
@@ -133,7 +254,100 @@ func sendToWorkers(workerData []workerData, data int) {
 	}
 }
 
-func workerController(p golParams, world [][]byte, workerData []workerData, d distributorChans, keyChan <-chan rune, threadsSmall, threadsSmallHeight, threadsLarge, threadsLargeHeight int) {
+// Returns the hash of a world, the XOR of protocol.CellHash of its alive cells, and its number of alive cells
+func hashWorld(world [][]byte) (uint64, int) {
+	var hash uint64
+	population := 0
+	for y := range world {
+		for x := range world[y] {
+			if world[y][x] != 0 {
+				hash ^= protocol.CellHash(x, y)
+				population++
+			}
+		}
+	}
+	return hash, population
+}
+
+// Combines the reports of the workers into the hash and population of the world after every turn, and sends the
+// first cycle found, starting from the world of turn 0. Reports are read until closed, so workers never wait on it.
+func findCycles(hash uint64, population int, reports <-chan protocol.TurnReport, workers int, found chan<- protocol.Cycles) {
+	var cycles protocol.Cycles
+	cycles.Record(0, hash, population)
+	hashes := make(map[int]uint64)
+	populations := make(map[int]int)
+	counts := make(map[int]int)
+	for r := range reports {
+		if cycles.Period != 0 {
+			continue
+		}
+		hashes[r.Turn] ^= r.Hash
+		populations[r.Turn] += r.Population
+		counts[r.Turn]++
+		if counts[r.Turn] < workers {
+			continue
+		}
+		if cycles.Record(r.Turn, hashes[r.Turn], populations[r.Turn]) {
+			found <- cycles
+		}
+		delete(hashes, r.Turn)
+		delete(populations, r.Turn)
+		delete(counts, r.Turn)
+	}
+}
+
+// Stops the workers at the first turn past all of theirs whose world is the world of the last turn, as the world goes
+// round its cycle, and receives that world. Workers which have already finished make the others carry on to the last turn.
+func skipCycle(p golParams, cycle protocol.Cycles, world [][]byte, workerData []workerData, tiles []tile) {
+	// Pause and get current turns
+	sendToWorkers(workerData, pause)
+	current := 0
+	finished := make([]bool, len(workerData))
+	done := false
+	for i, worker := range workerData {
+		t := <-worker.distributorOutput
+		if t == -1 {
+			finished[i], done = true, true
+		} else if t > current {
+			current = t
+		}
+	}
+
+	// Workers stop after the turn following the one they are told
+	last := current + 1 + (p.turns-current-1)%cycle.Period
+	if done || last >= p.turns {
+		last = p.turns
+	}
+	for i, worker := range workerData {
+		if !finished[i] {
+			encodeData(worker, last-1)
+		}
+	}
+
+	if last == p.turns {
+		for i, worker := range workerData {
+			if !finished[i] {
+				<-worker.distributorOutput
+			}
+		}
+		receiveWorld(world, workerData, tiles)
+		return
+	}
+	for _, channel := range workerData {
+		r := <-channel.distributorOutput
+		if r != pause {
+			fmt.Println("Something has gone wrong, r =", r)
+		}
+	}
+	sendToWorkers(workerData, save)
+	receiveWorld(world, workerData, tiles)
+	sendToWorkers(workerData, quit)
+	fmt.Println("Skipped from turn", last, "to turn", p.turns)
+}
+
+// Controls the workers until they finish or quit. Returns why the job failed, if a client reports that it has.
+// Cycles of the world are received on found, which blocks when not looking for them.
+func workerController(p golParams, world [][]byte, workerData []workerData, d distributorChans, keyChan <-chan rune, tiles []tile, failures <-chan error, found <-chan protocol.Cycles) error {
 	stopAtTurn := 0
 	paused := false
 	timer := time.NewTimer(2 * time.Second)
@@ -182,7 +396,7 @@ func workerController(p golParams, world [][]byte, workerData []workerData, d di
 					}
 
 					// Receive and output world
-					receiveWorld(world, workerData, threadsSmall, threadsSmallHeight, threadsLargeHeight)
+					receiveWorld(world, workerData, tiles)
 					outputWorld(p, stopAtTurn, d, world)
 
 					// Quit workers
@@ -204,86 +418,116 @@ func workerController(p golParams, world [][]byte, workerData []workerData, d di
 				<-workerData[i].distributorOutput
 			}
 			// Receive the world and quit
-			receiveWorld(world, workerData, threadsSmall, threadsSmallHeight, threadsLargeHeight)
+			receiveWorld(world, workerData, tiles)
 			q = true
+		case c := <-found:
+			fmt.Println("Stabilised at turn", c.Start, "with period", c.Period)
+			// A paused world is left for the user to resume
+			if p.skipCycles && !paused {
+				skipCycle(p, c, world, workerData, tiles)
+				q = true
+			}
+		case err := <-failures:
+			return err
 		}
 	}
+	return nil
 }
 
-type initPackage struct {
-	Clients           int
-	Workers           int
-	IpBefore, IpAfter string
-	Turns             int
-	Width             int
-}
-
-type workerPackage struct {
-	StartX int
-	EndX   int
-	World  [][]byte
-	Index  int
-}
-
-type distributorPackage struct {
-	Index       int
-	Type        int
-	Data        int
-	OutputWorld [][]byte
-}
+// Passes the messages of a client's workers to the distributor, until the client has freed the job.
+// Messages which cannot be used fail the job, as does a client reporting that it has failed.
+// Reports of turns are passed on to reports, which is nil when none were asked for.
+func listenToWorker(in chan protocol.Message, channel []workerData, tiles []tile, failures chan error, stopped chan byte, reports chan<- protocol.TurnReport) {
+	for {
+		m := <-in
 
-func listenToWorker(decoder *gob.Decoder, channel []workerData, workersServed int) {
-	for i := 0; i < workersServed; {
-		var p distributorPackage
-		err := decoder.Decode(&p)
-		if err != nil {
-			fmt.Println("Err", err)
+		if m.Kind != protocol.ShutdownMessage && m.Kind != protocol.RejectMessage && (m.Worker < 0 || m.Worker >= len(channel)) {
+			fail(failures, fmt.Errorf("message from worker %d, which does not exist", m.Worker))
+			continue
 		}
-
-		if p.Type == 1 {
-			channel[p.Index].outputWorld <- p.OutputWorld
-		} else if p.Type == 0 {
-			channel[p.Index].distributorOutput <- p.Data
-		} else if p.Type == -1 {
-			channel[p.Index].distributorOutput <- p.Data
-			i++
+		switch m.Kind {
+		case protocol.WorldMessage:
+			if m.Packed != nil {
+				t := tiles[m.Worker]
+				width := t.endY - t.startY
+				cells, err := protocol.Decompress(m.Packed, width*(t.endX-t.startX))
+				m.World = nil
+				if err == nil {
+					m.World, err = protocol.Unflatten(cells, width)
+				}
+				if err != nil {
+					// The failure is reported first, so it is seen once the controller has every world
+					fail(failures, fmt.Errorf("world of worker %d: %v", m.Worker, err))
+				}
+			}
+			channel[m.Worker].outputWorld <- m.World
+		case protocol.StatusMessage:
+			channel[m.Worker].distributorOutput <- m.Data
+		case protocol.DoneMessage:
+			channel[m.Worker].distributorOutput <- -1
+		case protocol.ReportMessage:
+			if reports == nil || m.Report == nil {
+				fail(failures, fmt.Errorf("unexpected report from worker %d", m.Worker))
+				continue
+			}
+			reports <- *m.Report
+		case protocol.RejectMessage:
+			fail(failures, fmt.Errorf("a client failed the job: %s", m.Error))
+		case protocol.ShutdownMessage:
+			stopped <- 1
+			return
+		default:
+			fmt.Println("Unexpected message from worker", m.Worker, "of kind", m.Kind)
 		}
 	}
 }
 
-const (
-	INIT = 0
-)
+// Reports why a job failed, unless a failure has been reported already
+func fail(failures chan error, err error) {
+	fmt.Println("Err", err)
+	select {
+	case failures <- err:
+	default:
+	}
+}
 
-func startWorkers(client clientData, initP initPackage, workerP []workerPackage, workerData []workerData) {
-	// The next packet is an init package
-	err := client.encoder.Encode(INIT)
+// Returns a random secret
+func randomToken() (string, error) {
+	b := make([]byte, 16)
+	_, err := rand.Read(b)
 	if err != nil {
-		fmt.Println("Err", err)
+		return "", err
 	}
+	return hex.EncodeToString(b), nil
+}
 
-	// Send the init package
-	err = client.encoder.Encode(initP)
+func startWorkers(client clientData, job int, initP protocol.InitPackage, workerP []protocol.WorkerPackage, workerData []workerData) {
+	// Start a job, then give the client its workers
+	err := client.encoder.Encode(protocol.Message{Kind: protocol.InitMessage, Job: job, Init: &initP})
 	if err != nil {
 		fmt.Println("Err", err)
 	}
-	// Send worker packages
+
 	for i, p := range workerP {
 		workerData[i].encoder = client.encoder
-		workerData[i].index = i
-		err = client.encoder.Encode(p)
+		workerData[i].index = p.Index
+		workerData[i].job = job
+		if client.compress {
+			p.Packed = protocol.Compress(protocol.Flatten(p.World))
+			p.World = nil
+		}
+		err = client.encoder.Encode(protocol.Message{Kind: protocol.AssignMessage, Job: job, Worker: p.Index, Assign: &p})
 		if err != nil {
 			fmt.Println("Err", err)
 		}
 	}
-
-	if err != nil {
-		fmt.Println("Err", err)
-	}
 }
 
 // distributor divides the work between workers and interacts with other goroutines.
-func distributor(p golParams, d distributorChans, alive chan []cell, keyChan <-chan rune, clients []clientData, clientNumber int) {
+func distributor(p golParams, d distributorChans, alive chan []cell, failed chan error, keyChan <-chan rune, clients []clientData, clientNumber int) {
+	if p.rule == nil {
+		p.rule = &protocol.Conway
+	}
 
 	// Create the 2D slice to store the world.
 	world := makeMatrix(p.imageWidth, p.imageHeight)
@@ -303,22 +547,15 @@ func distributor(p golParams, d distributorChans, alive chan []cell, keyChan <-c
 		}
 	}
 
-	// Make channels
-	var chans = make([]chan [][]byte, p.threads)
-	for i := 0; i < p.threads; i++ {
-		chans[i] = make(chan [][]byte)
-	}
-
-	// Thread calculations
-	// 16x16 with 10 threads: 6 large threads with 2 height + 4 small threads with 1 height
-	threadsLarge := p.imageHeight % p.threads
-	threadsSmall := p.threads - p.imageHeight%p.threads
-	threadsLargeHeight := p.imageHeight/p.threads + 1
-	threadsSmallHeight := p.imageHeight / p.threads
+	// Tile calculations
+	// 16x16 with 10 threads as strips: 4 small tiles with 1 height + 6 large tiles with 2 height
+	rows, cols := tileGrid(p)
+	tiles := makeTiles(p, rows, cols)
+	p.haloDepth = haloDepth(p, tiles)
 
 	// Worker channels
 	workerData := make([]workerData, p.threads)
-	initialiseChannels(workerData, threadsSmall, threadsSmallHeight, threadsLarge, threadsLargeHeight, p)
+	initialiseChannels(workerData)
 
 	// Threads per client
 	//clientLarge := p.threads % clientNumber
@@ -327,89 +564,135 @@ func distributor(p golParams, d distributorChans, alive chan []cell, keyChan <-c
 	clientLargeWorkers := p.threads/clientNumber + 1
 	clientSmallWorkers := p.threads / clientNumber
 
-	workerBounds := make([]workerPackage, p.threads)
-	t := 0
-
-	// Copy of world, but with extra 2 lines (one at the start, one at the end)
-	borderedWorld := make([][]byte, p.imageHeight+2)
-	for i := range world {
-		borderedWorld[i+1] = world[i]
+	// Workers are given to clients in order, the first clients get the smaller share
+	clientWorkers := make([]int, clientNumber)
+	owners := make([]int, 0, p.threads)
+	ips := make([]string, clientNumber)
+	peers := make([]map[int]string, clientNumber)
+	for i := range clientWorkers {
+		clientWorkers[i] = clientLargeWorkers
+		if i < clientSmall {
+			clientWorkers[i] = clientSmallWorkers
+		}
+		for j := 0; j < clientWorkers[i]; j++ {
+			owners = append(owners, i)
+		}
+		ips[i] = clients[i].ip
+		peers[i] = make(map[int]string)
 	}
-	borderedWorld[0] = world[p.imageHeight-1]
-	borderedWorld[p.imageHeight+1] = world[0]
 
-	// start workers
-	for i := 0; i < threadsSmall; i++ {
-		workerBounds[t] = workerPackage{
-			threadsSmallHeight * i,
-			threadsSmallHeight * (i + 1),
-			borderedWorld[(threadsSmallHeight)*i : (threadsSmallHeight)*(i+1)+2],
-			t,
+	workerBounds := make([]protocol.WorkerPackage, p.threads)
+	for i, t := range tiles {
+		// Copy of the tile, with its surrounding halos
+		tileWorld := makeMatrix(t.endY-t.startY+2*p.haloDepth, t.endX-t.startX+2*p.haloDepth)
+		for x := range tileWorld {
+			for y := range tileWorld[x] {
+				tileWorld[x][y] = world[positiveModulo(t.startX+x-p.haloDepth, p.imageHeight)][positiveModulo(t.startY+y-p.haloDepth, p.imageWidth)]
+			}
 		}
-		t++
-	}
-	for i := 0; i < threadsLarge; i++ {
-		workerBounds[t] = workerPackage{
-			threadsSmallHeight*threadsSmall + threadsLargeHeight*i,
-			threadsSmallHeight*threadsSmall + threadsLargeHeight*(i+1),
-			borderedWorld[threadsSmallHeight*threadsSmall+threadsLargeHeight*i : threadsSmallHeight*threadsSmall+threadsLargeHeight*(i+1)+2],
-			t,
+
+		workerBounds[i] = protocol.WorkerPackage{
+			StartX: t.startX,
+			EndX:   t.endX,
+			StartY: t.startY,
+			EndY:   t.endY,
+			World:  tileWorld,
+			Index:  i,
+		}
+		for direction, offset := range offsets {
+			neighbour := positiveModulo(i/cols+offset[0], rows)*cols + positiveModulo(i%cols+offset[1], cols)
+			workerBounds[i].Neighbours[direction] = neighbour
+
+			// Each pair of clients exchanging halos shares a secret, so other halo connections are refused
+			a, b := owners[i], owners[neighbour]
+			if a != b && peers[a][b] == "" {
+				token, err := randomToken()
+				if err != nil {
+					// The job is refused before any client has started it
+					d.io.command <- ioCheckIdle
+					<-d.io.idle
+					failed <- fmt.Errorf("could not make a secret for the clients: %v", err)
+					return
+				}
+				peers[a][b] = token
+				peers[b][a] = token
+			}
 		}
-		t++
 	}
 
-	t = 0
+	// Messages from the clients for this job
+	job := int(atomic.AddInt32(&lastJob, 1))
+	in := make([]chan protocol.Message, clientNumber)
+	for i := range clients {
+		in[i] = addJob(clients[i].jobs, job, 2*clientWorkers[i]+2)
+		defer removeJob(clients[i].jobs, job)
+	}
+
+	// Workers report their tiles after every turn when looking for cycles
+	var reports chan protocol.TurnReport
+	var found chan protocol.Cycles
+	turnReports := protocol.NoReports
+	if p.cycles || p.skipCycles {
+		reports = make(chan protocol.TurnReport, p.threads)
+		found = make(chan protocol.Cycles, 1)
+		turnReports = protocol.CountReports
+		hash, population := hashWorld(world)
+		go findCycles(hash, population, reports, p.threads, found)
+	}
+
+	t := 0
 	// Start workers on remote machines
 	for i := 0; i < clientNumber; i++ {
-		host0 := clients[positiveModulo(i-1, clientNumber)].ip
-		host1 := clients[positiveModulo(i+1, clientNumber)].ip
-		if i < clientSmall {
-			fmt.Println(clientSmallWorkers, "Workers started on client", i)
-			startWorkers(clients[i], initPackage{clientNumber, clientSmallWorkers, host0, host1, p.turns, p.imageWidth},
-				workerBounds[t:t+clientSmallWorkers], workerData[t:t+clientSmallWorkers])
-			t += clientSmallWorkers
-		} else {
-			fmt.Println(clientLargeWorkers, "Workers started on client", i)
-			startWorkers(clients[i], initPackage{clientNumber, clientLargeWorkers, host0, host1, p.turns, p.imageWidth},
-				workerBounds[t:t+clientLargeWorkers], workerData[t:t+clientLargeWorkers])
-			t += clientLargeWorkers
-		}
+		fmt.Println(clientWorkers[i], "Workers started on client", i)
+		startWorkers(clients[i], job, protocol.InitPackage{Clients: clientNumber, Workers: clientWorkers[i], Index: i, Ips: ips, Owners: owners,
+			Turns: p.turns, Depth: p.haloDepth, Peers: peers[i], Rule: *p.rule, Reports: turnReports},
+			workerBounds[t:t+clientWorkers[i]], workerData[t:t+clientWorkers[i]])
+		t += clientWorkers[i]
 	}
 
+	// Wait until every client listens for halo connections, then let them connect to each other.
+	// Clients which are busy refuse the job, which is then shut down everywhere.
+	var refusal error
+	running := make([]bool, clientNumber)
 	for i := 0; i < clientNumber; i++ {
-		var p int
-		err := clients[i].decoder.Decode(&p)
-
-		if err != nil {
-			fmt.Println(err)
-		}
-
-		if p != 1 {
-			fmt.Println("Ready package mismatch")
+		m := <-in[i]
+		running[i] = m.Kind != protocol.RejectMessage
+		if !running[i] {
+			fmt.Println("Client", i, "refused job", job, "-", m.Error)
+			refusal = fmt.Errorf("client %d refused the job: %s", i, m.Error)
+		} else if m.Kind != protocol.ReadyMessage {
+			fmt.Println("Expected client", i, "to be ready, got message of kind", m.Kind)
 		}
 	}
-	for i := 0; i < clientNumber; i++ {
-		p := 1
-		err := clients[i].encoder.Encode(&p)
+	stopped := make(chan byte, clientNumber)
+	failures := make(chan error, 1)
+	for i := 0; i < clientNumber && refusal == nil; i++ {
+		err := clients[i].encoder.Encode(protocol.Message{Kind: protocol.ReadyMessage, Job: job})
 
 		if err != nil {
 			fmt.Println(err)
 		}
 
-		if i < clientSmall {
-			go listenToWorker(clients[i].decoder, workerData, clientSmallWorkers)
-		} else {
-			go listenToWorker(clients[i].decoder, workerData, clientLargeWorkers)
-		}
+		go listenToWorker(in[i], workerData, tiles, failures, stopped, reports)
 	}
 
 	// Process IO and control workers
-	workerController(p, world, workerData, d, keyChan, threadsSmall, threadsSmallHeight, threadsLarge, threadsLargeHeight)
+	listening := refusal == nil
+	if listening {
+		refusal = workerController(p, world, workerData, d, keyChan, tiles, failures, found)
+	}
+	if refusal == nil {
+		// A world which could not be used fails the job after the workers have finished
+		select {
+		case refusal = <-failures:
+		default:
+		}
+	}
 
 	// Create an empty slice to store coordinates of cells that are still alive after p.turns are done.
 	var finalAlive []cell
 	// Go through the world and append the cells that are still alive.
-	for y := 0; y < p.imageHeight; y++ {
+	for y := 0; y < p.imageHeight && refusal == nil; y++ {
 		for x := 0; x < p.imageWidth; x++ {
 			if world[y][x] != 0 {
 				finalAlive = append(finalAlive, cell{x: x, y: y})
@@ -417,22 +700,37 @@ func distributor(p golParams, d distributorChans, alive chan []cell, keyChan <-c
 		}
 	}
 
-	// Tell workers to exit listening functions
+	// Tell workers to exit listening functions, and wait until the clients have freed the job
 	for i := 0; i < clientNumber; i++ {
-		err := clients[i].encoder.Encode(controllerData{
-			Index: -1,
-			Data:  0,
-		})
+		err := clients[i].encoder.Encode(protocol.Message{Kind: protocol.ShutdownMessage, Job: job})
 		if err != nil {
 			fmt.Println(err)
 		}
 	}
+	for i := 0; i < clientNumber; i++ {
+		if listening {
+			// The listeners still read the messages of the client, even after a quit
+			<-stopped
+			continue
+		}
+		for running[i] {
+			m := <-in[i]
+			running[i] = m.Kind != protocol.ShutdownMessage
+		}
+	}
+	if reports != nil {
+		close(reports)
+	}
 
 	//outputWorld(p, p.turns, d, world)
 
 	// Make sure that the Io has finished any output before exiting.
 	d.io.command <- ioCheckIdle
 	<-d.io.idle
+	if refusal != nil {
+		failed <- refusal
+		return
+	}
 	// Return the coordinates of cells that are still alive.
 	alive <- finalAlive
 
@@ -1,10 +1,14 @@
 package main
 
 import (
+	"crypto/tls"
 	"encoding/gob"
+	"errors"
 	"flag"
 	"fmt"
 	"net"
+	"uk.ac.bris.cs/gameoflife/batch"
+	"uk.ac.bris.cs/gameoflife/protocol"
 )
 
 const clientNumber = 1
@@ -15,6 +19,13 @@ type golParams struct {
 	threads     int
 	imageWidth  int
 	imageHeight int
+	tiled       bool
+	haloDepth   int
+	cycles      bool
+	skipCycles  bool
+	rule        *protocol.Rule // Conway's B3/S23 when nil
+	input       string         // Image to start from, images/[width]x[height].pgm when empty
+	outputDir   string         // Directory images are written to, out when empty
 }
 
 // ioCommand allows requesting behaviour from the io (pgm) goroutine.
@@ -71,8 +82,8 @@ type ioChans struct {
 // gameOfLife is the function called by the testing framework.
 // It makes some channels and starts relevant goroutines.
 // It places the created channels in the relevant structs.
-// It returns an array of alive cells returned by the distributor.
-func gameOfLife(p golParams, keyChan <-chan rune, clientNumber int, clients []clientData) []cell {
+// It returns an array of alive cells returned by the distributor, or an error if a client refused the job.
+func gameOfLife(p golParams, keyChan <-chan rune, clientNumber int, clients []clientData) ([]cell, error) {
 	var dChans distributorChans
 	var ioChans ioChans
 
@@ -97,23 +108,36 @@ func gameOfLife(p golParams, keyChan <-chan rune, clientNumber int, clients []cl
 	ioChans.distributor.world = worldChan
 
 	aliveCells := make(chan []cell)
+	failed := make(chan error)
 
 	if p.threads < clientNumber {
 		p.threads = clientNumber
 	}
 
-	go distributor(p, dChans, aliveCells, keyChan, clients, clientNumber)
+	go distributor(p, dChans, aliveCells, failed, keyChan, clients, clientNumber)
 	go pgmIo(p, ioChans)
 
-	alive := <-aliveCells
-	return alive
+	select {
+	case alive := <-aliveCells:
+		return alive, nil
+	case err := <-failed:
+		return nil, err
+	}
 }
 
-func processClients(clientNumber int) []clientData {
+// processClients waits for the clients to connect, and agrees with each one on the protocol version and capabilities.
+// Connections use TLS if config is set, and clients have to present token to join.
+func processClients(clientNumber int, compression bool, config *tls.Config, token string) []clientData {
 
 	clients := make([]clientData, clientNumber)
+	authorise := func(h protocol.Hello) error {
+		if !protocol.ValidToken(h.Token, token) {
+			return errors.New("wrong token")
+		}
+		return nil
+	}
 
-	ln, err := net.Listen("tcp4", ":4000")
+	ln, err := protocol.Listen(":4000", config)
 	if err != nil {
 		fmt.Println("Could not listen to port 4000", err)
 	}
@@ -123,12 +147,25 @@ func processClients(clientNumber int) []clientData {
 			conn, err := ln.Accept()
 			if err != nil {
 				fmt.Println(err)
+				continue
 			}
-			fmt.Println("Client number", i, "/", clientNumber, "connected")
 
 			clients[i].encoder = gob.NewEncoder(conn)
 			clients[i].decoder = gob.NewDecoder(conn)
 			clients[i].ip, _, _ = net.SplitHostPort(conn.RemoteAddr().String())
+
+			// Clients from a different build or without the token are turned away, and another client is waited for instead
+			_, shared, err := protocol.AcceptHello(clients[i].encoder, clients[i].decoder, protocol.Capabilities(compression), authorise)
+			if err != nil {
+				fmt.Println("Refused client from", clients[i].ip+":", err)
+				_ = conn.Close()
+				i--
+				continue
+			}
+			clients[i].compress = protocol.HasCapability(shared, protocol.CompressionCapability)
+			clients[i].jobs = &router{jobs: make(map[int]route)}
+			go routeMessages(clients[i].decoder, clients[i].jobs)
+			fmt.Println("Client number", i, "/", clientNumber, "connected")
 		}
 	}
 
@@ -139,6 +176,10 @@ func processClients(clientNumber int) []clientData {
 // Do not edit until Stage 2.
 func main() {
 	var params golParams
+	var compression bool
+	var certFile, keyFile, caFile, token string
+	var ruleName, jobFile, manifest string
+	var parallel int
 
 	flag.IntVar(
 		&params.threads,
@@ -158,18 +199,116 @@ func main() {
 		512,
 		"Specify the height of the image. Defaults to 512.")
 
+	flag.BoolVar(
+		&params.tiled,
+		"tiles",
+		false,
+		"Split the world into 2D tiles instead of horizontal strips. Defaults to false.")
+
+	flag.IntVar(
+		&params.haloDepth,
+		"depth",
+		1,
+		"Specify the number of halo rows exchanged at once. Workers exchange halos every depth turns. Defaults to 1.")
+
+	flag.BoolVar(
+		&params.cycles,
+		"cycles",
+		false,
+		"Look for the world repeating itself, and report the turn it stabilised at and its period. Defaults to false.")
+
+	flag.BoolVar(
+		&params.skipCycles,
+		"skip",
+		false,
+		"Look for the world repeating itself, and once it does skip straight to the last turn. Defaults to false.")
+
+	flag.BoolVar(
+		&compression,
+		"compress",
+		true,
+		"Compress worlds and halos sent over the network, when clients support it. Defaults to true.")
+
+	flag.StringVar(&certFile, "cert", "", "Certificate of this machine, for TLS. Defaults to plain TCP.")
+	flag.StringVar(&keyFile, "key", "", "Private key of the certificate, for TLS.")
+	flag.StringVar(&caFile, "ca", "", "CA which signs the certificates of the distributor and every client, for TLS.")
+	flag.StringVar(&token, "token", "", "Secret clients have to present to join. Use with TLS on untrusted networks. Defaults to none.")
+
+	flag.StringVar(
+		&ruleName,
+		"rule",
+		"B3/S23",
+		"Specify the rule in B/S notation. Defaults to B3/S23, Conway's Game of Life.")
+
+	flag.StringVar(
+		&jobFile,
+		"batch",
+		"",
+		"Run the jobs of a job file on the clients instead, with the columns: input rule size turns threads output.")
+
+	flag.StringVar(
+		&manifest,
+		"manifest",
+		"manifest.csv",
+		"Specify the file the results of a batch are written to. Defaults to manifest.csv.")
+
+	flag.IntVar(
+		&parallel,
+		"parallel",
+		1,
+		"Specify the number of batch jobs run at once. Clients run up to 4 jobs at once by default. Defaults to 1.")
+
 	flag.Parse()
 
+	config, err := protocol.LoadTLS(certFile, keyFile, caFile)
+	if err != nil {
+		fmt.Println("Could not load TLS certificates:", err)
+		return
+	}
+
+	r, err := protocol.ParseRule(ruleName)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	params.rule = &r
+
+	var jobs []batch.Job
+	if jobFile != "" {
+		// Checked before waiting for clients, as a mistake in the file would waste their time
+		jobs, err = batch.ReadJobFile(jobFile)
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+	}
+
 	params.turns = 5000
 
 	fmt.Println("Waiting for", clientNumber, "clients to connect.")
-	clients := processClients(clientNumber)
+	clients := processClients(clientNumber, compression, config, token)
+
+	if jobFile != "" {
+		results := runBatch(jobs, parallel, params, func(p golParams) ([]cell, error) {
+			return gameOfLife(p, nil, clientNumber, clients)
+		})
+		err = batch.WriteManifest(manifest, results)
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+		fmt.Println("Ran", len(results), "jobs, results are in", manifest)
+		return
+	}
 
 	startControlServer(params)
 	keyChan := make(chan rune)
 	go getKeyboardCommand(keyChan)
 
-	gameOfLife(params, keyChan, clientNumber, clients)
+	_, err = gameOfLife(params, keyChan, clientNumber, clients)
+	if err != nil {
+		fmt.Println(err)
+	}
 
 	StopControlServer()
 }
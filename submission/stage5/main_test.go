@@ -1,11 +1,27 @@
 package main
 
 import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/gob"
+	"encoding/pem"
+	"errors"
 	"fmt"
 	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"math/big"
+	"net"
 	"os"
+	"path/filepath"
 	"testing"
 	"time"
+	"uk.ac.bris.cs/gameoflife/batch"
+	"uk.ac.bris.cs/gameoflife/protocol"
 )
 
 var clients []clientData
@@ -260,6 +276,455 @@ func Test(t *testing.T) {
 			},
 		}},
 
+		// 2D tile tests
+		{"16x16x1-1-tiles", args{
+			p: golParams{
+				turns:       1,
+				threads:     1,
+				imageWidth:  16,
+				imageHeight: 16,
+				tiled:       true,
+			},
+			expectedAlive: []cell{
+				{x: 3, y: 6},
+				{x: 5, y: 6},
+				{x: 4, y: 7},
+				{x: 5, y: 7},
+				{x: 4, y: 8},
+			},
+		}},
+
+		{"16x16x4-1-tiles", args{
+			p: golParams{
+				turns:       1,
+				threads:     4,
+				imageWidth:  16,
+				imageHeight: 16,
+				tiled:       true,
+			},
+			expectedAlive: []cell{
+				{x: 3, y: 6},
+				{x: 5, y: 6},
+				{x: 4, y: 7},
+				{x: 5, y: 7},
+				{x: 4, y: 8},
+			},
+		}},
+
+		{"16x16x6-1-tiles", args{
+			p: golParams{
+				turns:       1,
+				threads:     6,
+				imageWidth:  16,
+				imageHeight: 16,
+				tiled:       true,
+			},
+			expectedAlive: []cell{
+				{x: 3, y: 6},
+				{x: 5, y: 6},
+				{x: 4, y: 7},
+				{x: 5, y: 7},
+				{x: 4, y: 8},
+			},
+		}},
+
+		{"16x16x8-1-tiles", args{
+			p: golParams{
+				turns:       1,
+				threads:     8,
+				imageWidth:  16,
+				imageHeight: 16,
+				tiled:       true,
+			},
+			expectedAlive: []cell{
+				{x: 3, y: 6},
+				{x: 5, y: 6},
+				{x: 4, y: 7},
+				{x: 5, y: 7},
+				{x: 4, y: 8},
+			},
+		}},
+
+		{"16x16x9-1-tiles", args{
+			p: golParams{
+				turns:       1,
+				threads:     9,
+				imageWidth:  16,
+				imageHeight: 16,
+				tiled:       true,
+			},
+			expectedAlive: []cell{
+				{x: 3, y: 6},
+				{x: 5, y: 6},
+				{x: 4, y: 7},
+				{x: 5, y: 7},
+				{x: 4, y: 8},
+			},
+		}},
+
+		{"16x16x12-1-tiles", args{
+			p: golParams{
+				turns:       1,
+				threads:     12,
+				imageWidth:  16,
+				imageHeight: 16,
+				tiled:       true,
+			},
+			expectedAlive: []cell{
+				{x: 3, y: 6},
+				{x: 5, y: 6},
+				{x: 4, y: 7},
+				{x: 5, y: 7},
+				{x: 4, y: 8},
+			},
+		}},
+
+		{"16x16x16-1-tiles", args{
+			p: golParams{
+				turns:       1,
+				threads:     16,
+				imageWidth:  16,
+				imageHeight: 16,
+				tiled:       true,
+			},
+			expectedAlive: []cell{
+				{x: 3, y: 6},
+				{x: 5, y: 6},
+				{x: 4, y: 7},
+				{x: 5, y: 7},
+				{x: 4, y: 8},
+			},
+		}},
+
+		{"16x16x1-100-tiles", args{
+			p: golParams{
+				turns:       100,
+				threads:     1,
+				imageWidth:  16,
+				imageHeight: 16,
+				tiled:       true,
+			},
+			expectedAlive: []cell{
+				{x: 12, y: 0},
+				{x: 13, y: 0},
+				{x: 14, y: 0},
+				{x: 13, y: 14},
+				{x: 14, y: 15},
+			},
+		}},
+
+		{"16x16x4-100-tiles", args{
+			p: golParams{
+				turns:       100,
+				threads:     4,
+				imageWidth:  16,
+				imageHeight: 16,
+				tiled:       true,
+			},
+			expectedAlive: []cell{
+				{x: 12, y: 0},
+				{x: 13, y: 0},
+				{x: 14, y: 0},
+				{x: 13, y: 14},
+				{x: 14, y: 15},
+			},
+		}},
+
+		{"16x16x6-100-tiles", args{
+			p: golParams{
+				turns:       100,
+				threads:     6,
+				imageWidth:  16,
+				imageHeight: 16,
+				tiled:       true,
+			},
+			expectedAlive: []cell{
+				{x: 12, y: 0},
+				{x: 13, y: 0},
+				{x: 14, y: 0},
+				{x: 13, y: 14},
+				{x: 14, y: 15},
+			},
+		}},
+
+		{"16x16x8-100-tiles", args{
+			p: golParams{
+				turns:       100,
+				threads:     8,
+				imageWidth:  16,
+				imageHeight: 16,
+				tiled:       true,
+			},
+			expectedAlive: []cell{
+				{x: 12, y: 0},
+				{x: 13, y: 0},
+				{x: 14, y: 0},
+				{x: 13, y: 14},
+				{x: 14, y: 15},
+			},
+		}},
+
+		{"16x16x9-100-tiles", args{
+			p: golParams{
+				turns:       100,
+				threads:     9,
+				imageWidth:  16,
+				imageHeight: 16,
+				tiled:       true,
+			},
+			expectedAlive: []cell{
+				{x: 12, y: 0},
+				{x: 13, y: 0},
+				{x: 14, y: 0},
+				{x: 13, y: 14},
+				{x: 14, y: 15},
+			},
+		}},
+
+		{"16x16x12-100-tiles", args{
+			p: golParams{
+				turns:       100,
+				threads:     12,
+				imageWidth:  16,
+				imageHeight: 16,
+				tiled:       true,
+			},
+			expectedAlive: []cell{
+				{x: 12, y: 0},
+				{x: 13, y: 0},
+				{x: 14, y: 0},
+				{x: 13, y: 14},
+				{x: 14, y: 15},
+			},
+		}},
+
+		{"16x16x16-100-tiles", args{
+			p: golParams{
+				turns:       100,
+				threads:     16,
+				imageWidth:  16,
+				imageHeight: 16,
+				tiled:       true,
+			},
+			expectedAlive: []cell{
+				{x: 12, y: 0},
+				{x: 13, y: 0},
+				{x: 14, y: 0},
+				{x: 13, y: 14},
+				{x: 14, y: 15},
+			},
+		}},
+
+		// Deep halo tests
+		{"16x16x2-1-depth3", args{
+			p: golParams{
+				turns:       1,
+				threads:     2,
+				imageWidth:  16,
+				imageHeight: 16,
+				haloDepth:   3,
+			},
+			expectedAlive: []cell{
+				{x: 3, y: 6},
+				{x: 5, y: 6},
+				{x: 4, y: 7},
+				{x: 5, y: 7},
+				{x: 4, y: 8},
+			},
+		}},
+
+		{"16x16x4-1-depth4", args{
+			p: golParams{
+				turns:       1,
+				threads:     4,
+				imageWidth:  16,
+				imageHeight: 16,
+				haloDepth:   4,
+			},
+			expectedAlive: []cell{
+				{x: 3, y: 6},
+				{x: 5, y: 6},
+				{x: 4, y: 7},
+				{x: 5, y: 7},
+				{x: 4, y: 8},
+			},
+		}},
+
+		{"16x16x8-1-depth4", args{
+			p: golParams{
+				turns:       1,
+				threads:     8,
+				imageWidth:  16,
+				imageHeight: 16,
+				haloDepth:   4,
+			},
+			expectedAlive: []cell{
+				{x: 3, y: 6},
+				{x: 5, y: 6},
+				{x: 4, y: 7},
+				{x: 5, y: 7},
+				{x: 4, y: 8},
+			},
+		}},
+
+		{"16x16x4-1-depth4-tiles", args{
+			p: golParams{
+				turns:       1,
+				threads:     4,
+				imageWidth:  16,
+				imageHeight: 16,
+				tiled:       true,
+				haloDepth:   4,
+			},
+			expectedAlive: []cell{
+				{x: 3, y: 6},
+				{x: 5, y: 6},
+				{x: 4, y: 7},
+				{x: 5, y: 7},
+				{x: 4, y: 8},
+			},
+		}},
+
+		{"16x16x9-1-depth5-tiles", args{
+			p: golParams{
+				turns:       1,
+				threads:     9,
+				imageWidth:  16,
+				imageHeight: 16,
+				tiled:       true,
+				haloDepth:   5,
+			},
+			expectedAlive: []cell{
+				{x: 3, y: 6},
+				{x: 5, y: 6},
+				{x: 4, y: 7},
+				{x: 5, y: 7},
+				{x: 4, y: 8},
+			},
+		}},
+
+		{"16x16x1-100-depth2", args{
+			p: golParams{
+				turns:       100,
+				threads:     1,
+				imageWidth:  16,
+				imageHeight: 16,
+				haloDepth:   2,
+			},
+			expectedAlive: []cell{
+				{x: 12, y: 0},
+				{x: 13, y: 0},
+				{x: 14, y: 0},
+				{x: 13, y: 14},
+				{x: 14, y: 15},
+			},
+		}},
+
+		{"16x16x2-100-depth3", args{
+			p: golParams{
+				turns:       100,
+				threads:     2,
+				imageWidth:  16,
+				imageHeight: 16,
+				haloDepth:   3,
+			},
+			expectedAlive: []cell{
+				{x: 12, y: 0},
+				{x: 13, y: 0},
+				{x: 14, y: 0},
+				{x: 13, y: 14},
+				{x: 14, y: 15},
+			},
+		}},
+
+		{"16x16x4-100-depth4", args{
+			p: golParams{
+				turns:       100,
+				threads:     4,
+				imageWidth:  16,
+				imageHeight: 16,
+				haloDepth:   4,
+			},
+			expectedAlive: []cell{
+				{x: 12, y: 0},
+				{x: 13, y: 0},
+				{x: 14, y: 0},
+				{x: 13, y: 14},
+				{x: 14, y: 15},
+			},
+		}},
+
+		{"16x16x8-100-depth4", args{
+			p: golParams{
+				turns:       100,
+				threads:     8,
+				imageWidth:  16,
+				imageHeight: 16,
+				haloDepth:   4,
+			},
+			expectedAlive: []cell{
+				{x: 12, y: 0},
+				{x: 13, y: 0},
+				{x: 14, y: 0},
+				{x: 13, y: 14},
+				{x: 14, y: 15},
+			},
+		}},
+
+		{"16x16x4-100-depth3-tiles", args{
+			p: golParams{
+				turns:       100,
+				threads:     4,
+				imageWidth:  16,
+				imageHeight: 16,
+				tiled:       true,
+				haloDepth:   3,
+			},
+			expectedAlive: []cell{
+				{x: 12, y: 0},
+				{x: 13, y: 0},
+				{x: 14, y: 0},
+				{x: 13, y: 14},
+				{x: 14, y: 15},
+			},
+		}},
+
+		{"16x16x9-100-depth5-tiles", args{
+			p: golParams{
+				turns:       100,
+				threads:     9,
+				imageWidth:  16,
+				imageHeight: 16,
+				tiled:       true,
+				haloDepth:   5,
+			},
+			expectedAlive: []cell{
+				{x: 12, y: 0},
+				{x: 13, y: 0},
+				{x: 14, y: 0},
+				{x: 13, y: 14},
+				{x: 14, y: 15},
+			},
+		}},
+
+		{"16x16x16-100-depth4-tiles", args{
+			p: golParams{
+				turns:       100,
+				threads:     16,
+				imageWidth:  16,
+				imageHeight: 16,
+				tiled:       true,
+				haloDepth:   4,
+			},
+			expectedAlive: []cell{
+				{x: 12, y: 0},
+				{x: 13, y: 0},
+				{x: 14, y: 0},
+				{x: 13, y: 14},
+				{x: 14, y: 15},
+			},
+		}},
+
 		// Special test to be used to generate traces - not a real test
 		//{"trace", args{
 		//	p: golParams{
@@ -274,18 +739,84 @@ func Test(t *testing.T) {
 	start := time.Now()
 	// Networking
 	fmt.Println("Waiting for", clientNumber, "clients to connect.")
-	clients = processClients(clientNumber)
+	clients = processClients(clientNumber, true, nil, "")
 	fmt.Println("Waited for", time.Since(start))
 
 	for _, test := range tests {
 		t.Run(test.name, func(t *testing.T) {
-			alive := gameOfLife(test.args.p, nil, clientNumber, clients)
+			alive, err := gameOfLife(test.args.p, nil, clientNumber, clients)
+			assert.NoError(t, err)
 			//fmt.Println("Ran test:", test.name)
 			if test.name != "trace" {
 				assert.ElementsMatch(t, alive, test.args.expectedAlive)
 			}
 		})
 	}
+
+	// Clients run several jobs at once, up to their default limit of 4
+	t.Run("parallel", func(t *testing.T) {
+		running := make(chan byte, 4)
+		results := make([]chan []cell, len(tests))
+		for i, test := range tests {
+			results[i] = make(chan []cell, 1)
+			go func(p golParams, result chan []cell) {
+				running <- 1
+				alive, err := gameOfLife(p, nil, clientNumber, clients)
+				assert.NoError(t, err)
+				result <- alive
+				<-running
+			}(test.args.p, results[i])
+		}
+		for i, test := range tests {
+			assert.ElementsMatch(t, <-results[i], test.args.expectedAlive, test.name)
+		}
+	})
+
+	// Batches run their jobs on the clients, with the rule of each job
+	t.Run("batch", func(t *testing.T) {
+		dir, err := ioutil.TempDir("", "gol-batch")
+		assert.NoError(t, err)
+		defer os.RemoveAll(dir)
+
+		jobFile := filepath.Join(dir, "jobs.txt")
+		assert.NoError(t, ioutil.WriteFile(jobFile, []byte(`images/16x16.pgm B3/S23 16x16 100 4 `+dir+`
+images/16x16.pgm B36/S23 16x16 100 2 `+dir+`
+images/16x16.pgm B/S 16x16 1 1 `+dir+`
+images/64x64.pgm B3/S23 16x16 1 1 `+dir+`
+`), 0644))
+		jobs, err := batch.ReadJobFile(jobFile)
+		assert.NoError(t, err)
+
+		results := runBatch(jobs, 2, golParams{}, func(p golParams) ([]cell, error) {
+			return gameOfLife(p, nil, clientNumber, clients)
+		})
+		assert.Equal(t, 5, results[0].Population)
+		assert.Equal(t, 5, results[1].Population)
+		assert.Equal(t, 0, results[2].Population)
+		assert.Error(t, results[3].Err)
+		for _, r := range results[:3] {
+			assert.NoError(t, r.Err)
+			assert.FileExists(t, r.Image)
+		}
+		assert.NoError(t, batch.WriteManifest(filepath.Join(dir, "manifest.csv"), results))
+	})
+
+	// The glider comes back to where it started every 64 turns, so the turns after the first cycle are skipped
+	t.Run("skip cycles", func(t *testing.T) {
+		p := golParams{turns: 64*15625 + 100, threads: 4, imageWidth: 16, imageHeight: 16, skipCycles: true}
+		alive, err := gameOfLife(p, nil, clientNumber, clients)
+		assert.NoError(t, err)
+		assert.ElementsMatch(t, alive, tests[len(tests)-1].args.expectedAlive)
+	})
+
+	// A lone worker wraps all its halos itself, and still answers the keys
+	t.Run("quit one worker", func(t *testing.T) {
+		keys := make(chan rune, 1)
+		keys <- 'q'
+		p := golParams{turns: 1000000, threads: 1, imageWidth: 512, imageHeight: 512}
+		_, err := gameOfLife(p, keys, clientNumber, clients)
+		assert.NoError(t, err)
+	})
 }
 
 const benchLength = 1000
@@ -464,15 +995,384 @@ func Benchmark(b *testing.B) {
 				imageWidth:  512,
 				imageHeight: 512,
 			}},
+
+		{
+			"512x512x16-tiles", golParams{
+				turns:       benchLength,
+				threads:     16,
+				imageWidth:  512,
+				imageHeight: 512,
+				tiled:       true,
+			}},
+
+		{
+			"512x512x64-tiles", golParams{
+				turns:       benchLength,
+				threads:     64,
+				imageWidth:  512,
+				imageHeight: 512,
+				tiled:       true,
+			}},
+
+		{
+			"512x512x128-tiles", golParams{
+				turns:       benchLength,
+				threads:     128,
+				imageWidth:  512,
+				imageHeight: 512,
+				tiled:       true,
+			}},
+
+		{
+			"512x512x8-depth4", golParams{
+				turns:       benchLength,
+				threads:     8,
+				imageWidth:  512,
+				imageHeight: 512,
+				haloDepth:   4,
+			}},
+
+		{
+			"512x512x16-depth4", golParams{
+				turns:       benchLength,
+				threads:     16,
+				imageWidth:  512,
+				imageHeight: 512,
+				haloDepth:   4,
+			}},
+
+		{
+			"512x512x64-depth4", golParams{
+				turns:       benchLength,
+				threads:     64,
+				imageWidth:  512,
+				imageHeight: 512,
+				haloDepth:   4,
+			}},
+
+		{
+			"512x512x64-tiles-depth4", golParams{
+				turns:       benchLength,
+				threads:     64,
+				imageWidth:  512,
+				imageHeight: 512,
+				tiled:       true,
+				haloDepth:   4,
+			}},
 	}
 
 	for _, bm := range benchmarks {
 		os.Stdout = nil // Disable all program output apart from benchmark results
 		b.Run(bm.name, func(b *testing.B) {
 			for i := 0; i < b.N; i++ {
-				gameOfLife(bm.p, nil, clientNumber, clients)
+				_, err := gameOfLife(bm.p, nil, clientNumber, clients)
+				if err != nil {
+					b.Fatal(err)
+				}
 				//fmt.Println("Ran bench:", bm.name)
 			}
 		})
 	}
 }
+
+func TestCompression(t *testing.T) {
+	sparse := make([]byte, 512*512)
+	for _, c := range []cell{{4, 5}, {5, 6}, {3, 7}, {4, 7}, {5, 7}} {
+		sparse[c.y*512+c.x] = 0xFF
+	}
+	dense := make([]byte, 1000)
+	for i := range dense {
+		if (i*7919)%3 == 0 {
+			dense[i] = 0xFF
+		}
+	}
+	full := make([]byte, 1000)
+	for i := range full {
+		full[i] = 0xFF
+	}
+
+	tests := []struct {
+		name  string
+		cells []byte
+	}{
+		{"empty", []byte{}},
+		{"single", []byte{0xFF}},
+		{"odd", []byte{0xFF, 0, 0, 0xFF, 0xFF, 0, 0xFF, 0, 0, 0xFF, 0xFF}},
+		{"sparse", sparse},
+		{"dense", dense},
+		{"full", full},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			cells, err := protocol.Decompress(protocol.Compress(test.cells), len(test.cells))
+			assert.NoError(t, err)
+			assert.Equal(t, test.cells, cells)
+		})
+	}
+
+	// A glider on a 512x512 world takes a few hundred bytes rather than one byte per cell
+	assert.True(t, len(protocol.Compress(sparse)) < len(sparse)/100)
+
+	_, err := protocol.Decompress([]byte{5, 3, 0xFF}, 5)
+	assert.Error(t, err)
+
+	// Data holding more cells than expected is refused, however few bytes it takes
+	_, err = protocol.Decompress(protocol.Compress(sparse), 64)
+	assert.Error(t, err)
+	_, err = protocol.Decompress(append([]byte{64}, bytes.Repeat([]byte{0x81, 0xFF}, 100)...), 64)
+	assert.Error(t, err)
+
+	_, err = protocol.Unflatten(make([]byte, 16), 0)
+	assert.Error(t, err)
+	_, err = protocol.Unflatten(make([]byte, 16), 3)
+	assert.Error(t, err)
+	world, err := protocol.Unflatten(make([]byte, 16), 4)
+	assert.NoError(t, err)
+	assert.Len(t, world, 4)
+}
+
+// Worlds which cannot be decompressed, and messages from workers which do not exist, fail the job
+func TestCorruptMessages(t *testing.T) {
+	in := make(chan protocol.Message, 4)
+	workers := make([]workerData, 1)
+	initialiseChannels(workers)
+	tiles := []tile{{0, 4, 0, 4}}
+	failures, stopped := make(chan error, 1), make(chan byte, 1)
+	go listenToWorker(in, workers, tiles, failures, stopped, nil)
+
+	in <- protocol.Message{Kind: protocol.WorldMessage, Worker: 0, Packed: []byte{0x80}}
+	assert.Empty(t, <-workers[0].outputWorld)
+	assert.Error(t, <-failures)
+	in <- protocol.Message{Kind: protocol.WorldMessage, Worker: 0, Packed: protocol.Compress(make([]byte, 15))}
+	assert.Empty(t, <-workers[0].outputWorld)
+	assert.Error(t, <-failures)
+	in <- protocol.Message{Kind: protocol.StatusMessage, Worker: 3}
+	assert.Error(t, <-failures)
+	in <- protocol.Message{Kind: protocol.ReportMessage, Worker: 0, Report: &protocol.TurnReport{Turn: 1}}
+	assert.Error(t, <-failures)
+	in <- protocol.Message{Kind: protocol.RejectMessage, Error: "halo from client 1: halo has 3 cells instead of 4"}
+	assert.Error(t, <-failures)
+	in <- protocol.Message{Kind: protocol.WorldMessage, Worker: 0, Packed: protocol.Compress(make([]byte, 16))}
+	assert.Len(t, <-workers[0].outputWorld, 4)
+	assert.Empty(t, failures)
+
+	in <- protocol.Message{Kind: protocol.ShutdownMessage}
+	<-stopped
+}
+
+// Tests that a job which does not read its messages does not hold up the other jobs on the connection
+func TestStalledJob(t *testing.T) {
+	r := &router{jobs: make(map[int]route)}
+	stalled := addJob(r, 1, 1)
+	running := addJob(r, 2, 1)
+
+	client, server := net.Pipe()
+	defer client.Close()
+	go routeMessages(gob.NewDecoder(server), r)
+
+	// The pipe has no buffer, so sending waits for the router to take each message
+	routed := make(chan byte)
+	go func() {
+		encoder := gob.NewEncoder(client)
+		for i := 0; i < 100; i++ {
+			_ = encoder.Encode(protocol.Message{Job: 1, Data: i})
+		}
+		_ = encoder.Encode(protocol.Message{Job: 2})
+		routed <- 1
+	}()
+
+	select {
+	case <-routed:
+	case <-time.After(time.Second):
+		t.Fatal("messages of a stalled job held up the other jobs")
+	}
+	assert.Equal(t, 2, (<-running).Job)
+	for i := 0; i < 100; i++ {
+		assert.Equal(t, i, (<-stalled).Data)
+	}
+	removeJob(r, 1)
+	removeJob(r, 2)
+	assert.Empty(t, r.jobs)
+}
+
+func TestHandshake(t *testing.T) {
+	// Runs a handshake over an in-memory connection, returning what both ends agreed
+	authorise := func(h protocol.Hello) error {
+		if h.Token != "secret" {
+			return errors.New("wrong token")
+		}
+		return nil
+	}
+	handshake := func(h protocol.Hello, serverCapabilities []string) (protocol.Welcome, []string, error) {
+		clientConn, serverConn := net.Pipe()
+		defer clientConn.Close()
+		defer serverConn.Close()
+
+		type result struct {
+			shared []string
+			err    error
+		}
+		server := make(chan result)
+		go func() {
+			_, shared, err := protocol.AcceptHello(gob.NewEncoder(serverConn), gob.NewDecoder(serverConn), serverCapabilities, authorise)
+			server <- result{shared, err}
+		}()
+
+		var w protocol.Welcome
+		assert.NoError(t, gob.NewEncoder(clientConn).Encode(h))
+		assert.NoError(t, gob.NewDecoder(clientConn).Decode(&w))
+		r := <-server
+		return w, r.shared, r.err
+	}
+
+	t.Run("capabilities", func(t *testing.T) {
+		w, shared, err := handshake(protocol.Hello{Protocol: protocol.Name, Version: protocol.Version, Capabilities: protocol.Capabilities(true), Token: "secret"}, protocol.Capabilities(true))
+		assert.NoError(t, err)
+		assert.Empty(t, w.Error)
+		assert.Equal(t, []string{protocol.CompressionCapability}, w.Capabilities)
+		assert.Equal(t, w.Capabilities, shared)
+
+		w, _, err = handshake(protocol.Hello{Protocol: protocol.Name, Version: protocol.Version, Capabilities: protocol.Capabilities(false), Token: "secret"}, protocol.Capabilities(true))
+		assert.NoError(t, err)
+		assert.False(t, protocol.HasCapability(w.Capabilities, protocol.CompressionCapability))
+	})
+
+	t.Run("version", func(t *testing.T) {
+		w, _, err := handshake(protocol.Hello{Protocol: protocol.Name, Version: protocol.Version + 1, Capabilities: protocol.Capabilities(true), Token: "secret"}, protocol.Capabilities(true))
+		assert.Error(t, err)
+		assert.Contains(t, w.Error, "version")
+		assert.Empty(t, w.Capabilities)
+	})
+
+	t.Run("protocol", func(t *testing.T) {
+		w, _, err := handshake(protocol.Hello{Protocol: "http", Version: protocol.Version, Token: "secret"}, protocol.Capabilities(true))
+		assert.Error(t, err)
+		assert.NotEmpty(t, w.Error)
+	})
+
+	t.Run("token", func(t *testing.T) {
+		w, _, err := handshake(protocol.Hello{Protocol: protocol.Name, Version: protocol.Version, Capabilities: protocol.Capabilities(true), Token: "guess"}, protocol.Capabilities(true))
+		assert.Error(t, err)
+		assert.Contains(t, w.Error, "token")
+	})
+
+	t.Run("client", func(t *testing.T) {
+		clientConn, serverConn := net.Pipe()
+		defer clientConn.Close()
+		defer serverConn.Close()
+		go func() {
+			_, _, _ = protocol.AcceptHello(gob.NewEncoder(serverConn), gob.NewDecoder(serverConn), protocol.Capabilities(false), authorise)
+		}()
+
+		shared, err := protocol.SendHello(gob.NewEncoder(clientConn), gob.NewDecoder(clientConn), protocol.Hello{Capabilities: protocol.Capabilities(true), Token: "secret"})
+		assert.NoError(t, err)
+		assert.Empty(t, shared)
+	})
+}
+
+// Writes a certificate for 127.0.0.1 and its key to dir, signed by parent or self-signed if parent is nil
+func writeCertificate(t *testing.T, dir, name string, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey, string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	if parent == nil {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+		parent, parentKey = template, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	assert.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	assert.NoError(t, err)
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	assert.NoError(t, err)
+
+	certFile := filepath.Join(dir, name+".pem")
+	keyFile := filepath.Join(dir, name+"-key.pem")
+	assert.NoError(t, ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600))
+	assert.NoError(t, ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600))
+	return cert, key, certFile, keyFile
+}
+
+func TestTLS(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gol-tls")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	ca, caKey, caFile, _ := writeCertificate(t, dir, "ca", nil, nil)
+	_, _, serverCert, serverKey := writeCertificate(t, dir, "server", ca, caKey)
+	_, _, clientCert, clientKey := writeCertificate(t, dir, "client", ca, caKey)
+	other, otherKey, _, _ := writeCertificate(t, dir, "other-ca", nil, nil)
+	_, _, strangerCert, strangerKey := writeCertificate(t, dir, "stranger", other, otherKey)
+
+	serverConfig, err := protocol.LoadTLS(serverCert, serverKey, caFile)
+	assert.NoError(t, err)
+
+	// Runs a handshake between the server and a client using config, returning the errors at both ends
+	connect := func(config *tls.Config) (error, error) {
+		ln, err := protocol.Listen("127.0.0.1:0", serverConfig)
+		assert.NoError(t, err)
+		defer ln.Close()
+
+		server := make(chan error)
+		go func() {
+			conn, err := ln.Accept()
+			if err != nil {
+				server <- err
+				return
+			}
+			defer conn.Close()
+			_, _, err = protocol.AcceptHello(gob.NewEncoder(conn), gob.NewDecoder(conn), nil, func(protocol.Hello) error { return nil })
+			server <- err
+		}()
+
+		conn, err := protocol.Dial(ln.Addr().String(), config)
+		if err == nil {
+			_, err = protocol.SendHello(gob.NewEncoder(conn), gob.NewDecoder(conn), protocol.Hello{})
+			conn.Close()
+		}
+		return err, <-server
+	}
+
+	t.Run("mutual", func(t *testing.T) {
+		config, err := protocol.LoadTLS(clientCert, clientKey, caFile)
+		assert.NoError(t, err)
+		clientErr, serverErr := connect(config)
+		assert.NoError(t, clientErr)
+		assert.NoError(t, serverErr)
+	})
+
+	t.Run("no certificate", func(t *testing.T) {
+		config := serverConfig.Clone()
+		config.Certificates = nil
+		clientErr, serverErr := connect(config)
+		assert.Error(t, clientErr)
+		assert.Error(t, serverErr)
+	})
+
+	t.Run("other CA", func(t *testing.T) {
+		config, err := protocol.LoadTLS(strangerCert, strangerKey, caFile)
+		assert.NoError(t, err)
+		clientErr, serverErr := connect(config)
+		assert.Error(t, clientErr)
+		assert.Error(t, serverErr)
+	})
+
+	t.Run("files", func(t *testing.T) {
+		config, err := protocol.LoadTLS("", "", "")
+		assert.NoError(t, err)
+		assert.Nil(t, config)
+
+		_, err = protocol.LoadTLS(clientCert, clientKey, "")
+		assert.Error(t, err)
+	})
+}
@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"io/ioutil"
 	"os"
+	"path/filepath"
 	"strconv"
 	"strings"
 )
@@ -17,10 +18,14 @@ func check(e error) {
 // writePgmImage receives an array of bytes and writes it to a pgm file.
 // Note that this function is incomplete. Use the commented-out for loop to receive data from the distributor.
 func writePgmImage(p golParams, i ioChans) {
-	_ = os.Mkdir("out", os.ModePerm)
+	dir := "out"
+	if p.outputDir != "" {
+		dir = p.outputDir
+	}
+	_ = os.MkdirAll(dir, os.ModePerm)
 
 	filename := <-i.distributor.filename
-	file, ioError := os.Create("out/" + filename + ".pgm")
+	file, ioError := os.Create(filepath.Join(dir, filename+".pgm"))
 	check(ioError)
 	defer file.Close()
 
@@ -61,7 +66,11 @@ func writePgmImage(p golParams, i ioChans) {
 // readPgmImage opens a pgm file and sends its data as an array of bytes.
 func readPgmImage(p golParams, i ioChans) {
 	filename := <-i.distributor.filename
-	data, ioError := ioutil.ReadFile("images/" + filename + ".pgm")
+	path := "images/" + filename + ".pgm"
+	if p.input != "" {
+		path = p.input
+	}
+	data, ioError := ioutil.ReadFile(path)
 	check(ioError)
 
 	fields := strings.Fields(string(data))
@@ -109,3 +118,36 @@ func pgmIo(p golParams, i ioChans) {
 		}
 	}
 }
+
+// Returns the width and height of a pgm file, or why it cannot be read
+func pgmSize(path string) (int, int, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	fields := strings.Fields(string(data))
+	if len(fields) < 4 || fields[0] != "P5" {
+		return 0, 0, fmt.Errorf("%s is not a pgm file", path)
+	}
+	width, err := strconv.Atoi(fields[1])
+	if err != nil {
+		return 0, 0, fmt.Errorf("%s has an invalid width", path)
+	}
+	height, err := strconv.Atoi(fields[2])
+	if err != nil {
+		return 0, 0, fmt.Errorf("%s has an invalid height", path)
+	}
+	return width, height, nil
+}
+
+// Writes a pgm file of the given size, with the alive cells set
+func writePgm(path string, width, height int, alive []cell) error {
+	image := make([]byte, width*height)
+	for _, c := range alive {
+		image[c.y*width+c.x] = 0xFF
+	}
+
+	header := "P5\n" + strconv.Itoa(width) + " " + strconv.Itoa(height) + "\n255\n"
+	return ioutil.WriteFile(path, append([]byte(header), image...), 0644)
+}
@@ -1,15 +1,16 @@
 package main
 
 import (
+	"crypto/tls"
 	"encoding/gob"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
 	"net"
-)
-
-const (
-	INIT = 0
+	"strings"
+	"sync"
+	"uk.ac.bris.cs/gameoflife/protocol"
 )
 
 const (
@@ -20,138 +21,261 @@ const (
 	save   = iota
 )
 
-type initPackage struct {
-	Clients           int
-	Workers           int
-	IpBefore, IpAfter string
-	Turns             int
-	Width             int
-}
-
-type workerPackage struct {
-	StartX int
-	EndX   int
-	World  [][]byte
-	Index  int
-}
+// Row and column offset of each halo direction, clockwise from the row above
+var offsets = [8][2]int{{-1, 0}, {-1, 1}, {0, 1}, {1, 1}, {1, 0}, {1, -1}, {0, -1}, {-1, -1}}
 
 type workerChannel struct {
-	inputHalo        [2]chan byte
-	outputHalo       [2]chan byte
+	inputHalo        [8]chan []byte
+	outputHalo       [8]chan []byte
 	distributorInput chan int
 	localDistributor chan byte
 }
 
-type distributorPackage struct {
-	Index       int
-	Type        int
-	Data        int
-	OutputWorld [][]byte
+// Connection to a client which this client sends halos to
+type haloClient struct {
+	conn     net.Conn
+	encoder  *gob.Encoder
+	compress bool
+}
+
+// Halo of a local worker which has to be sent to a worker on another client
+type remoteHalo struct {
+	worker, direction, neighbour, owner int
 }
 
-type controllerData struct {
-	Index, Data int
+// Returns the direction pointing the other way
+func opposite(direction int) int {
+	return (direction + 4) % 8
 }
 
-// Returns the new state of a cell from the number of alive neighbours and current state
-func getNewState(numberOfAlive int, cellState bool) int {
+// Returns the new state of a cell from the number of alive neighbours and current state, under rule r
+func getNewState(r protocol.Rule, numberOfAlive int, cellState bool) int {
 	if cellState == true {
-		if numberOfAlive < 2 {
+		if !r.Survive[numberOfAlive] {
 			return -1
 		}
-		if numberOfAlive <= 3 {
-			return 0
-		}
-		if numberOfAlive > 3 {
-			return -1
+	} else if r.Born[numberOfAlive] {
+		return 1
+	}
+	return 0
+}
+
+// Returns the range covered by a halo along one axis of a worker's world, for halos of the given depth.
+// Ghost halos lie outside the tile, edge halos are the cells of the tile a neighbour needs.
+func haloSpan(offset, length, depth int, ghost bool) (int, int) {
+	switch {
+	case offset == 0:
+		return depth, depth + length
+	case offset < 0 && ghost:
+		return 0, depth
+	case offset < 0:
+		return depth, 2 * depth
+	case ghost:
+		return depth + length, 2*depth + length
+	default:
+		return length, depth + length
+	}
+}
+
+// Returns the rows and columns of the halo in a direction, for a tile of the given size with halos of the given depth
+func haloRegion(direction, height, width, depth int, ghost bool) (startX, endX, startY, endY int) {
+	startX, endX = haloSpan(offsets[direction][0], height, depth, ghost)
+	startY, endY = haloSpan(offsets[direction][1], width, depth, ghost)
+	return
+}
+
+// Fills the halo in a direction from the opposite edge of the same worker, when it is its own neighbour
+func wrapHalo(world [][]byte, direction, depth int) {
+	height, width := len(world)-2*depth, len(world[0])-2*depth
+	startX, endX, startY, endY := haloRegion(direction, height, width, depth, true)
+	fromX, _, fromY, _ := haloRegion(opposite(direction), height, width, depth, false)
+	for i := startX; i < endX; i++ {
+		copy(world[i][startY:endY], world[fromX+i-startX][fromY:fromY+endY-startY])
+	}
+}
+
+// Returns true if every element is true
+func all(flags [8]bool) bool {
+	for _, f := range flags {
+		if !f {
+			return false
 		}
-	} else {
-		if numberOfAlive == 3 {
-			return 1
+	}
+	return true
+}
+
+// Tells the distributor the current turn, then waits for the turn to stop after.
+// Returns false if the job was stopped instead.
+func interrupt(channels workerChannel, wp protocol.WorkerPackage, encoder jobEncoder, turn int, stopAtTurn *int) bool {
+	sendStatus(encoder, wp.Index, turn)
+	t, open := <-channels.distributorInput
+	*stopAtTurn = t
+	return open
+}
+
+// Sends a status reply of a worker to the distributor
+func sendStatus(encoder jobEncoder, index, data int) {
+	err := encoder.Encode(protocol.Message{Kind: protocol.StatusMessage, Worker: index, Data: data})
+	if err != nil {
+		fmt.Println("err", err)
+	}
+}
+
+// Sends the tile of a worker to the distributor, compressed if the connection is
+func sendWorld(encoder jobEncoder, index int, world [][]byte, compressed bool) {
+	m := protocol.Message{Kind: protocol.WorldMessage, Worker: index, World: world}
+	if compressed {
+		m.Packed = protocol.Compress(protocol.Flatten(world))
+		m.World = nil
+	}
+	err := encoder.Encode(m)
+	if err != nil {
+		fmt.Println("err", err)
+	}
+}
+
+// Returns what changed in the tile of a worker in a turn, from its world before and after the turn.
+// The cells are placed in the whole world, so the reports of every worker can be combined.
+func tileReport(p protocol.InitPackage, wp protocol.WorkerPackage, world, newWorld [][]byte, turn int) protocol.TurnReport {
+	r := protocol.TurnReport{Turn: turn}
+	for i := 0; i < wp.EndX-wp.StartX; i++ {
+		for j := 0; j < wp.EndY-wp.StartY; j++ {
+			was, alive := world[i+p.Depth][j+p.Depth] == 0xFF, newWorld[i+p.Depth][j+p.Depth] == 0xFF
+			c := protocol.Cell{X: wp.StartY + j, Y: wp.StartX + i}
+			if alive {
+				// Rows are read in order, so only the columns can move the bounds back
+				if r.Population == 0 {
+					r.Min = c
+				}
+				if c.X < r.Min.X {
+					r.Min.X = c.X
+				}
+				if c.X > r.Max.X || r.Population == 0 {
+					r.Max.X = c.X
+				}
+				r.Max.Y = c.Y
+				r.Population++
+				r.Hash ^= protocol.CellHash(c.X, c.Y)
+			}
+			if alive != was {
+				if alive {
+					r.Births++
+				} else {
+					r.Deaths++
+				}
+				if p.Reports == protocol.FlipReports {
+					r.Flipped = append(r.Flipped, c)
+				}
+			}
 		}
 	}
-	return 0
+	return r
 }
 
-func worker(p initPackage, channels workerChannel, wp workerPackage, encoder *gob.Encoder) {
-	endX := wp.EndX
-	startX := wp.StartX
-	endY := p.Width
-	startY := 0
+// Sends the report of a worker's tile after a turn to the distributor
+func sendReport(encoder jobEncoder, index int, report protocol.TurnReport) {
+	err := encoder.Encode(protocol.Message{Kind: protocol.ReportMessage, Worker: index, Report: &report})
+	if err != nil {
+		fmt.Println("err", err)
+	}
+}
 
-	world := make([][]byte, endX-startX+2)
-	for i := range world {
-		world[i] = make([]byte, endY-startY)
+// Copies the cells of a halo region into a single slice, so it can be sent as one message
+func packHalo(world [][]byte, startX, endX, startY, endY int) []byte {
+	halo := make([]byte, 0, (endX-startX)*(endY-startY))
+	for i := startX; i < endX; i++ {
+		halo = append(halo, world[i][startY:endY]...)
+	}
+	return halo
+}
+
+// Copies a halo received as one message into its region
+func unpackHalo(world [][]byte, halo []byte, startX, endX, startY, endY int) {
+	for i := startX; i < endX; i++ {
+		copy(world[i][startY:endY], halo[(i-startX)*(endY-startY):])
+	}
+}
+
+// Receive halo, or receive command from distributor. Returns false if the job was stopped.
+func receiveOrInterrupt(world [][]byte, channels workerChannel, wp protocol.WorkerPackage, encoder jobEncoder, turn int, halo *bool, stopAtTurn *int, direction, depth int) bool {
+	select {
+	case h := <-channels.inputHalo[direction]:
+		startX, endX, startY, endY := haloRegion(direction, len(world)-2*depth, len(world[0])-2*depth, depth, true)
+		unpackHalo(world, h, startX, endX, startY, endY)
+		*halo = true
+	case _, open := <-channels.distributorInput:
+		return open && interrupt(channels, wp, encoder, turn, stopAtTurn)
+	}
+	return true
+}
+
+// Send halo, or receive command from distributor. Returns false if the job was stopped.
+func sendOrInterrupt(world [][]byte, channels workerChannel, wp protocol.WorkerPackage, encoder jobEncoder, turn int, out *bool, stopAtTurn *int, direction, depth int) bool {
+	startX, endX, startY, endY := haloRegion(direction, len(world)-2*depth, len(world[0])-2*depth, depth, false)
+	select {
+	case channels.outputHalo[direction] <- packHalo(world, startX, endX, startY, endY):
+		*out = true
+	case _, open := <-channels.distributorInput:
+		return open && interrupt(channels, wp, encoder, turn, stopAtTurn)
 	}
+	return true
+}
+
+// Halos are exchanged every p.Depth turns. In between, the worker also computes the cells of its halos
+// which are still valid, which are one fewer in every direction each turn.
+func worker(p protocol.InitPackage, channels workerChannel, wp protocol.WorkerPackage, encoder jobEncoder, compressed bool) {
+	height := wp.EndX - wp.StartX
+	width := wp.EndY - wp.StartY
+	depth := p.Depth
 
-	newWorld := make([][]byte, endX-startX+2)
+	world := make([][]byte, height+2*depth)
 	for i := range world {
-		newWorld[i] = make([]byte, endY-startY)
+		world[i] = make([]byte, width+2*depth)
 	}
 
+	newWorld := make([][]byte, height+2*depth)
 	for i := range world {
-		for j := 0; j < endY; j++ {
-			newWorld[i][j] = wp.World[i][j]
-		}
+		newWorld[i] = make([]byte, width+2*depth)
 	}
 
 	for i := range world {
-		for j := range world[i] {
-			world[i][j] = newWorld[i][j]
-		}
+		copy(newWorld[i], wp.World[i])
+		copy(world[i], newWorld[i])
 	}
 
-	halo0 := true
-	halo1 := true
+	halos := [8]bool{true, true, true, true, true, true, true, true}
 	stopAtTurn := -2
 
 	for turn := 0; turn < p.Turns; {
 
 		if turn == stopAtTurn+1 {
-			err := encoder.Encode(distributorPackage{
-				Index:       wp.Index,
-				Type:        0,
-				Data:        pause,
-				OutputWorld: nil,
-			})
-			if err != nil {
-				fmt.Println("err", err)
-			}
+			sendStatus(encoder, wp.Index, pause)
 			for {
-				r := <-channels.distributorInput
+				r, open := <-channels.distributorInput
+				if !open {
+					r = quit
+				}
 				if r == resume {
 					break
 				} else if r == save {
-					err := encoder.Encode(distributorPackage{
-						Index:       wp.Index,
-						Type:        1,
-						Data:        0,
-						OutputWorld: newWorld[1 : endX-startX+1],
-					})
-					if err != nil {
-						fmt.Println("err", err)
+					outputWorld := make([][]byte, height)
+					for i := range outputWorld {
+						outputWorld[i] = newWorld[i+depth][depth : width+depth]
 					}
+					sendWorld(encoder, wp.Index, outputWorld, compressed)
 				} else if r == quit {
 					channels.localDistributor <- 1
 					return
 				} else if r == ping {
 					alive := 0
-					for i := 1; i < endX-startX+1; i++ {
-						for j := startY; j < endY; j++ {
+					for i := depth; i < height+depth; i++ {
+						for j := depth; j < width+depth; j++ {
 							if newWorld[i][j] == 0xFF {
 								alive++
 							}
 						}
 					}
-					err := encoder.Encode(distributorPackage{
-						Index:       wp.Index,
-						Type:        0,
-						Data:        alive,
-						OutputWorld: nil,
-					})
-					if err != nil {
-						fmt.Println("err", err)
-					}
+					sendStatus(encoder, wp.Index, alive)
 					break
 				} else {
 					fmt.Println("Something went wrong, r = ", r)
@@ -159,72 +283,45 @@ func worker(p initPackage, channels workerChannel, wp workerPackage, encoder *go
 			}
 		}
 
+		// Workers without neighbours never wait for halos, so they check for a command between turns
+		select {
+		case _, open := <-channels.distributorInput:
+			if !open || !interrupt(channels, wp, encoder, turn, &stopAtTurn) {
+				channels.localDistributor <- 1
+				return
+			}
+		default:
+		}
+
 		// Process something
-		if turn != 0 {
-			if !halo0 {
-				select {
-				case c := <-channels.inputHalo[0]:
-					world[0][0] = c
-					for j := 1; j < endY; j++ {
-						world[0][j] = <-channels.inputHalo[0]
-					}
-					halo0 = true
-				case <-channels.distributorInput:
-					err := encoder.Encode(distributorPackage{
-						Index:       wp.Index,
-						Type:        0,
-						Data:        turn,
-						OutputWorld: nil,
-					})
-					if err != nil {
-						fmt.Println("err", err)
-					}
-					stopAtTurn = <-channels.distributorInput
-				}
+		for direction := range halos {
+			if halos[direction] {
+				continue
 			}
-			if !halo1 {
-				select {
-				case c := <-channels.inputHalo[1]:
-					world[endX-startX+1][0] = c
-					for j := 1; j < endY; j++ {
-						world[endX-startX+1][j] = <-channels.inputHalo[1]
-					}
-					halo1 = true
-				case <-channels.distributorInput:
-					err := encoder.Encode(distributorPackage{
-						Index:       wp.Index,
-						Type:        0,
-						Data:        turn,
-						OutputWorld: nil,
-					})
-					if err != nil {
-						fmt.Println("err", err)
-					}
-					stopAtTurn = <-channels.distributorInput
-				}
+			if channels.inputHalo[direction] == nil {
+				// This worker is its own neighbour
+				wrapHalo(world, direction, depth)
+				halos[direction] = true
+			} else if !receiveOrInterrupt(world, channels, wp, encoder, turn, &halos[direction], &stopAtTurn, direction, depth) {
+				channels.localDistributor <- 1
+				return
 			}
 		}
 
 		// Move on to next turn
-		if halo0 && halo1 {
+		if all(halos) {
+			// Cells computed beyond the tile in each direction
+			extra := depth - 1 - turn%depth
 
-			for i := 1; i < endX-startX+1; i++ {
-				for j := startY; j < endY; j++ {
+			for i := depth - extra; i < height+depth+extra; i++ {
+				for j := depth - extra; j < width+depth+extra; j++ {
 					// Compute alive neighbours
-					aliveNeighbours := 0
-
-					yp1 := (j + 1) % endY
-					ym1 := j - 1
-					if ym1 < 0 {
-						ym1 += endY
-					}
-
-					aliveNeighbours = int(world[i+1][j]) + int(world[i-1][j]) +
-						int(world[i][yp1]) + int(world[i][ym1]) +
-						int(world[i+1][yp1]) + int(world[i+1][ym1]) +
-						int(world[i-1][yp1]) + int(world[i-1][ym1])
+					aliveNeighbours := int(world[i+1][j]) + int(world[i-1][j]) +
+						int(world[i][j+1]) + int(world[i][j-1]) +
+						int(world[i+1][j+1]) + int(world[i+1][j-1]) +
+						int(world[i-1][j+1]) + int(world[i-1][j-1])
 
-					switch getNewState(aliveNeighbours/255, world[i][j] == 0xFF) {
+					switch getNewState(p.Rule, aliveNeighbours/255, world[i][j] == 0xFF) {
 					case -1:
 						newWorld[i][j] = 0x00
 					case 1:
@@ -234,81 +331,45 @@ func worker(p initPackage, channels workerChannel, wp workerPackage, encoder *go
 					}
 				}
 			}
-			halo0 = false
-			halo1 = false
 			turn++
+			if p.Reports != protocol.NoReports {
+				sendReport(encoder, wp.Index, tileReport(p, wp, world, newWorld, turn))
+			}
 
-			out0 := false
-			out1 := false
-			for !(out0 && out1) {
-				if !out0 {
-					select {
-					case channels.outputHalo[0] <- newWorld[1][0]:
-						for j := 1; j < endY; j++ {
-							channels.outputHalo[0] <- newWorld[1][j]
-						}
-						out0 = true
-					case <-channels.distributorInput:
-						err := encoder.Encode(distributorPackage{
-							Index:       wp.Index,
-							Type:        0,
-							Data:        turn,
-							OutputWorld: nil,
-						})
-						if err != nil {
-							fmt.Println("err", err)
-						}
-						stopAtTurn = <-channels.distributorInput
-					}
-				}
-				if !out1 {
-					select {
-					case channels.outputHalo[1] <- newWorld[endX-startX][0]:
-						for j := 1; j < endY; j++ {
-							channels.outputHalo[1] <- newWorld[endX-startX][j]
+			// Send the halos once they have run out
+			if turn%depth == 0 && turn < p.Turns {
+				halos = [8]bool{}
+				var out [8]bool
+				for !all(out) {
+					for direction := range out {
+						if out[direction] {
+							continue
 						}
-						out1 = true
-					case <-channels.distributorInput:
-						err := encoder.Encode(distributorPackage{
-							Index:       wp.Index,
-							Type:        0,
-							Data:        turn,
-							OutputWorld: nil,
-						})
-						if err != nil {
-							fmt.Println("err", err)
+						if channels.outputHalo[direction] == nil {
+							out[direction] = true
+						} else if !sendOrInterrupt(newWorld, channels, wp, encoder, turn, &out[direction], &stopAtTurn, direction, depth) {
+							channels.localDistributor <- 1
+							return
 						}
-						stopAtTurn = <-channels.distributorInput
 					}
 				}
 			}
 
 			for i := range world {
-				for j := range world[i] {
-					world[i][j] = newWorld[i][j]
-				}
+				copy(world[i], newWorld[i])
 			}
 		}
 
 	}
 
-	err := encoder.Encode(distributorPackage{
-		Index:       wp.Index,
-		Type:        1,
-		Data:        0,
-		OutputWorld: newWorld[1 : endX-startX+1],
-	})
-	if err != nil {
-		fmt.Println("err", err)
+	outputWorld := make([][]byte, height)
+	for i := range outputWorld {
+		outputWorld[i] = newWorld[i+depth][depth : width+depth]
 	}
+	sendWorld(encoder, wp.Index, outputWorld, compressed)
 
 	// Done
-	err = encoder.Encode(distributorPackage{
-		Index:       wp.Index,
-		Type:        -1,
-		Data:        -1,
-		OutputWorld: nil,
-	})
+	err := encoder.Encode(protocol.Message{Kind: protocol.DoneMessage, Worker: wp.Index})
 	if err != nil {
 		fmt.Println("err", err)
 	}
@@ -316,287 +377,592 @@ func worker(p initPackage, channels workerChannel, wp workerPackage, encoder *go
 	channels.localDistributor <- 0
 }
 
-func initialiseChannels(workerChannels []workerChannel, workers, clients, imageWidth, endX, startX, i int) {
-	workerChannels[i].inputHalo[0] = make(chan byte, imageWidth)
-	workerChannels[i].inputHalo[1] = make(chan byte, imageWidth)
-	workerChannels[i].localDistributor = make(chan byte)
-	workerChannels[i].distributorInput = make(chan int, 1)
-
-	if workers == 1 && clients > 1 {
-		// Just one client
-		workerChannels[0].outputHalo[0] = make(chan byte, imageWidth)
-		workerChannels[0].outputHalo[1] = make(chan byte, imageWidth)
-	} else if workers == 1 {
-		workerChannels[0].outputHalo[0] = workerChannels[0].inputHalo[1]
-		workerChannels[0].outputHalo[1] = workerChannels[0].inputHalo[0]
-	} else if i == 0 {
-		workerChannels[0].outputHalo[0] = make(chan byte, imageWidth)
-		workerChannels[i+1].outputHalo[0] = workerChannels[i].inputHalo[1]
-	} else {
-		if i == workers-1 {
-			workerChannels[workers-1].outputHalo[1] = make(chan byte, imageWidth)
-			workerChannels[i-1].outputHalo[1] = workerChannels[i].inputHalo[0]
-		} else {
-			workerChannels[i-1].outputHalo[1] = workerChannels[i].inputHalo[0]
-			workerChannels[i+1].outputHalo[0] = workerChannels[i].inputHalo[1]
-		}
+// Links the halo channels of the local workers.
+// Returns the halos which have to be sent to other clients, and the clients hosting them.
+func initialiseChannels(workerChannels []workerChannel, workerPackages []protocol.WorkerPackage, initP protocol.InitPackage) ([]remoteHalo, []int) {
+	firstWorker := workerPackages[0].Index
+	var remote []remoteHalo
+	var peers []int
 
+	for i := range workerChannels {
+		workerChannels[i].localDistributor = make(chan byte)
+		workerChannels[i].distributorInput = make(chan int, 1)
 	}
 
-}
+	for i, wp := range workerPackages {
+		for direction, neighbour := range wp.Neighbours {
+			// Workers which are their own neighbour wrap their halos locally
+			if neighbour == wp.Index {
+				continue
+			}
 
-func receiveFromDistributor(decoder *gob.Decoder, channels []workerChannel, exit chan byte) {
-	for {
-		var p controllerData
+			owner := initP.Owners[neighbour]
+			if owner == initP.Index {
+				workerChannels[i].inputHalo[direction] = make(chan []byte, 1)
+				workerChannels[neighbour-firstWorker].outputHalo[opposite(direction)] = workerChannels[i].inputHalo[direction]
+				continue
+			}
 
-		err := decoder.Decode(&p)
-		if err != nil {
-			fmt.Println("err", err)
-			break
+			// Halos from other clients may arrive a turn early
+			workerChannels[i].inputHalo[direction] = make(chan []byte, 2)
+			workerChannels[i].outputHalo[direction] = make(chan []byte, 1)
+			remote = append(remote, remoteHalo{i, direction, neighbour, owner})
+
+			known := false
+			for _, peer := range peers {
+				known = known || peer == owner
+			}
+			if !known {
+				peers = append(peers, owner)
+			}
 		}
+	}
+	return remote, peers
+}
 
-		// Exit
-		if p.Index == -1 {
+// Passes commands to the local workers of a job until the distributor shuts it down.
+// Workers still running when the distributor disconnects are stopped.
+func receiveFromDistributor(in chan protocol.Message, channels []workerChannel, firstWorker int, exit chan byte) {
+	for m := range in {
+		if m.Kind == protocol.ShutdownMessage {
 			break
 		}
-		channels[p.Index].distributorInput <- p.Data
+		if m.Kind != protocol.CommandMessage {
+			fmt.Println("Unexpected message from distributor of kind", m.Kind)
+			continue
+		}
+		channels[m.Worker-firstWorker].distributorInput <- m.Data
+	}
+	for i := range channels {
+		close(channels[i].distributorInput)
 	}
 	exit <- 1
 }
 
-func syncWithOtherClients(encoder *gob.Encoder, decoder *gob.Decoder) {
-	// This client is ready to receive
-	err := encoder.Encode(1)
+// Tells the distributor this client is ready for halo connections, and waits until all clients are.
+// Returns false if the job was shut down instead.
+func syncWithOtherClients(encoder jobEncoder, in chan protocol.Message) bool {
+	err := encoder.Encode(protocol.Message{Kind: protocol.ReadyMessage})
 	if err != nil {
 		fmt.Println("err", err)
 	}
 
-	var p int
-	err = decoder.Decode(&p)
-	// All clients are ready to receive
-	if err != nil {
-		fmt.Println("err", err)
+	m, open := <-in
+	if !open || m.Kind == protocol.ShutdownMessage {
+		return false
 	}
-	if p != 1 {
-		fmt.Println("Error from distributor, p =", p)
+	if m.Kind != protocol.ReadyMessage {
+		fmt.Println("Expected all clients to be ready, got message of kind", m.Kind)
 	}
-
+	return true
 }
 
 type haloPacket struct {
-	Index int
-	Data  []byte
+	Index     int // Worker receiving the halo
+	Direction int // Direction the halo comes from, as seen by the receiving worker
+	Data      []byte
 }
 
-func distributor(encoder *gob.Encoder, decoder *gob.Decoder, exitThread []chan byte) int {
-	var haloClients = make([]net.Conn, 2)
-	var done = make(chan net.Listener)
-	var listening = make(chan byte)
+// Sends the messages of one job to its distributor, over the connection shared by every job from it
+type jobEncoder struct {
+	encoder *gob.Encoder
+	job     int
+}
 
-	var initP initPackage
-	err := decoder.Decode(&initP)
-	if err != nil {
-		fmt.Println("err", err)
+func (e jobEncoder) Encode(m protocol.Message) error {
+	m.Job = e.job
+	return e.encoder.Encode(m)
+}
+
+// Part of a job this client runs for a distributor
+type job struct {
+	id       int
+	initP    protocol.InitPackage
+	in       chan protocol.Message   // Messages from the distributor for this job
+	queue    chan<- protocol.Message // Passes messages on to in without waiting, so other jobs are not held up
+	stop     chan struct{}           // Closed when the job has ended, dropping the messages it has not read
+	peers    map[int]haloClient      // Halo connections accepted from other clients of the job
+	accepted chan byte               // Receives once for each accepted halo connection
+}
+
+// Passes the messages from a distributor to the jobs they belong to, while the jobs run
+type router struct {
+	mutex sync.Mutex
+	jobs  map[int]*job
+}
+
+// Passes m to its job, or drops it if the job is not running
+func routeMessage(r *router, m protocol.Message) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	j, running := r.jobs[m.Job]
+	if !running {
+		return
+	}
+	// The queue is only stopped once the job is removed, so it takes the message straight away
+	j.queue <- m
+	if m.Kind == protocol.ShutdownMessage {
+		delete(r.jobs, m.Job)
 	}
+}
 
-	if initP.Clients != 1 {
-		go waitForClients(haloClients, done, listening)
+// Removes a job which has ended, so its messages are dropped
+func removeJob(r *router, j *job) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if r.jobs[j.id] == j {
+		delete(r.jobs, j.id)
 	}
+	close(j.stop)
+}
 
-	workerChannel := make([]workerChannel, initP.Workers)
-	workerPackages := make([]workerPackage, initP.Workers)
-	for i := 0; i < initP.Workers; i++ {
-		var w workerPackage
-		err = decoder.Decode(&w)
-		//fmt.Println(w)
+// Runs the jobs of every distributor this client is connected to
+type daemon struct {
+	mutex        sync.Mutex
+	jobs         map[*job]bool
+	workers      int // Workers running over all jobs
+	maxJobs      int // Most jobs run at once, 0 for no limit
+	maxWorkers   int // Most workers run at once over all jobs, 0 for no limit
+	capabilities []string
+	config       *tls.Config
+}
+
+// Reserves the resources of a job, or returns why it cannot run
+func startJob(d *daemon, id int, initP protocol.InitPackage) (*job, error) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	if d.maxJobs > 0 && len(d.jobs) >= d.maxJobs {
+		return nil, fmt.Errorf("already running %d jobs", len(d.jobs))
+	}
+	if d.maxWorkers > 0 && d.workers+initP.Workers > d.maxWorkers {
+		return nil, fmt.Errorf("%d workers would exceed the limit of %d, %d are running", initP.Workers, d.maxWorkers, d.workers)
+	}
+
+	j := &job{
+		id:       id,
+		initP:    initP,
+		in:       make(chan protocol.Message, 2*initP.Workers+2),
+		stop:     make(chan struct{}),
+		peers:    make(map[int]haloClient),
+		accepted: make(chan byte, len(initP.Peers)),
+	}
+	j.queue = protocol.Queue(j.in, j.stop)
+	d.jobs[j] = true
+	d.workers += initP.Workers
+	return j, nil
+}
+
+// Releases the resources of a job
+func endJob(d *daemon, j *job) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	delete(d.jobs, j)
+	d.workers -= j.initP.Workers
+}
+
+// Runs the workers of a job, until they are done and the distributor has shut the job down.
+// compressed is true if the connection to the distributor is compressed.
+func runJob(d *daemon, jobs *router, j *job, encoder jobEncoder, compressed bool) {
+	// Once the resources of the job are free the distributor may send another one
+	defer func() {
+		removeJob(jobs, j)
+		endJob(d, j)
+		err := encoder.Encode(protocol.Message{Kind: protocol.ShutdownMessage})
 		if err != nil {
 			fmt.Println("err", err)
-			break
 		}
-		//
-		//fmt.Println("Received worker package,", w.StartX, w.EndX)
+	}()
+	initP := j.initP
+	exit := make(chan byte)
 
+	workerChannel := make([]workerChannel, initP.Workers)
+	workerPackages := make([]protocol.WorkerPackage, initP.Workers)
+	for i := 0; i < initP.Workers; i++ {
+		m, open := <-j.in
+		if !open || m.Kind == protocol.ShutdownMessage {
+			fmt.Println("Job", j.id, "was shut down before starting")
+			return
+		}
+		if m.Kind != protocol.AssignMessage || m.Assign == nil {
+			failJob(encoder, fmt.Errorf("expected a worker, got message of kind %d", m.Kind))
+			return
+		}
+
+		w := *m.Assign
+		if i > 0 && w.Index != workerPackages[0].Index+i {
+			failJob(encoder, fmt.Errorf("expected worker %d, got worker %d", workerPackages[0].Index+i, w.Index))
+			return
+		}
+		err := unpackTile(&w, initP.Depth)
+		if err != nil {
+			failJob(encoder, fmt.Errorf("worker %d: %v", w.Index, err))
+			return
+		}
 		workerPackages[i] = w
-		initialiseChannels(workerChannel, initP.Workers, initP.Clients, initP.Width, w.EndX, w.StartX, i)
+	}
+	remote, peers := initialiseChannels(workerChannel, workerPackages, initP)
+
+	// The halo socket is always listening, so once every client is ready they can connect to each other
+	if !syncWithOtherClients(encoder, j.in) {
+		fmt.Println("Job", j.id, "was shut down before starting")
+		return
 	}
 
-	// Wait until the program binds to port, then sync to this point with all clients. At this point all of them are listening and ready for connections
-	if initP.Clients > 1 {
-		<-listening
+	// Connect to external halo sockets, and wait for the other clients to connect to this one
+	for _, peer := range peers {
+		h := protocol.Hello{Capabilities: d.capabilities, Client: initP.Index, Job: j.id, Token: initP.Peers[peer]}
+		go receiveFromClient(initP.Ips[peer], h, d.config, workerChannel, workerPackages, initP.Depth, encoder, exit)
+	}
+	for range peers {
+		<-j.accepted
 	}
-	syncWithOtherClients(encoder, decoder)
 
-	var ln net.Listener
-	// Connect to external halo sockets
-	if initP.Clients > 1 {
-		go receiveFromClient(initP.IpBefore, [2]chan byte{workerChannel[0].inputHalo[0], workerChannel[initP.Workers-1].inputHalo[1]}, initP.Width, initP.Turns, exitThread[1])
-		go receiveFromClient(initP.IpAfter, [2]chan byte{workerChannel[0].inputHalo[0], workerChannel[initP.Workers-1].inputHalo[1]}, initP.Width, initP.Turns, exitThread[2])
+	go receiveFromDistributor(j.in, workerChannel, workerPackages[0].Index, exit)
 
-		ln = <-done
+	packets := make(map[int]chan haloPacket)
+	for _, peer := range peers {
+		packets[peer] = make(chan haloPacket, 8)
+		go serveToClient(j.peers[peer], packets[peer], exit)
 	}
 
-	go receiveFromDistributor(decoder, workerChannel, exitThread[0])
-
-	if initP.Clients != 1 {
-		ip0, _, _ := net.SplitHostPort(haloClients[0].RemoteAddr().String())
-		ip1, _, _ := net.SplitHostPort(haloClients[1].RemoteAddr().String())
-		if ip0 == initP.IpBefore && ip1 == initP.IpAfter {
-			go serveToClient(haloClients[0], 1, workerChannel[0].outputHalo[0], initP.Width, initP.Turns, exitThread[3])
-			go serveToClient(haloClients[1], 0, workerChannel[initP.Workers-1].outputHalo[1], initP.Width, initP.Turns, exitThread[4])
-		} else if ip0 == initP.IpAfter && ip1 == initP.IpBefore {
-			go serveToClient(haloClients[1], 1, workerChannel[0].outputHalo[0], initP.Width, initP.Turns, exitThread[3])
-			go serveToClient(haloClients[0], 0, workerChannel[initP.Workers-1].outputHalo[1], initP.Width, initP.Turns, exitThread[4])
-		} else {
-			fmt.Println("IPs are mismatched")
-		}
-	} else {
-		// Only local workers
-		workerChannel[initP.Workers-1].outputHalo[1] = workerChannel[0].inputHalo[0]
-		workerChannel[0].outputHalo[0] = workerChannel[initP.Workers-1].inputHalo[1]
+	collected := make(chan byte, len(remote))
+	for _, h := range remote {
+		go forwardHalo(workerChannel[h.worker].outputHalo[h.direction], h.neighbour, opposite(h.direction), packets[h.owner], collected)
 	}
 
 	for i := 0; i < initP.Workers; i++ {
-		go worker(initP, workerChannel[i], workerPackages[i], encoder)
+		go worker(initP, workerChannel[i], workerPackages[i], encoder, compressed)
 	}
 
-	fmt.Println("All workers active")
+	fmt.Println("All workers of job", j.id, "active")
 	var r byte
 	for i := 0; i < initP.Workers; i++ {
 		r = <-workerChannel[i].localDistributor
 	}
 
-	if initP.Clients != 1 {
-		err = ln.Close()
-		if err != nil {
-			fmt.Println(err)
-		}
+	// Flush the halos still being sent to other clients, then close the connections
+	for _, h := range remote {
+		close(workerChannel[h.worker].outputHalo[h.direction])
 	}
-	fmt.Println("Done")
-	if r == 1 {
-		return -1 // Quit command
+	for range remote {
+		<-collected
 	}
-	if initP.Clients == 1 {
-		return 1 // Just local client, no halo sockets
+	for _, c := range packets {
+		close(c)
+	}
+
+	// Wait for the connections to the distributor and other clients to finish
+	for i := 0; i < 1+2*len(peers); i++ {
+		<-exit
+	}
+
+	if r == 1 {
+		fmt.Println("Job", j.id, "quit")
+	} else {
+		fmt.Println("Job", j.id, "done")
 	}
-	return 0 // Normal termination
 }
 
-func serveToClient(conn net.Conn, index int, c chan byte, width int, turns int, exit chan byte) {
-	enc := gob.NewEncoder(conn)
-	for i := 0; i < turns; i++ {
-		var haloData = make([]byte, width)
+// Tells the distributor why this client cannot go on with a job, so it fails the job
+func failJob(encoder jobEncoder, err error) {
+	fmt.Println("Job", encoder.job, "failed:", err)
+	err = encoder.Encode(protocol.Message{Kind: protocol.RejectMessage, Error: err.Error()})
+	if err != nil {
+		fmt.Println("err", err)
+	}
+}
 
-		for i := 0; i < width; i++ {
-			haloData[i] = <-c
+// Restores the world of a worker sent compressed, and checks that it is the tile surrounded by depth rows of halo
+func unpackTile(w *protocol.WorkerPackage, depth int) error {
+	height, width := w.EndX-w.StartX+2*depth, w.EndY-w.StartY+2*depth
+	if depth < 1 || w.EndX <= w.StartX || w.EndY <= w.StartY {
+		return fmt.Errorf("tile %d-%d by %d-%d with halos of depth %d is empty", w.StartX, w.EndX, w.StartY, w.EndY, depth)
+	}
+	if w.Packed != nil {
+		cells, err := protocol.Decompress(w.Packed, height*width)
+		if err != nil {
+			return err
 		}
+		w.World, err = protocol.Unflatten(cells, width)
+		if err != nil {
+			return err
+		}
+	}
+	if len(w.World) != height {
+		return fmt.Errorf("tile has %d rows instead of %d", len(w.World), height)
+	}
+	for _, row := range w.World {
+		if len(row) != width {
+			return fmt.Errorf("tile has a row of %d cells instead of %d", len(row), width)
+		}
+	}
+	return nil
+}
 
-		err := enc.Encode(haloPacket{index, haloData})
+// Wraps the halos a worker sends to a worker on another client into packets
+func forwardHalo(c chan []byte, index, direction int, packets chan haloPacket, collected chan byte) {
+	for haloData := range c {
+		packets <- haloPacket{index, direction, haloData}
+	}
+	collected <- 1
+}
 
+func serveToClient(client haloClient, packets chan haloPacket, exit chan byte) {
+	var err error
+	for p := range packets {
+		// Once the connection fails the packets are dropped, so the workers are not held up until the job is shut down
+		if err != nil {
+			continue
+		}
+		if client.compress {
+			p.Data = protocol.Compress(p.Data)
+		}
+		err = client.encoder.Encode(p)
 		if err != nil {
 			fmt.Println("err", err)
-			break
 		}
 	}
 
+	err = client.conn.Close()
+	if err != nil {
+		fmt.Println("err", err)
+	}
 	exit <- 1
 }
 
-func waitForClients(clients []net.Conn, done chan net.Listener, listening chan byte) {
-	ln, err := net.Listen("tcp4", ":4001")
-	if err != nil {
-		fmt.Println("err", err)
-		return
+// Accepts halo connections for every job, for as long as the daemon runs
+func waitForClients(d *daemon, ln net.Listener) {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			fmt.Println("err", err)
+			return
+		}
+		go acceptClient(d, conn)
 	}
-	listening <- 1
+}
 
-	if ln != nil {
-		for i := 0; i < 2; i++ {
-			conn, _ := ln.Accept()
-			clients[i] = conn
+// Finds the job a halo connection is for and hands it over.
+// Clients which are not neighbours the distributor assigned in that job, or which connect twice, are refused.
+func acceptClient(d *daemon, conn net.Conn) {
+	// The connecting client first says which one it is, and proves it with the secret the distributor gave to both
+	var j *job
+	ip, _, _ := net.SplitHostPort(conn.RemoteAddr().String())
+	authorise := func(h protocol.Hello) error {
+		d.mutex.Lock()
+		defer d.mutex.Unlock()
+		for candidate := range d.jobs {
+			token, neighbour := candidate.initP.Peers[h.Client]
+			if candidate.id == h.Job && neighbour && protocol.ValidToken(h.Token, token) {
+				j = candidate
+			}
+		}
+		if j == nil {
+			return errors.New("not a neighbour assigned by the distributor")
+		}
+		if _, connected := j.peers[h.Client]; connected {
+			return errors.New("already connected")
 		}
-		done <- ln
+		if ip != j.initP.Ips[h.Client] {
+			return errors.New("connecting from " + ip + " instead of " + j.initP.Ips[h.Client])
+		}
+		return nil
+	}
+
+	encoder := gob.NewEncoder(conn)
+	h, shared, err := protocol.AcceptHello(encoder, gob.NewDecoder(conn), d.capabilities, authorise)
+	if err != nil {
+		fmt.Println("Refused halo connection:", err)
+		_ = conn.Close()
+		return
 	}
+
+	d.mutex.Lock()
+	j.peers[h.Client] = haloClient{conn, encoder, protocol.HasCapability(shared, protocol.CompressionCapability)}
+	d.mutex.Unlock()
+	j.accepted <- 1
 }
 
-func receiveFromClient(ip string, c [2]chan byte, width int, turns int, exit chan byte) {
-	conn, err := net.Dial("tcp4", ip+":4001")
+// Receives the halos another client sends to the workers of a job, until it closes the connection.
+// A halo which cannot be used fails the job, as the workers waiting for it could never go on.
+func receiveFromClient(ip string, h protocol.Hello, config *tls.Config, channels []workerChannel, packages []protocol.WorkerPackage, depth int, encoder jobEncoder, exit chan byte) {
+	conn, err := protocol.Dial(ip+":4001", config)
 	if err != nil {
-		fmt.Println("err", err)
+		failJob(encoder, err)
 		exit <- 1
 		return
 	}
 
 	dec := gob.NewDecoder(conn)
-	for i := 0; i < turns; i++ {
+	shared, err := protocol.SendHello(gob.NewEncoder(conn), dec, h)
+	if err != nil {
+		failJob(encoder, err)
+		_ = conn.Close()
+		exit <- 1
+		return
+	}
+	compressed := protocol.HasCapability(shared, protocol.CompressionCapability)
+
+	for {
 		var haloP haloPacket
 		err := dec.Decode(&haloP)
-		//fmt.Println("Received from socket,", haloData)
 
 		if err != nil {
-			fmt.Println("err", err)
-			return
+			if err != io.EOF {
+				fmt.Println("err", err)
+			}
+			break
 		}
 
-		// Take bytes from haloData row slice and put them in the channel
-		for _, b := range haloP.Data {
-			c[haloP.Index] <- b
+		err = receiveHalo(&haloP, channels, packages, depth, compressed)
+		if err != nil {
+			failJob(encoder, fmt.Errorf("halo from client %d: %v", h.Client, err))
+			break
 		}
+		channels[haloP.Index-packages[0].Index].inputHalo[haloP.Direction] <- haloP.Data
 	}
 
+	_ = conn.Close()
 	exit <- 1
 }
 
-func main() {
-	defaultHostname := "127.0.0.1"
-	var hostname string
-
-	flag.StringVar(&hostname, "hostname", defaultHostname, "The hostname of the server.")
-	flag.Parse()
+// Restores a halo from another client sent compressed, and returns why it cannot be given to a worker, or nil if it can
+func receiveHalo(haloP *haloPacket, channels []workerChannel, packages []protocol.WorkerPackage, depth int, compressed bool) error {
+	i := haloP.Index - packages[0].Index
+	if i < 0 || i >= len(packages) || haloP.Direction < 0 || haloP.Direction >= len(offsets) {
+		return fmt.Errorf("worker %d has no halo in direction %d on this client", haloP.Index, haloP.Direction)
+	}
+	if channels[i].inputHalo[haloP.Direction] == nil {
+		return fmt.Errorf("worker %d has no neighbour in direction %d", haloP.Index, haloP.Direction)
+	}
+	wp := packages[i]
+	startX, endX, startY, endY := haloRegion(haloP.Direction, wp.EndX-wp.StartX, wp.EndY-wp.StartY, depth, true)
+	size := (endX - startX) * (endY - startY)
+	if compressed {
+		cells, err := protocol.Decompress(haloP.Data, size)
+		if err != nil {
+			return err
+		}
+		haloP.Data = cells
+	}
+	if len(haloP.Data) != size {
+		return fmt.Errorf("halo has %d cells instead of %d", len(haloP.Data), size)
+	}
+	return nil
+}
 
+// Connects to a distributor and runs the jobs it sends, until it disconnects
+func serveDistributor(d *daemon, hostname, token string, compression bool, done chan byte) {
 	fmt.Println("Connecting to", hostname)
 
-	conn, err := net.Dial("tcp4", hostname+":4000")
+	conn, err := protocol.Dial(hostname+":4000", d.config)
 	if err != nil {
-		fmt.Println("Server is offline")
+		fmt.Println("Server is offline:", err)
+		done <- 1
 		return
 	}
 	fmt.Println("Connected to server")
 
-	exitThread := make([]chan byte, 5)
-	for i := 0; i < 5; i++ {
-		exitThread[i] = make(chan byte, 1)
-	}
-
 	dec := gob.NewDecoder(conn)
 	enc := gob.NewEncoder(conn)
 
+	// Agree with the distributor on the protocol version, and whether worlds are sent compressed
+	shared, err := protocol.SendHello(enc, dec, protocol.Hello{Capabilities: protocol.Capabilities(compression), Token: token})
+	if err != nil {
+		fmt.Println(err)
+		_ = conn.Close()
+		done <- 1
+		return
+	}
+	compressed := protocol.HasCapability(shared, protocol.CompressionCapability)
+
+	// Jobs of this distributor which have not been shut down
+	r := &router{jobs: make(map[int]*job)}
 	for {
-		var packetType int = 0
-		err := dec.Decode(&packetType)
+		var m protocol.Message
+		err := dec.Decode(&m)
 		if err != nil {
 			if err == io.EOF {
-				fmt.Println("Connection closed, exiting worker.")
-				return
+				fmt.Println("Connection to", hostname, "closed.")
+			} else {
+				fmt.Println("err", err)
 			}
-			fmt.Println("err", err)
 			break
 		}
 
-		if packetType == INIT {
-			fmt.Println("Starting workers..")
-			result := distributor(enc, dec, exitThread)
-			waitForX := 5
-
-			if result == -1 || result == 1 {
-				waitForX = 1
-			}
-			for i := 0; i < waitForX; i++ {
-				<-exitThread[i]
-			}
-
-			if result == -1 { // If quit command, quit worker program
-				return
+		if m.Kind == protocol.InitMessage && m.Init != nil {
+			j, err := startJob(d, m.Job, *m.Init)
+			if err != nil {
+				fmt.Println("Refused job", m.Job, "from", hostname+":", err)
+				err = enc.Encode(protocol.Message{Kind: protocol.RejectMessage, Job: m.Job, Error: err.Error()})
+				if err != nil {
+					fmt.Println("err", err)
+				}
+				continue
 			}
+			fmt.Println("Starting job", m.Job, "from", hostname)
+			r.mutex.Lock()
+			r.jobs[m.Job] = j
+			r.mutex.Unlock()
+			go runJob(d, r, j, jobEncoder{enc, m.Job}, compressed)
+			continue
 		}
+
+		// Messages of refused and ended jobs are dropped
+		routeMessage(r, m)
+	}
+
+	// The jobs of a distributor which has gone are stopped
+	r.mutex.Lock()
+	for id, j := range r.jobs {
+		close(j.queue)
+		delete(r.jobs, id)
+	}
+	r.mutex.Unlock()
+	done <- 1
+}
+
+func main() {
+	defaultHostname := "127.0.0.1"
+	var hostnames string
+	var compression bool
+	var certFile, keyFile, caFile, token string
+	d := daemon{jobs: make(map[*job]bool)}
+
+	flag.StringVar(&hostnames, "hostname", defaultHostname, "The hostnames of the servers to run jobs for, separated by commas.")
+	flag.BoolVar(&compression, "compress", true, "Compress worlds and halos sent over the network, when the other end supports it.")
+	flag.StringVar(&certFile, "cert", "", "Certificate of this machine, for TLS. Defaults to plain TCP.")
+	flag.StringVar(&keyFile, "key", "", "Private key of the certificate, for TLS.")
+	flag.StringVar(&caFile, "ca", "", "CA which signs the certificates of the distributor and every client, for TLS.")
+	flag.StringVar(&token, "token", "", "Secret the distributor requires to join. Defaults to none.")
+	flag.IntVar(&d.maxJobs, "jobs", 4, "Most jobs run at once, 0 for no limit. Defaults to 4.")
+	flag.IntVar(&d.maxWorkers, "workers", 0, "Most workers run at once over all jobs, 0 for no limit. Defaults to 0.")
+	flag.Parse()
+
+	var err error
+	d.config, err = protocol.LoadTLS(certFile, keyFile, caFile)
+	if err != nil {
+		fmt.Println("Could not load TLS certificates:", err)
+		return
+	}
+	d.capabilities = protocol.Capabilities(compression)
+
+	// One halo socket serves every job
+	ln, err := protocol.Listen(":4001", d.config)
+	if err != nil {
+		fmt.Println("Could not listen to port 4001", err)
+		return
+	}
+	go waitForClients(&d, ln)
+
+	servers := strings.Split(hostnames, ",")
+	done := make(chan byte)
+	for _, hostname := range servers {
+		go serveDistributor(&d, strings.TrimSpace(hostname), token, compression, done)
+	}
+	for range servers {
+		<-done
 	}
+	fmt.Println("All servers disconnected, exiting worker.")
 }